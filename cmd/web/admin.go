@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+const adminUsersPageSize = 20
+
+func (app *application) handleAdminUsersGet(w http.ResponseWriter, r *http.Request) error {
+	qs := r.URL.Query()
+
+	var data struct {
+		Search   string
+		Users    []*models.User
+		Metadata models.Metadata
+	}
+
+	data.Search = qs.Get("q")
+
+	filters := models.Filters{
+		Page:     max(readInt(qs, "page", 1), 1),
+		PageSize: adminUsersPageSize,
+	}
+
+	var err error
+	data.Users, data.Metadata, err = app.models.User.GetAll(r.Context(), data.Search, filters)
+	if err != nil {
+		return err
+	}
+
+	return app.render(w, r, http.StatusOK, "admin-users.tmpl", data)
+}
+
+func (app *application) handleAdminUsersPost(w http.ResponseWriter, r *http.Request) error {
+	var form struct {
+		Username string `form:"username" validate:"required,max=254"`
+		Password string `form:"password" validate:"required,min=8,max=72"`
+	}
+
+	err := app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.User.New(r.Context(), form.Username, form.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateUsername) {
+			return FormErrors{"Username": "username is already taken"}
+		}
+
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: fmt.Sprintf("Created user %s.", user.Username),
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+
+	return nil
+}
+
+func (app *application) handleAdminUserGet(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.readUserParam(r)
+	if err != nil {
+		if errors.Is(err, errInvalidIDParam) || errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, "user not found")
+		}
+
+		return err
+	}
+
+	var data struct {
+		User             *models.User
+		Permissions      models.Permissions
+		AllPermissions   models.Permissions
+		TwoFactorEnabled bool
+		LoginThrottle    *models.LoginThrottle
+		Sessions         []*models.UserSession
+	}
+
+	data.User = user
+
+	data.Sessions, err = app.models.UserSession.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	data.LoginThrottle, err = app.models.LoginThrottle.Get(r.Context(), usernameThrottleKey(user.Username))
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		return err
+	}
+
+	data.TwoFactorEnabled, err = app.models.TwoFactor.Enabled(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	data.Permissions, err = app.models.Permission.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	data.AllPermissions, err = app.models.Permission.GetAll(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return app.render(w, r, http.StatusOK, "admin-user.tmpl", data)
+}
+
+func (app *application) handleAdminUserPasswordPost(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.readUserParam(r)
+	if err != nil {
+		if errors.Is(err, errInvalidIDParam) || errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, "user not found")
+		}
+
+		return err
+	}
+
+	var form struct {
+		Password string `form:"password" validate:"required,min=8,max=72"`
+		Version  int    `form:"version" validate:"required"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	err = app.setUserPassword(r.Context(), user, form.Password, form.Version)
+	if err != nil {
+		if errors.Is(err, models.ErrEditConflict) {
+			return FormErrors{"Version": editConflictMessage}
+		}
+
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: fmt.Sprintf("Reset password for %s.", user.Username),
+	}
+	app.putFlash(r, f)
+	app.refresh(w, r)
+
+	return nil
+}
+
+// Clear the failed logins counted against the user's username, lifting a
+// lockout. Blocks on client IPs are left alone.
+func (app *application) handleAdminUserUnlockPost(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.readUserParam(r)
+	if err != nil {
+		if errors.Is(err, errInvalidIDParam) || errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, "user not found")
+		}
+
+		return err
+	}
+
+	err = app.models.LoginThrottle.Reset(r.Context(), usernameThrottleKey(user.Username))
+	if err != nil {
+		return err
+	}
+
+	app.securityEvent(r, "account_unlocked", slog.String("username", user.Username))
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: fmt.Sprintf("Unlocked %s.", user.Username),
+	}
+	app.putFlash(r, f)
+	app.refresh(w, r)
+
+	return nil
+}
+
+// Log the user out of every device
+func (app *application) handleAdminUserSessionsRevokePost(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.readUserParam(r)
+	if err != nil {
+		if errors.Is(err, errInvalidIDParam) || errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, "user not found")
+		}
+
+		return err
+	}
+
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	err = app.revokeSessions(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	app.securityEvent(r, "sessions_revoked", slog.String("username", user.Username))
+
+	if user.ID == suid {
+		err = app.logout(w, r)
+		if err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+
+		return nil
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: fmt.Sprintf("Logged %s out of every device and revoked their access tokens.", user.Username),
+	}
+	app.putFlash(r, f)
+	app.refresh(w, r)
+
+	return nil
+}
+
+func (app *application) handleAdminUserGrantPost(w http.ResponseWriter, r *http.Request) error {
+	return app.updateUserPermission(w, r, true)
+}
+
+func (app *application) handleAdminUserRevokePost(w http.ResponseWriter, r *http.Request) error {
+	return app.updateUserPermission(w, r, false)
+}
+
+func (app *application) updateUserPermission(w http.ResponseWriter, r *http.Request, grant bool) error {
+	user, err := app.readUserParam(r)
+	if err != nil {
+		if errors.Is(err, errInvalidIDParam) || errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, "user not found")
+		}
+
+		return err
+	}
+
+	var form struct {
+		Permission string `form:"permission" validate:"required"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	err = app.setUserPermission(r.Context(), suid, user, form.Permission, grant)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Revoked %s from %s.", form.Permission, user.Username)
+	if grant {
+		msg = fmt.Sprintf("Granted %s to %s.", form.Permission, user.Username)
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: msg,
+	}
+	app.putFlash(r, f)
+	app.refresh(w, r)
+
+	return nil
+}
+
+func (app *application) handleAdminUserDeletePost(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.readUserParam(r)
+	if err != nil {
+		if errors.Is(err, errInvalidIDParam) || errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, "user not found")
+		}
+
+		return err
+	}
+
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	err = app.deleteUser(r.Context(), suid, user)
+	if err != nil {
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: fmt.Sprintf("Deleted user %s.", user.Username),
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+
+	return nil
+}
+
+func (app *application) handleAdminPermissionsGet(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		Permissions      models.Permissions
+		TwoFactorEnabled models.Permissions
+	}
+
+	var err error
+	data.Permissions, err = app.models.Permission.GetAll(r.Context())
+	if err != nil {
+		return err
+	}
+
+	data.TwoFactorEnabled, err = app.models.Permission.GetAllRequiringTwoFactor(r.Context())
+	if err != nil {
+		return err
+	}
+
+	return app.render(w, r, http.StatusOK, "admin-permissions.tmpl", data)
+}
+
+func (app *application) handleAdminPermissionsTwoFactorPost(w http.ResponseWriter, r *http.Request) error {
+	var form struct {
+		Permission string `form:"permission" validate:"required"`
+		Required   bool   `form:"required"`
+	}
+
+	err := app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Permission.SetRequiresTwoFactor(r.Context(), form.Permission, form.Required)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return FormErrors{"Permission": "unknown permission"}
+		}
+
+		return err
+	}
+
+	msg := fmt.Sprintf("Holders of %s no longer need two-factor authentication.", form.Permission)
+	if form.Required {
+		msg = fmt.Sprintf("Holders of %s now need two-factor authentication.", form.Permission)
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: msg,
+	}
+	app.putFlash(r, f)
+	app.refresh(w, r)
+
+	return nil
+}
+
+// Get the user identified by the "id" URL parameter
+func (app *application) readUserParam(r *http.Request) (*models.User, error) {
+	id, err := readIDParam(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.models.User.GetWithID(r.Context(), id)
+}
+
+// The rules below are shared by the admin console and the API. Broken rules
+// return FormErrors.
+
+// Replace the password of a user at the given version and log them out
+// everywhere. Returns models.ErrEditConflict if the user changed since.
+func (app *application) setUserPassword(ctx context.Context, user *models.User, password string, version int) error {
+	err := app.models.User.SetPassword(user, password)
+	if err != nil {
+		return err
+	}
+
+	// Update the version the admin was looking at, not the latest one
+	user.Version = version
+
+	err = app.models.User.Update(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	// Force the user to log in again with the new password
+	return app.revokeSessions(ctx, user.ID)
+}
+
+// Grant or revoke a permission on behalf of the admin actorID.
+func (app *application) setUserPermission(ctx context.Context, actorID int, user *models.User, code string, grant bool) error {
+	all, err := app.models.Permission.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !all.Include(code) {
+		return FormErrors{"Permission": "unknown permission"}
+	}
+
+	// Admins cannot lock themselves out of the console
+	if !grant && user.ID == actorID && code == "admin" {
+		return FormErrors{"Permission": "cannot revoke your own admin permission"}
+	}
+
+	if grant && user.Unverified() {
+		return FormErrors{"Permission": "the user has not verified their email address"}
+	}
+
+	if grant {
+		return app.models.Permission.Grant(ctx, user.ID, code)
+	}
+
+	return app.models.WithTx(ctx, func(m models.Models) error {
+		if code == "admin" {
+			last, err := isLastAdmin(ctx, m, user.ID)
+			if err != nil {
+				return err
+			}
+
+			if last {
+				return FormErrors{"Permission": "cannot revoke the admin permission of the last admin"}
+			}
+		}
+
+		return m.Permission.Revoke(ctx, user.ID, code)
+	})
+}
+
+// Delete a user on behalf of the admin actorID.
+func (app *application) deleteUser(ctx context.Context, actorID int, user *models.User) error {
+	if user.ID == actorID {
+		return FormErrors{"User": "cannot delete your own account"}
+	}
+
+	// The session index goes with the user, so read it first. Tokens and
+	// remember me devices are deleted with the user.
+	hashes, err := app.models.UserSession.GetTokenHashesForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.WithTx(ctx, func(m models.Models) error {
+		last, err := isLastAdmin(ctx, m, user.ID)
+		if err != nil {
+			return err
+		}
+
+		if last {
+			return FormErrors{"User": "cannot delete the last admin"}
+		}
+
+		return m.User.Delete(ctx, user.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	return app.destroySessions(ctx, hashes...)
+}
+
+// Check if the user is the only one left holding the admin permission. Run in
+// the same transaction as the change, so that two admins removing each other
+// cannot both succeed.
+func isLastAdmin(ctx context.Context, m models.Models, userID int) (bool, error) {
+	admin, err := m.Permission.Check(ctx, userID, "admin")
+	if err != nil || !admin {
+		return false, err
+	}
+
+	n, err := m.Permission.CountHolders(ctx, "admin")
+	if err != nil {
+		return false, err
+	}
+
+	return n <= 1, nil
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/micahco/web-lite/internal/models"
+)
+
+// Error codes of the API, one per status it returns
+const (
+	apiCodeBadRequest       = "bad_request"
+	apiCodeUnauthorized     = "unauthorized"
+	apiCodeForbidden        = "forbidden"
+	apiCodeNotFound         = "not_found"
+	apiCodeMethodNotAllowed = "method_not_allowed"
+	apiCodeConflict         = "conflict"
+	apiCodeValidation       = "validation_failed"
+	apiCodeTooManyRequests  = "too_many_requests"
+	apiCodeInternal         = "internal_error"
+)
+
+func apiErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return apiCodeBadRequest
+	case http.StatusUnauthorized:
+		return apiCodeUnauthorized
+	case http.StatusForbidden:
+		return apiCodeForbidden
+	case http.StatusNotFound:
+		return apiCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return apiCodeMethodNotAllowed
+	case http.StatusConflict:
+		return apiCodeConflict
+	case http.StatusUnprocessableEntity:
+		return apiCodeValidation
+	case http.StatusTooManyRequests:
+		return apiCodeTooManyRequests
+	default:
+		return apiCodeInternal
+	}
+}
+
+// apiErrorResponse is the body of every failed API request
+type apiErrorResponse struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Validation failures by JSON field name
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// http.HandlerFunc wrapper with error handling for JSON endpoints. FormErrors,
+// from request validation or the rules shared with the HTML handlers, become
+// a 422 with a field map.
+func (app *application) handleAPI(h withError) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			var formErrors FormErrors
+			switch {
+			case errors.As(err, &formErrors):
+				app.apiValidationError(w, r, formErrors)
+			case errors.Is(err, errInvalidJSON):
+				app.apiError(w, r, http.StatusBadRequest, err.Error())
+			default:
+				app.requestLogger(r).Error("handled unexpected error", slog.Any("err", err), slog.String("type", fmt.Sprintf("%T", err)))
+
+				app.apiError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			}
+		}
+	}
+}
+
+func (app *application) apiError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	app.writeAPIError(w, r, status, apiErrorBody{
+		Code:    apiErrorCode(status),
+		Message: message,
+	})
+}
+
+func (app *application) apiValidationError(w http.ResponseWriter, r *http.Request, formErrors FormErrors) {
+	fields := make(map[string]string, len(formErrors))
+	for name, msg := range formErrors {
+		fields[jsonFieldName(name)] = msg
+	}
+
+	app.writeAPIError(w, r, http.StatusUnprocessableEntity, apiErrorBody{
+		Code:    apiCodeValidation,
+		Message: "the request is invalid",
+		Fields:  fields,
+	})
+}
+
+// Refuse a rate limited request, telling the client when to retry.
+func (app *application) apiTooManyRequests(w http.ResponseWriter, r *http.Request, until time.Time) {
+	seconds := int(math.Ceil(time.Until(until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+
+	app.apiError(w, r, http.StatusTooManyRequests, "too many requests, try again "+retryIn(time.Until(until)))
+}
+
+func (app *application) writeAPIError(w http.ResponseWriter, r *http.Request, status int, body apiErrorBody) {
+	err := writeJSON(w, status, apiErrorResponse{Error: body})
+	if err != nil {
+		app.requestLogger(r).Error("write api error", slog.Any("err", err))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (app *application) handleAPINotFound(w http.ResponseWriter, r *http.Request) {
+	app.apiError(w, r, http.StatusNotFound, "no such endpoint")
+}
+
+func (app *application) handleAPIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	app.apiError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// JSON name of a struct field, which the API always spells in snake case,
+// e.g. "expires_in" for ExpiresIn.
+func jsonFieldName(field string) string {
+	runes := []rune(field)
+	var b []rune
+
+	for i, c := range runes {
+		if unicode.IsUpper(c) && i > 0 {
+			prevLower := !unicode.IsUpper(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b = append(b, '_')
+			}
+		}
+
+		b = append(b, unicode.ToLower(c))
+	}
+
+	return string(b)
+}
+
+// Decode a JSON request body and check its validate tags, like parseForm
+// does for HTML forms.
+func (app *application) readAPIRequest(w http.ResponseWriter, r *http.Request, dst any) error {
+	err := readJSON(w, r, dst)
+	if err != nil {
+		return err
+	}
+
+	return app.validateStruct(dst)
+}
+
+// Read the user named by the "id" URL parameter, writing a 404 if there is
+// none. Returns nil if the response was written.
+func (app *application) readAPIUserParam(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	user, err := app.readUserParam(r)
+	if err != nil {
+		if errors.Is(err, errInvalidIDParam) || errors.Is(err, models.ErrNoRecord) {
+			app.apiError(w, r, http.StatusNotFound, "user not found")
+
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return user, nil
+}
+
+type apiMessageResponse struct {
+	Message string `json:"message"`
+}
+
+// apiUser is the public representation of a user
+type apiUser struct {
+	ID         int        `json:"id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email,omitempty"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// Sent back when changing the user, to detect concurrent edits
+	Version int `json:"version"`
+}
+
+func newAPIUser(u *models.User) apiUser {
+	a := apiUser{
+		ID:       u.ID,
+		Username: u.Username,
+		Email:    u.Email,
+		Version:  u.Version,
+	}
+
+	if !u.VerifiedAt.IsZero() {
+		a.VerifiedAt = &u.VerifiedAt
+	}
+
+	return a
+}
+
+type apiToken struct {
+	ID          int                `json:"id"`
+	Name        string             `json:"name"`
+	Permissions models.Permissions `json:"permissions"`
+	CreatedAt   time.Time          `json:"created_at"`
+	Expiry      time.Time          `json:"expiry"`
+	LastUsedAt  *time.Time         `json:"last_used_at,omitempty"`
+}
+
+func newAPIToken(t *models.AccessToken) apiToken {
+	a := apiToken{
+		ID:          t.ID,
+		Name:        t.Name,
+		Permissions: t.Permissions,
+		CreatedAt:   t.CreatedAt,
+		Expiry:      t.Expiry,
+	}
+
+	if a.Permissions == nil {
+		a.Permissions = models.Permissions{}
+	}
+
+	if !t.LastUsedAt.IsZero() {
+		a.LastUsedAt = &t.LastUsedAt
+	}
+
+	return a
+}
+
+type apiSignupRequest struct {
+	Username string `json:"username" validate:"required,max=254"`
+	// Required when email verification is enabled, ignored otherwise
+	Email    string `json:"email" validate:"omitempty,email,max=254"`
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
+
+// Same rules and response as the signup form
+func (app *application) handleAPIAuthSignupPost(w http.ResponseWriter, r *http.Request) error {
+	var req apiSignupRequest
+
+	err := app.readAPIRequest(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	until, err := app.recordSignup(r, req.Username)
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		app.apiTooManyRequests(w, r, until)
+
+		return nil
+	}
+
+	err = app.signup(r, req.Username, req.Email, req.Password)
+	if err != nil {
+		return err
+	}
+
+	msg := "If that username was available, the account has been created."
+	if app.config.verifyEmail {
+		msg = "If that username was available, the account has been created. Follow the link sent to its email address to verify it."
+	}
+
+	return writeJSON(w, http.StatusAccepted, apiMessageResponse{Message: msg})
+}
+
+type apiResetRequest struct {
+	Username string `json:"username" validate:"required,max=254"`
+}
+
+func (app *application) handleAPIAuthResetPost(w http.ResponseWriter, r *http.Request) error {
+	var req apiResetRequest
+
+	err := app.readAPIRequest(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	until, err := app.recordPasswordReset(r, req.Username)
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		app.apiTooManyRequests(w, r, until)
+
+		return nil
+	}
+
+	err = app.requestPasswordReset(r, req.Username)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusAccepted, apiMessageResponse{
+		Message: "If an account with that username exists, a password reset link has been sent.",
+	})
+}
+
+type apiCurrentUserResponse struct {
+	User apiUser `json:"user"`
+	// The token that authenticated the request, with the permissions it may
+	// use right now
+	Token apiToken `json:"token"`
+}
+
+func (app *application) handleAPIUserGet(w http.ResponseWriter, r *http.Request) error {
+	t := app.accessToken(r)
+
+	user, err := app.models.User.GetWithID(r.Context(), t.UserID)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, apiCurrentUserResponse{
+		User:  newAPIUser(user),
+		Token: newAPIToken(t),
+	})
+}
+
+type apiTokensResponse struct {
+	Tokens []apiToken `json:"tokens"`
+}
+
+func (app *application) handleAPIUserTokensGet(w http.ResponseWriter, r *http.Request) error {
+	t := app.accessToken(r)
+
+	tokens, err := app.models.AccessToken.GetAllForUser(r.Context(), t.UserID)
+	if err != nil {
+		return err
+	}
+
+	res := apiTokensResponse{Tokens: make([]apiToken, 0, len(tokens))}
+	for _, t := range tokens {
+		res.Tokens = append(res.Tokens, newAPIToken(t))
+	}
+
+	return writeJSON(w, http.StatusOK, res)
+}
+
+// Revoke a token of the user, which may be the one making the request
+func (app *application) handleAPIUserTokenDelete(w http.ResponseWriter, r *http.Request) error {
+	t := app.accessToken(r)
+
+	id, err := readIDParam(r)
+	if err != nil {
+		app.apiError(w, r, http.StatusNotFound, "token not found")
+
+		return nil
+	}
+
+	err = app.models.AccessToken.Delete(r.Context(), id, t.UserID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.apiError(w, r, http.StatusNotFound, "token not found")
+
+			return nil
+		}
+
+		return err
+	}
+
+	app.securityEvent(r, "access_token_revoked", slog.Int("token_id", id))
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type apiUsersResponse struct {
+	Users    []apiUser       `json:"users"`
+	Metadata models.Metadata `json:"metadata"`
+}
+
+func (app *application) handleAPIUsersGet(w http.ResponseWriter, r *http.Request) error {
+	qs := r.URL.Query()
+
+	filters := models.Filters{
+		Page:     max(readInt(qs, "page", 1), 1),
+		PageSize: min(max(readInt(qs, "page_size", adminUsersPageSize), 1), 100),
+	}
+
+	users, metadata, err := app.models.User.GetAll(r.Context(), qs.Get("q"), filters)
+	if err != nil {
+		return err
+	}
+
+	res := apiUsersResponse{
+		Users:    make([]apiUser, 0, len(users)),
+		Metadata: metadata,
+	}
+	for _, u := range users {
+		res.Users = append(res.Users, newAPIUser(u))
+	}
+
+	return writeJSON(w, http.StatusOK, res)
+}
+
+type apiCreateUserRequest struct {
+	Username string `json:"username" validate:"required,max=254"`
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
+
+type apiUserResponse struct {
+	User apiUser `json:"user"`
+}
+
+func (app *application) handleAPIUsersPost(w http.ResponseWriter, r *http.Request) error {
+	var req apiCreateUserRequest
+
+	err := app.readAPIRequest(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.User.New(r.Context(), req.Username, req.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateUsername) {
+			app.apiError(w, r, http.StatusConflict, "username is already taken")
+
+			return nil
+		}
+
+		return err
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/users/%d", user.ID))
+
+	return writeJSON(w, http.StatusCreated, apiUserResponse{User: newAPIUser(user)})
+}
+
+type apiUserDetailResponse struct {
+	User             apiUser            `json:"user"`
+	Permissions      models.Permissions `json:"permissions"`
+	TwoFactorEnabled bool               `json:"two_factor_enabled"`
+}
+
+func (app *application) handleAPIUserDetailGet(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.readAPIUserParam(w, r)
+	if err != nil || user == nil {
+		return err
+	}
+
+	res := apiUserDetailResponse{User: newAPIUser(user)}
+
+	res.Permissions, err = app.models.Permission.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	if res.Permissions == nil {
+		res.Permissions = models.Permissions{}
+	}
+
+	res.TwoFactorEnabled, err = app.models.TwoFactor.Enabled(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, res)
+}
+
+type apiSetPasswordRequest struct {
+	Password string `json:"password" validate:"required,min=8,max=72"`
+	// Version of the user the change is based on
+	Version int `json:"version" validate:"required"`
+}
+
+// Same rules as the admin console: the user is logged out everywhere
+func (app *application) handleAPIUserPasswordPut(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.readAPIUserParam(w, r)
+	if err != nil || user == nil {
+		return err
+	}
+
+	var req apiSetPasswordRequest
+
+	err = app.readAPIRequest(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = app.setUserPassword(r.Context(), user, req.Password, req.Version)
+	if err != nil {
+		if errors.Is(err, models.ErrEditConflict) {
+			app.apiError(w, r, http.StatusConflict, editConflictMessage)
+
+			return nil
+		}
+
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (app *application) handleAPIUserDelete(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.readAPIUserParam(w, r)
+	if err != nil || user == nil {
+		return err
+	}
+
+	err = app.deleteUser(r.Context(), app.accessToken(r).UserID, user)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (app *application) handleAPIUserPermissionPut(w http.ResponseWriter, r *http.Request) error {
+	return app.updateAPIUserPermission(w, r, true)
+}
+
+func (app *application) handleAPIUserPermissionDelete(w http.ResponseWriter, r *http.Request) error {
+	return app.updateAPIUserPermission(w, r, false)
+}
+
+func (app *application) updateAPIUserPermission(w http.ResponseWriter, r *http.Request, grant bool) error {
+	user, err := app.readAPIUserParam(w, r)
+	if err != nil || user == nil {
+		return err
+	}
+
+	err = app.setUserPermission(r.Context(), app.accessToken(r).UserID, user, chi.URLParam(r, "permission"), grant)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+type apiPermission struct {
+	Name              string `json:"name"`
+	RequiresTwoFactor bool   `json:"requires_two_factor"`
+}
+
+type apiPermissionsResponse struct {
+	Permissions []apiPermission `json:"permissions"`
+}
+
+func (app *application) handleAPIPermissionsGet(w http.ResponseWriter, r *http.Request) error {
+	all, err := app.models.Permission.GetAll(r.Context())
+	if err != nil {
+		return err
+	}
+
+	required, err := app.models.Permission.GetAllRequiringTwoFactor(r.Context())
+	if err != nil {
+		return err
+	}
+
+	res := apiPermissionsResponse{Permissions: make([]apiPermission, 0, len(all))}
+	for _, name := range all {
+		res.Permissions = append(res.Permissions, apiPermission{
+			Name:              name,
+			RequiresTwoFactor: required.Include(name),
+		})
+	}
+
+	return writeJSON(w, http.StatusOK, res)
+}
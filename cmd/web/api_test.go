@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type apiTestResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Decode the error envelope of the response.
+func (res apiTestResponse) apiError(t *testing.T) apiErrorBody {
+	t.Helper()
+
+	var e apiErrorResponse
+	err := json.Unmarshal(res.body, &e)
+	if err != nil {
+		t.Fatalf("decode error body %q: %v", res.body, err)
+	}
+
+	return e.Error
+}
+
+// Build a JSON API request. A string body is sent as is, anything else is
+// marshalled. A non-empty token is sent as the bearer token.
+func (ts *testServer) newAPIRequest(t *testing.T, method, path, token string, body any) *http.Request {
+	t.Helper()
+
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(b)
+	default:
+		js, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req
+}
+
+func (ts *testServer) sendAPI(t *testing.T, req *http.Request) apiTestResponse {
+	t.Helper()
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return apiTestResponse{status: res.StatusCode, header: res.Header, body: body}
+}
+
+func (ts *testServer) api(t *testing.T, method, path, token string, body any) apiTestResponse {
+	t.Helper()
+
+	return ts.sendAPI(t, ts.newAPIRequest(t, method, path, token, body))
+}
+
+// POST a JSON body as if forwarded by a proxy for the client IP. Returns the
+// status and the Retry-After header.
+func (ts *testServer) postJSONFrom(t *testing.T, ip, path string, body any) (int, string) {
+	t.Helper()
+
+	req := ts.newAPIRequest(t, http.MethodPost, path, "", body)
+	req.Header.Set("X-Forwarded-For", ip)
+
+	res := ts.sendAPI(t, req)
+
+	return res.status, res.header.Get("Retry-After")
+}
+
+func TestAPIErrors(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	admin, err := app.models.User.New(ctx, "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Permission.Grant(ctx, admin.ID, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adminToken := newTestAccessToken(t, app, admin.ID, "admin").Plaintext
+	// Held by the user, but not given to the token
+	plainToken := newTestAccessToken(t, app, admin.ID).Plaintext
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   any
+		status int
+		fields map[string]string
+	}{
+		{
+			name:   "no token",
+			method: http.MethodGet,
+			path:   "/api/v1/user",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "unknown token",
+			method: http.MethodGet,
+			path:   "/api/v1/user",
+			token:  "wlat_unknown",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "token without permission",
+			method: http.MethodGet,
+			path:   "/api/v1/users",
+			token:  plainToken,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "no such endpoint",
+			method: http.MethodGet,
+			path:   "/api/v1/nothing",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "no such user",
+			method: http.MethodGet,
+			path:   "/api/v1/users/999",
+			token:  adminToken,
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "malformed id",
+			method: http.MethodGet,
+			path:   "/api/v1/users/abc",
+			token:  adminToken,
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "method not allowed",
+			method: http.MethodPatch,
+			path:   "/api/v1/user",
+			token:  adminToken,
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "taken username",
+			method: http.MethodPost,
+			path:   "/api/v1/users",
+			token:  adminToken,
+			body:   apiCreateUserRequest{Username: "alice", Password: "password123"},
+			status: http.StatusConflict,
+		},
+		{
+			name:   "stale version",
+			method: http.MethodPut,
+			path:   fmt.Sprintf("/api/v1/users/%d/password", admin.ID),
+			token:  adminToken,
+			body:   apiSetPasswordRequest{Password: "newpassword1", Version: admin.Version + 1},
+			status: http.StatusConflict,
+		},
+		{
+			name:   "invalid fields",
+			method: http.MethodPost,
+			path:   "/api/v1/users",
+			token:  adminToken,
+			body:   apiCreateUserRequest{Password: "short"},
+			status: http.StatusUnprocessableEntity,
+			fields: map[string]string{"username": "required", "password": "minimum length: 8"},
+		},
+		{
+			name:   "malformed JSON",
+			method: http.MethodPost,
+			path:   "/api/v1/users",
+			token:  adminToken,
+			body:   `{"username": "bob",`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "wrong JSON type",
+			method: http.MethodPost,
+			path:   "/api/v1/users",
+			token:  adminToken,
+			body:   `{"username": 1}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "several JSON values",
+			method: http.MethodPost,
+			path:   "/api/v1/users",
+			token:  adminToken,
+			body:   `{"username": "bob", "password": "password123"} {}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "body too large",
+			method: http.MethodPost,
+			path:   "/api/v1/users",
+			token:  adminToken,
+			body:   `{"username": "` + strings.Repeat("b", maxJSONBodySize) + `"}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ts.api(t, tt.method, tt.path, tt.token, tt.body)
+			if res.status != tt.status {
+				t.Fatalf("got status %d, want %d: %s", res.status, tt.status, res.body)
+			}
+
+			if ct := res.header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", ct)
+			}
+
+			e := res.apiError(t)
+			if e.Code != apiErrorCode(tt.status) {
+				t.Errorf("got code %q, want %q", e.Code, apiErrorCode(tt.status))
+			}
+
+			if e.Message == "" {
+				t.Error("got an empty message")
+			}
+
+			if !maps.Equal(e.Fields, tt.fields) {
+				t.Errorf("got fields %v, want %v", e.Fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestAPISharedRules(t *testing.T) {
+	app := newTestApplication(t, "-verify-email")
+	ts := newTestServer(t, app.routes())
+
+	// Rules from the HTML handlers fill in the fields map like request
+	// validation does
+	res := ts.api(t, http.MethodPost, "/api/v1/auth/signup", "", apiSignupRequest{Username: "bob", Password: "password123"})
+	if res.status != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d", res.status, http.StatusUnprocessableEntity)
+	}
+
+	e := res.apiError(t)
+	if want := map[string]string{"email": "required"}; !maps.Equal(e.Fields, want) {
+		t.Errorf("got fields %v, want %v", e.Fields, want)
+	}
+}
+
+// Admin endpoints ask for no recent password because creating the token did
+func TestAccessTokenNeedsReauthentication(t *testing.T) {
+	app := newTestApplication(t, "-session-reauth-window=1ns")
+	ts := newTestServer(t, app.routes())
+
+	_, err := app.models.User.New(context.Background(), "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := ts.postForm(t, "/auth/login", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"password123"},
+	})
+	if res.status != http.StatusSeeOther || res.location != "/" {
+		t.Fatalf("login: got %+v, want redirect to /", res)
+	}
+
+	res = ts.postForm(t, "/account/tokens", "/account/tokens", url.Values{
+		"name":       {"script"},
+		"expires_in": {"7"},
+	})
+	if res.status != http.StatusSeeOther || res.location != "/auth/reauth" {
+		t.Errorf("got %+v, want redirect to /auth/reauth", res)
+	}
+}
+
+func TestAPIErrorCode(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusBadRequest, apiCodeBadRequest},
+		{http.StatusUnauthorized, apiCodeUnauthorized},
+		{http.StatusForbidden, apiCodeForbidden},
+		{http.StatusNotFound, apiCodeNotFound},
+		{http.StatusMethodNotAllowed, apiCodeMethodNotAllowed},
+		{http.StatusConflict, apiCodeConflict},
+		{http.StatusUnprocessableEntity, apiCodeValidation},
+		{http.StatusTooManyRequests, apiCodeTooManyRequests},
+		{http.StatusInternalServerError, apiCodeInternal},
+		{http.StatusTeapot, apiCodeInternal},
+	}
+
+	for _, tt := range tests {
+		if got := apiErrorCode(tt.status); got != tt.want {
+			t.Errorf("%d: got %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestJSONFieldName(t *testing.T) {
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"Username", "username"},
+		{"ExpiresIn", "expires_in"},
+		{"TwoFactorEnabled", "two_factor_enabled"},
+		{"ID", "id"},
+		{"UserID", "user_id"},
+		{"HTTPStatus", "http_status"},
+		{"PageSize2", "page_size2"},
+	}
+
+	for _, tt := range tests {
+		if got := jsonFieldName(tt.field); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestAPIRateLimit(t *testing.T) {
+	tests := []struct {
+		path        string
+		body        func(username string) any
+		perIP       int
+		perUsername int
+	}{
+		{
+			path:        "/api/v1/auth/signup",
+			body:        func(u string) any { return apiSignupRequest{Username: u, Password: "password123"} },
+			perIP:       maxSignupsPerIP,
+			perUsername: maxSignupsPerUsername,
+		},
+		{
+			path:        "/api/v1/auth/reset",
+			body:        func(u string) any { return apiResetRequest{Username: u} },
+			perIP:       maxResetsPerIP,
+			perUsername: maxResetsPerUsername,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			t.Run("per username", func(t *testing.T) {
+				app := newTestApplication(t, "-trusted-proxies=127.0.0.1")
+				ts := newTestServer(t, app.routes())
+
+				for i := range tt.perUsername {
+					status, _ := ts.postJSONFrom(t, fmt.Sprintf("192.0.2.%d", i), tt.path, tt.body("alice"))
+					if status != http.StatusAccepted {
+						t.Fatalf("request %d: got %d, want %d", i, status, http.StatusAccepted)
+					}
+				}
+
+				status, retryAfter := ts.postJSONFrom(t, "198.51.100.1", tt.path, tt.body("alice"))
+				if status != http.StatusTooManyRequests {
+					t.Errorf("got %d, want %d", status, http.StatusTooManyRequests)
+				}
+
+				if retryAfter == "" {
+					t.Error("got no Retry-After header")
+				}
+
+				status, _ = ts.postJSONFrom(t, "198.51.100.1", tt.path, tt.body("bob"))
+				if status != http.StatusAccepted {
+					t.Errorf("other username: got %d, want %d", status, http.StatusAccepted)
+				}
+			})
+
+			t.Run("per IP", func(t *testing.T) {
+				app := newTestApplication(t, "-trusted-proxies=127.0.0.1")
+				ts := newTestServer(t, app.routes())
+
+				for i := range tt.perIP {
+					status, _ := ts.postJSONFrom(t, "192.0.2.1", tt.path, tt.body(fmt.Sprintf("user%d", i)))
+					if status != http.StatusAccepted {
+						t.Fatalf("request %d: got %d, want %d", i, status, http.StatusAccepted)
+					}
+				}
+
+				status, _ := ts.postJSONFrom(t, "192.0.2.1", tt.path, tt.body("alice"))
+				if status != http.StatusTooManyRequests {
+					t.Errorf("got %d, want %d", status, http.StatusTooManyRequests)
+				}
+
+				status, _ = ts.postJSONFrom(t, "192.0.2.2", tt.path, tt.body("alice"))
+				if status != http.StatusAccepted {
+					t.Errorf("other IP: got %d, want %d", status, http.StatusAccepted)
+				}
+			})
+		})
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"log/slog"
 	"net/http"
+	"time"
 
+	"github.com/micahco/web-lite/internal/auth"
 	"github.com/micahco/web-lite/internal/models"
 )
 
@@ -12,21 +16,96 @@ type contextKey string
 const (
 	authenticatedUserIDSessionKey = "authenticatedUserID"
 	isAuthenticatedContextKey     = contextKey("isAuthenticated")
+	requestLogContextKey          = contextKey("requestLog")
+	accessTokenContextKey         = contextKey("accessToken")
 )
 
+// Chain the configured password backends in order.
+func newAuthenticator(cfg config, m models.Models, logger *slog.Logger) auth.Authenticator {
+	var chain auth.Chain
+
+	for _, name := range cfg.authBackends {
+		switch name {
+		case "local":
+			chain = append(chain, auth.Local{Users: m.User, Identities: m.Identity})
+		case "ldap":
+			chain = append(chain, auth.NewLDAP(auth.LDAPConfig{
+				URL:               cfg.ldap.url,
+				StartTLS:          cfg.ldap.startTLS,
+				BindDN:            cfg.ldap.bindDN,
+				BindPassword:      cfg.ldap.bindPassword,
+				BaseDN:            cfg.ldap.baseDN,
+				UserFilter:        cfg.ldap.userFilter,
+				UsernameAttribute: cfg.ldap.usernameAttribute,
+				EmailAttribute:    cfg.ldap.emailAttribute,
+				GroupAttribute:    cfg.ldap.groupAttribute,
+				GroupPermissions:  cfg.ldap.groupPermissions,
+			}, m, logger))
+		}
+	}
+
+	return chain
+}
+
+// Check the password of a user that is already known, such as when
+// confirming a sensitive action. Returns models.ErrInvalidCredentials if the
+// password is wrong.
+func (app *application) checkPassword(ctx context.Context, user *models.User, password string) error {
+	u, err := app.authenticator.Authenticate(ctx, user.Username, password)
+	if err != nil {
+		return err
+	}
+
+	// Another backend may know a different user by the same name
+	if u.ID != user.ID {
+		return models.ErrInvalidCredentials
+	}
+
+	return nil
+}
+
+// Answer a password that could not be checked, e.g. because the directory is
+// unreachable. Nothing is counted against the user, who is asked to retry.
+func (app *application) passwordCheckFailed(r *http.Request, err error) FormErrors {
+	app.requestLogger(r).Error("check password", slog.Any("err", err))
+
+	return FormErrors{"Password": "your password could not be checked right now, try again later"}
+}
+
 func (app *application) login(r *http.Request, userID int) error {
 	err := app.sessionManager.RenewToken(r.Context())
 	if err != nil {
 		return err
 	}
 
+	app.clearPendingTwoFactor(r)
 	app.sessionManager.Put(r.Context(), authenticatedUserIDSessionKey, userID)
+	app.startSessionClocks(r.Context())
 
-	return nil
+	// Index the session now rather than on its next request, so that it can
+	// be revoked even if it never makes one
+	idle, err := app.idleTimeout(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	expiry, _ := app.sessionExpiry(r.Context(), idle)
+
+	return app.trackSession(r, userID, expiry)
 }
 
-func (app *application) logout(r *http.Request) error {
-	err := app.sessionManager.RenewToken(r.Context())
+func (app *application) logout(w http.ResponseWriter, r *http.Request) error {
+	err := app.forgetDevice(w, r)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.UserSession.Delete(r.Context(), app.sessionTokenHash(r.Context()))
+	if err != nil {
+		return err
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
 	if err != nil {
 		return err
 	}
@@ -36,6 +115,30 @@ func (app *application) logout(r *http.Request) error {
 	return nil
 }
 
+// Destroy every stored session and API access token that belongs to the
+// user. The session of the current request is held in memory and must be
+// handled by the caller.
+func (app *application) revokeSessions(ctx context.Context, userID int) error {
+	hashes, err := app.models.UserSession.GetTokenHashesForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	err = app.destroySessions(ctx, hashes...)
+	if err != nil {
+		return err
+	}
+
+	// Including devices whose session already expired
+	err = app.models.RememberToken.DeleteAllForUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	// Scripts hold credentials of their own that outlive a password change
+	return app.models.AccessToken.DeleteAllForUser(ctx, userID)
+}
+
 // Check the auth context set by the authenticate middleware
 func (app *application) isAuthenticated(r *http.Request) bool {
 	isAuthenticated, ok := r.Context().Value(isAuthenticatedContextKey).(bool)
@@ -53,7 +156,15 @@ func (app *application) getSessionUserID(r *http.Request) (int, error) {
 }
 
 func (app *application) handleAuthLoginGet(w http.ResponseWriter, r *http.Request) error {
-	return app.render(w, r, http.StatusOK, "login.tmpl", nil)
+	var data struct {
+		VerifyEmail bool
+		SSO         bool
+	}
+
+	data.VerifyEmail = app.config.verifyEmail
+	data.SSO = app.oidc != nil
+
+	return app.render(w, r, http.StatusOK, "login.tmpl", data)
 }
 
 func (app *application) handleAuthLoginPost(w http.ResponseWriter, r *http.Request) error {
@@ -64,6 +175,7 @@ func (app *application) handleAuthLoginPost(w http.ResponseWriter, r *http.Reque
 	var form struct {
 		Username string `form:"username" validate:"required"`
 		Password string `form:"password" validate:"required"`
+		Remember bool   `form:"remember"`
 	}
 
 	err := app.parseForm(r, &form)
@@ -71,29 +183,47 @@ func (app *application) handleAuthLoginPost(w http.ResponseWriter, r *http.Reque
 		return err
 	}
 
-	user, err := app.models.User.GetForCredentials(form.Username, form.Password)
+	// Refuse throttled attempts before spending time on the password hash
+	until, err := app.loginBlockedUntil(r, form.Username)
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		app.securityEvent(r, "login_throttled",
+			slog.String("username", form.Username),
+			slog.Time("until", until))
+		app.refuseLogin(w, r, until)
+
+		return nil
+	}
+
+	user, err := app.authenticator.Authenticate(r.Context(), form.Username, form.Password)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrInvalidCredentials):
+			until, err := app.recordLoginFailure(r, form.Username)
+			if err != nil {
+				return err
+			}
+
+			if !until.IsZero() {
+				app.refuseLogin(w, r, until)
+
+				return nil
+			}
+
 			return app.renderError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
 		default:
-			return err
+			return app.passwordCheckFailed(r, err)
 		}
 	}
 
-	err = app.login(r, user.ID)
-	if err != nil {
-		return err
-	}
-
-	// Redirect to homepage after authenticating the user.
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-
-	return nil
+	return app.loginWithPassword(w, r, user, form.Remember)
 }
 
 func (app *application) handleAuthLogoutPost(w http.ResponseWriter, r *http.Request) error {
-	err := app.logout(r)
+	err := app.logout(w, r)
 	if err != nil {
 		return err
 	}
@@ -110,6 +240,7 @@ func (app *application) handleAuthSignupPost(w http.ResponseWriter, r *http.Requ
 
 	var form struct {
 		Username string `form:"username" validate:"required,max=254"`
+		Email    string `form:"email" validate:"omitempty,email,max=254"`
 		Password string `form:"password" validate:"required,min=8,max=72"`
 	}
 
@@ -118,28 +249,74 @@ func (app *application) handleAuthSignupPost(w http.ResponseWriter, r *http.Requ
 		return err
 	}
 
-	user, err := app.models.User.New(form.Username, form.Password)
+	until, err := app.recordSignup(r, form.Username)
 	if err != nil {
-		if errors.Is(err, models.ErrDuplicateUsername) {
-			return app.renderError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return err
+	}
+
+	if !until.IsZero() {
+		f := FlashMessage{
+			Type:    FlashError,
+			Message: "Too many signups. Try again " + retryIn(time.Until(until)) + ".",
 		}
+		app.putFlash(r, f)
+		app.refresh(w, r)
 
-		return err
+		return nil
 	}
 
-	// Login user
-	app.sessionManager.Clear(r.Context())
-	err = app.login(r, user.ID)
+	err = app.signup(r, form.Username, form.Email, form.Password)
 	if err != nil {
 		return err
 	}
 
 	f := FlashMessage{
-		Type:    FlashSuccess,
-		Message: "Successfully created account. Welcome!",
+		Type:    FlashInfo,
+		Message: "If that username was available, your account has been created. Please log in.",
+	}
+
+	if app.config.verifyEmail {
+		f.Message = "If that username was available, your account has been created. Please follow the link sent to your email address, then log in."
 	}
 	app.putFlash(r, f)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
 
 	return nil
 }
+
+// Create an account, shared by the signup form and the API. Taken usernames
+// and email addresses return nil like new accounts, so signup cannot be used
+// to find out which are registered.
+func (app *application) signup(r *http.Request, username, email, password string) error {
+	if !app.config.verifyEmail {
+		email = ""
+	} else if email == "" {
+		return FormErrors{"Email": "required"}
+	}
+
+	user := &models.User{Username: username, Email: email}
+	err := app.models.User.SetPassword(user, password)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.User.Insert(r.Context(), user)
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateUsername) || errors.Is(err, models.ErrDuplicateEmail) {
+			return nil
+		}
+
+		return err
+	}
+
+	if !app.config.verifyEmail {
+		return nil
+	}
+
+	_, err = app.recordVerificationEmail(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	return app.sendVerificationEmail(r, user)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+func TestLoginUnknownUserLikeWrongPassword(t *testing.T) {
+	app := newTestApplication(t)
+
+	_, err := app.models.User.New(context.Background(), "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(username, password string) testResponse {
+		ts := newTestServer(t, app.routes())
+
+		return ts.postForm(t, "/auth/login", "/auth/login", url.Values{
+			"username": {username},
+			"password": {password},
+		})
+	}
+
+	wrongPassword := login("alice", "wrongpassword")
+	unknownUser := login("bob", "wrongpassword")
+
+	if wrongPassword.status != http.StatusUnauthorized {
+		t.Errorf("wrong password: got status %d, want %d", wrongPassword.status, http.StatusUnauthorized)
+	}
+
+	if unknownUser != wrongPassword {
+		t.Errorf("unknown user: got %+v, want %+v", unknownUser, wrongPassword)
+	}
+
+	// Both count against the username, so throttling does not tell them
+	// apart either
+	for _, username := range []string{"alice", "bob"} {
+		lt, err := app.models.LoginThrottle.Get(context.Background(), usernameThrottleKey(username))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lt.Failures != 1 {
+			t.Errorf("%s: got %d failures, want 1", username, lt.Failures)
+		}
+	}
+
+	if got := login("alice", "password123"); got.status != http.StatusSeeOther || got.location != "/" {
+		t.Errorf("right password: got %+v, want redirect to /", got)
+	}
+}
+
+// Authenticator whose backend cannot be reached
+type unavailableAuthenticator struct{}
+
+func (unavailableAuthenticator) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	return nil, errors.New("directory unreachable")
+}
+
+func TestLoginBackendUnavailable(t *testing.T) {
+	app := newTestApplication(t)
+	app.authenticator = unavailableAuthenticator{}
+	ts := newTestServer(t, app.routes())
+
+	res := ts.postForm(t, "/auth/login", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"password123"},
+	})
+
+	// Sent back to the form to try later
+	if res.status != http.StatusSeeOther || res.location != "/auth/login" {
+		t.Errorf("got %+v, want redirect to /auth/login", res)
+	}
+
+	_, err := app.models.LoginThrottle.Get(context.Background(), usernameThrottleKey("alice"))
+	if !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("got %v, want no failure recorded", err)
+	}
+}
+
+func TestSignupTakenLikeNew(t *testing.T) {
+	app := newTestApplication(t, "-verify-email")
+
+	signup := func(username, email string) (testResponse, string) {
+		ts := newTestServer(t, app.routes())
+
+		res := ts.postForm(t, "/auth/login", "/auth/signup", url.Values{
+			"username": {username},
+			"email":    {email},
+			"password": {"password123"},
+		})
+
+		// The outcome is told in a flash message on the next page
+		return res, ts.get(t, res.location).body
+	}
+
+	newRes, newPage := signup("alice", "alice@example.com")
+
+	if newRes.status != http.StatusSeeOther || newRes.location != "/auth/login" {
+		t.Fatalf("new account: got %+v, want redirect to /auth/login", newRes)
+	}
+
+	const flash = "If that username was available, your account has been created."
+	if !strings.Contains(newPage, flash) {
+		t.Fatalf("new account: flash %q not shown", flash)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		email    string
+	}{
+		{"taken username", "alice", "other@example.com"},
+		{"taken email", "bob", "alice@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, page := signup(tt.username, tt.email)
+
+			if res != newRes {
+				t.Errorf("got %+v, want %+v", res, newRes)
+			}
+
+			if !strings.Contains(page, flash) {
+				t.Errorf("flash %q not shown", flash)
+			}
+		})
+	}
+
+	// Neither attempt changed the accounts
+	_, err := app.models.User.GetWithUsername(context.Background(), "bob")
+	if !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("bob: got %v, want %v", err, models.ErrNoRecord)
+	}
+
+	alice, err := app.models.User.GetWithUsername(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if alice.Email != "alice@example.com" {
+		t.Errorf("alice: got email %q, want %q", alice.Email, "alice@example.com")
+	}
+}
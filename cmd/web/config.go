@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+)
+
+// Prefix of the environment variable for each setting, e.g. the -db-dsn flag
+// is read from WEB_DB_DSN.
+const envPrefix = "WEB_"
+
+// Printed in place of secret values by -print-config
+const redacted = "[redacted]"
+
+type config struct {
+	port            int
+	dev             bool
+	baseURL         string
+	shutdownTimeout time.Duration
+	trustedProxies  stringList
+	server          struct {
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+		idleTimeout  time.Duration
+	}
+	log struct {
+		level  slog.Level
+		format string
+	}
+	db struct {
+		dsn string
+	}
+	session struct {
+		lifetime               time.Duration
+		idleTimeout            time.Duration
+		permissionIdleTimeouts durationMap
+		reauthWindow           time.Duration
+		cookieSecure           bool
+		rememberLifetime       time.Duration
+	}
+	password struct {
+		memory      uint
+		iterations  uint
+		parallelism uint
+	}
+	login struct {
+		maxFailures int
+		lockout     time.Duration
+		backoffBase time.Duration
+		backoffMax  time.Duration
+	}
+	resetTokenTTL        time.Duration
+	verifyEmail          bool
+	verificationTokenTTL time.Duration
+	oidc                 struct {
+		issuer           string
+		clientID         string
+		clientSecret     string
+		scopes           stringList
+		autoProvision    bool
+		groupsClaim      string
+		groupPermissions stringMap
+	}
+	authBackends stringList
+	ldap         struct {
+		url               string
+		startTLS          bool
+		bindDN            string
+		bindPassword      string
+		baseDN            string
+		userFilter        string
+		usernameAttribute string
+		emailAttribute    string
+		groupAttribute    string
+		groupPermissions  stringMap
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+}
+
+// Settings that must never be printed
+var secretSettings = []string{
+	"smtp-password",
+	"oidc-client-secret",
+	"ldap-bind-password",
+}
+
+// Register every setting with its default value.
+func (cfg *config) register(fs *flag.FlagSet) {
+	fs.IntVar(&cfg.port, "port", 8080, "HTTP server port")
+	fs.BoolVar(&cfg.dev, "dev", false, "Development mode")
+	fs.StringVar(&cfg.baseURL, "base-url", "http://localhost:8080", "Public base URL used in emailed links")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time allowed to drain requests and background tasks on shutdown")
+	fs.Var(&cfg.trustedProxies, "trusted-proxies", "Comma separated IPs or CIDRs of proxies allowed to set X-Forwarded-For")
+
+	fs.DurationVar(&cfg.server.readTimeout, "server-read-timeout", 5*time.Second, "HTTP server read timeout")
+	fs.DurationVar(&cfg.server.writeTimeout, "server-write-timeout", 10*time.Second, "HTTP server write timeout")
+	fs.DurationVar(&cfg.server.idleTimeout, "server-idle-timeout", time.Minute, "HTTP server idle timeout")
+
+	fs.TextVar(&cfg.log.level, "log-level", slog.LevelInfo, "Log level (debug, info, warn, error)")
+	fs.StringVar(&cfg.log.format, "log-format", "json", "Log format (json, text)")
+
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "pricetag.db", "SQLite DSN")
+
+	cfg.session.permissionIdleTimeouts = durationMap{"admin": 15 * time.Minute}
+	fs.DurationVar(&cfg.session.lifetime, "session-lifetime", 12*time.Hour, "Longest a login lasts, however active")
+	fs.DurationVar(&cfg.session.idleTimeout, "session-idle-timeout", time.Hour, "Inactivity after which a login expires (0 disables)")
+	fs.Var(&cfg.session.permissionIdleTimeouts, "session-permission-idle-timeouts", "Comma separated permission=duration idle timeouts for holders of the permission, when shorter")
+	fs.DurationVar(&cfg.session.reauthWindow, "session-reauth-window", 10*time.Minute, "How long after entering their password a user may perform sensitive actions without entering it again")
+	fs.BoolVar(&cfg.session.cookieSecure, "session-cookie-secure", true, "Set the Secure attribute on session and CSRF cookies")
+	fs.DurationVar(&cfg.session.rememberLifetime, "session-remember-lifetime", 30*24*time.Hour, "How long \"remember me\" keeps a device logged in without use")
+
+	fs.UintVar(&cfg.password.memory, "password-memory", uint(argon2id.DefaultParams.Memory), "argon2id memory cost in KiB for new password hashes")
+	fs.UintVar(&cfg.password.iterations, "password-iterations", uint(argon2id.DefaultParams.Iterations), "argon2id time cost for new password hashes")
+	fs.UintVar(&cfg.password.parallelism, "password-parallelism", uint(argon2id.DefaultParams.Parallelism), "argon2id threads for new password hashes")
+
+	fs.IntVar(&cfg.login.maxFailures, "login-max-failures", 10, "Failed logins for a username before the account is locked")
+	fs.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "How long an account stays locked")
+	fs.DurationVar(&cfg.login.backoffBase, "login-backoff-base", time.Second, "First delay imposed after repeated failed logins, doubled on each further failure")
+	fs.DurationVar(&cfg.login.backoffMax, "login-backoff-max", 5*time.Minute, "Longest delay imposed between failed logins")
+
+	fs.DurationVar(&cfg.resetTokenTTL, "reset-token-ttl", 30*time.Minute, "Password reset link lifetime")
+	fs.BoolVar(&cfg.verifyEmail, "verify-email", false, "Collect an email address at signup and limit accounts until it is verified")
+	fs.DurationVar(&cfg.verificationTokenTTL, "verification-token-ttl", 24*time.Hour, "Email verification link lifetime")
+
+	cfg.oidc.scopes = stringList{"openid", "email", "profile"}
+	fs.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect provider issuer URL (single sign-on is disabled when empty)")
+	fs.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	fs.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret (empty for public clients)")
+	fs.Var(&cfg.oidc.scopes, "oidc-scopes", "Comma separated OpenID Connect scopes to request")
+	fs.BoolVar(&cfg.oidc.autoProvision, "oidc-auto-provision", false, "Create accounts for unknown identities on their first login")
+	fs.StringVar(&cfg.oidc.groupsClaim, "oidc-groups-claim", "groups", "ID token claim listing the groups of the user")
+	fs.Var(&cfg.oidc.groupPermissions, "oidc-group-permissions", "Comma separated group=permission grants for provisioned accounts")
+
+	cfg.authBackends = stringList{"local"}
+	fs.Var(&cfg.authBackends, "auth-backends", "Comma separated password backends to try in order (ldap, local)")
+	fs.StringVar(&cfg.ldap.url, "ldap-url", "", "LDAP server URL, ldap:// or ldaps://")
+	fs.BoolVar(&cfg.ldap.startTLS, "ldap-start-tls", false, "Upgrade ldap:// connections with StartTLS")
+	fs.StringVar(&cfg.ldap.bindDN, "ldap-bind-dn", "", "DN of the account that searches for users (anonymous when empty)")
+	fs.StringVar(&cfg.ldap.bindPassword, "ldap-bind-password", "", "Password of the LDAP search account")
+	fs.StringVar(&cfg.ldap.baseDN, "ldap-base-dn", "", "DN of the subtree searched for users")
+	fs.StringVar(&cfg.ldap.userFilter, "ldap-user-filter", "(uid=%s)", "LDAP filter matching a user, %s is replaced by the username")
+	fs.StringVar(&cfg.ldap.usernameAttribute, "ldap-username-attribute", "uid", "LDAP attribute holding the username")
+	fs.StringVar(&cfg.ldap.emailAttribute, "ldap-email-attribute", "mail", "LDAP attribute holding the email address")
+	fs.StringVar(&cfg.ldap.groupAttribute, "ldap-group-attribute", "memberOf", "LDAP attribute listing the group DNs of a user")
+	fs.Var(&cfg.ldap.groupPermissions, "ldap-group-permissions", "Comma separated group=permission grants, by group common name, kept in sync on every login")
+
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "", "SMTP host, required unless -dev (emails are logged when empty)")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 587, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "web <no-reply@localhost>", "SMTP sender")
+}
+
+// Load the configuration from, in increasing order of precedence, defaults,
+// a JSON config file, WEB_* environment variables and command line flags.
+// Returns the remaining command line arguments.
+func loadConfig(args []string, stdout io.Writer) (cfg config, rest []string, err error) {
+	fs := flag.NewFlagSet("web", flag.ContinueOnError)
+	cfg.register(fs)
+
+	configFile := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "Path to a JSON config file")
+	printConfig := fs.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
+
+	err = fs.Parse(args)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	// Flags were applied first, remember them so they can be re-applied on
+	// top of the file and environment.
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	if *configFile != "" {
+		err = applyConfigFile(fs, *configFile)
+		if err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	err = applyEnv(fs)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	for name, value := range explicit {
+		err = fs.Set(name, value)
+		if err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	if *printConfig {
+		err = writeConfig(fs, stdout)
+		if err != nil {
+			return cfg, nil, err
+		}
+
+		return cfg, nil, errPrintedConfig
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+var errPrintedConfig = errors.New("printed config")
+
+// Meta flags that only make sense on the command line
+func isMetaFlag(name string) bool {
+	return name == "config" || name == "print-config"
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func applyEnv(fs *flag.FlagSet) error {
+	var errs []error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if isMetaFlag(f.Name) {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+
+		err := f.Value.Set(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", envName(f.Name), err))
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// The config file is a flat JSON object keyed by flag name, for example
+// {"port": 4000, "db-dsn": "/var/lib/web/web.db"}.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+
+	var values map[string]any
+	err = dec.Decode(&values)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	var errs []error
+
+	for name, raw := range values {
+		flg := fs.Lookup(name)
+		if flg == nil || isMetaFlag(name) {
+			errs = append(errs, fmt.Errorf("config file %s: unknown setting %q", path, name))
+			continue
+		}
+
+		var value string
+		switch v := raw.(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case bool:
+			value = fmt.Sprint(v)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		default:
+			errs = append(errs, fmt.Errorf("config file %s: unsupported value for %q", path, name))
+			continue
+		}
+
+		err = flg.Value.Set(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Write the effective configuration as a JSON config file.
+func writeConfig(fs *flag.FlagSet, w io.Writer) error {
+	values := make(map[string]string)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if isMetaFlag(f.Name) {
+			return
+		}
+
+		value := f.Value.String()
+		if value != "" && slices.Contains(secretSettings, f.Name) {
+			value = redacted
+		}
+
+		values[f.Name] = value
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.SetEscapeHTML(false)
+
+	return enc.Encode(values)
+}
+
+func (cfg config) validate() error {
+	var errs []error
+
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.port > 0 && cfg.port <= 65535, "port: must be between 1 and 65535")
+	check(cfg.shutdownTimeout > 0, "shutdown-timeout: must be positive")
+	check(cfg.server.readTimeout > 0, "server-read-timeout: must be positive")
+	check(cfg.server.writeTimeout > 0, "server-write-timeout: must be positive")
+	check(cfg.server.idleTimeout > 0, "server-idle-timeout: must be positive")
+	check(cfg.log.format == "json" || cfg.log.format == "text", "log-format: must be json or text")
+	check(cfg.db.dsn != "", "db-dsn: must be provided")
+	check(cfg.session.lifetime > 0, "session-lifetime: must be positive")
+	check(cfg.session.idleTimeout >= 0, "session-idle-timeout: must not be negative")
+	check(cfg.session.reauthWindow > 0, "session-reauth-window: must be positive")
+
+	for code, d := range cfg.session.permissionIdleTimeouts {
+		check(d > 0, "session-permission-idle-timeouts: %s: must be positive", code)
+	}
+	check(cfg.session.rememberLifetime > 0, "session-remember-lifetime: must be positive")
+	check(cfg.password.memory >= 8*cfg.password.parallelism && cfg.password.memory <= math.MaxUint32,
+		"password-memory: must be at least 8 KiB per thread")
+	check(cfg.password.iterations > 0 && cfg.password.iterations <= math.MaxUint32, "password-iterations: must be positive")
+	check(cfg.password.parallelism > 0 && cfg.password.parallelism <= math.MaxUint8, "password-parallelism: must be between 1 and 255")
+	check(cfg.login.maxFailures > 0, "login-max-failures: must be positive")
+	check(cfg.login.lockout > 0, "login-lockout: must be positive")
+	check(cfg.login.backoffBase > 0, "login-backoff-base: must be positive")
+	check(cfg.login.backoffMax >= cfg.login.backoffBase, "login-backoff-max: must be at least login-backoff-base")
+	check(cfg.resetTokenTTL > 0, "reset-token-ttl: must be positive")
+	check(cfg.verificationTokenTTL > 0, "verification-token-ttl: must be positive")
+
+	u, err := url.Parse(cfg.baseURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && strings.TrimSuffix(u.Path, "/") == "",
+		"base-url: must be an absolute http(s) URL without a path")
+
+	for _, proxy := range cfg.trustedProxies {
+		_, err := parsePrefix(proxy)
+		check(err == nil, "trusted-proxies: invalid IP or CIDR %q", proxy)
+	}
+
+	if cfg.oidc.issuer != "" {
+		u, err := url.Parse(cfg.oidc.issuer)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "oidc-issuer: must be an absolute http(s) URL")
+		check(cfg.oidc.clientID != "", "oidc-client-id: must be provided")
+	}
+
+	check(len(cfg.authBackends) > 0, "auth-backends: must not be empty")
+	for i, b := range cfg.authBackends {
+		check(b == "local" || b == "ldap", "auth-backends: unknown backend %q", b)
+		check(!slices.Contains(cfg.authBackends[:i], b), "auth-backends: %q listed twice", b)
+	}
+
+	if slices.Contains(cfg.authBackends, "ldap") {
+		u, err := url.Parse(cfg.ldap.url)
+		check(err == nil && (u.Scheme == "ldap" || u.Scheme == "ldaps") && u.Host != "", "ldap-url: must be an ldap:// or ldaps:// URL")
+		check(!cfg.ldap.startTLS || u == nil || u.Scheme == "ldap", "ldap-start-tls: only applies to ldap:// URLs")
+		check(cfg.ldap.baseDN != "", "ldap-base-dn: must be provided")
+		check(strings.Count(cfg.ldap.userFilter, "%s") == 1 && strings.Count(cfg.ldap.userFilter, "%") == 1,
+			"ldap-user-filter: must contain %%s exactly once")
+	}
+
+	// Logged emails include live reset and verification links
+	check(cfg.smtp.host != "" || cfg.dev, "smtp-host: must be provided unless -dev is set")
+	if cfg.smtp.host != "" {
+		check(cfg.smtp.port > 0 && cfg.smtp.port <= 65535, "smtp-port: must be between 1 and 65535")
+		check(cfg.smtp.sender != "", "smtp-sender: must be provided")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Parameters for new password hashes. Existing hashes made with weaker ones
+// are upgraded when their owner logs in.
+func (cfg config) passwordParams() *argon2id.Params {
+	return &argon2id.Params{
+		Memory:      uint32(cfg.password.memory),
+		Iterations:  uint32(cfg.password.iterations),
+		Parallelism: uint8(cfg.password.parallelism),
+		SaltLength:  argon2id.DefaultParams.SaltLength,
+		KeyLength:   argon2id.DefaultParams.KeyLength,
+	}
+}
+
+// Parse an IP address or CIDR into a prefix
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// stringList is a comma separated flag value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			*l = append(*l, s)
+		}
+	}
+
+	return nil
+}
+
+// durationMap is a comma separated list of key=duration flag values
+type durationMap map[string]time.Duration
+
+func (m *durationMap) String() string {
+	items := make([]string, 0, len(*m))
+	for k, d := range *m {
+		items = append(items, k+"="+d.String())
+	}
+	slices.Sort(items)
+
+	return strings.Join(items, ",")
+}
+
+func (m *durationMap) Set(value string) error {
+	*m = make(durationMap)
+
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("%q: expected key=duration", s)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+
+		(*m)[strings.TrimSpace(k)] = d
+	}
+
+	return nil
+}
+
+// stringMap is a comma separated list of key=value flag values
+type stringMap map[string]string
+
+func (m *stringMap) String() string {
+	items := make([]string, 0, len(*m))
+	for k, v := range *m {
+		items = append(items, k+"="+v)
+	}
+	slices.Sort(items)
+
+	return strings.Join(items, ",")
+}
+
+func (m *stringMap) Set(value string) error {
+	*m = make(stringMap)
+
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("%q: expected key=value", s)
+		}
+
+		(*m)[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	return nil
+}
+
+// Check if ip belongs to one of the trusted proxies.
+func (cfg config) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	for _, proxy := range cfg.trustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestConfigRequiresSMTP(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{args: nil, wantErr: true},
+		{args: []string{"-dev"}},
+		{args: []string{"-smtp-host=mail.example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			_, _, err := loadConfig(tt.args, io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %t", err, tt.wantErr)
+			}
+
+			if err != nil && !strings.Contains(err.Error(), "smtp-host") {
+				t.Errorf("got %v, want an smtp-host error", err)
+			}
+		})
+	}
+}
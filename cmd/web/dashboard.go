@@ -8,16 +8,22 @@ func (app *application) handleDashboardGet(w http.ResponseWriter, r *http.Reques
 		return err
 	}
 
-	u, err := app.models.User.GetWithID(suid)
+	u, err := app.models.User.GetWithID(r.Context(), suid)
 	if err != nil {
 		return err
 	}
 
 	var data struct {
-		Username string
+		Username   string
+		Email      string
+		Unverified bool
+		SSO        bool
 	}
 
 	data.Username = u.Username
+	data.Email = u.Email
+	data.Unverified = u.Unverified()
+	data.SSO = app.oidc != nil
 
 	return app.render(w, r, http.StatusOK, "dashboard.tmpl", data)
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// Unix times kept in the session of an authenticated user
+	loginTimeSessionKey  = "loginTime"
+	lastActiveSessionKey = "lastActive"
+	// Last time the user entered their credentials, see requireReauthentication
+	authTimeSessionKey = "authTime"
+
+	// Sessions are kept in the store this much longer than they last, so that
+	// a user coming back to an expired one can be told why they were logged
+	// out
+	sessionExpiredNoticeWindow = 24 * time.Hour
+)
+
+// Start the expiry clocks of a session that was just authenticated.
+func (app *application) startSessionClocks(ctx context.Context) {
+	now := time.Now().Unix()
+	app.sessionManager.Put(ctx, loginTimeSessionKey, now)
+	app.sessionManager.Put(ctx, lastActiveSessionKey, now)
+	app.sessionManager.Put(ctx, authTimeSessionKey, now)
+}
+
+// Idle timeout for the user: the shortest of the default and the overrides
+// for permissions they hold. Zero if there is none.
+func (app *application) idleTimeout(ctx context.Context, userID int) (time.Duration, error) {
+	idle := app.config.session.idleTimeout
+	if len(app.config.session.permissionIdleTimeouts) == 0 {
+		return idle, nil
+	}
+
+	permissions, err := app.models.Permission.GetAllForUser(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, code := range permissions {
+		d, ok := app.config.session.permissionIdleTimeouts[code]
+		if ok && (idle == 0 || d < idle) {
+			idle = d
+		}
+	}
+
+	return idle, nil
+}
+
+// Time at which the authenticated session expires, whichever of the absolute
+// and idle limits comes first, and the message explaining why.
+func (app *application) sessionExpiry(ctx context.Context, idle time.Duration) (time.Time, string) {
+	loginTime := time.Unix(app.sessionManager.GetInt64(ctx, loginTimeSessionKey), 0)
+	expiry := loginTime.Add(app.config.session.lifetime)
+	reason := "Your session expired. Please log in again."
+
+	if idle > 0 {
+		lastActive := time.Unix(app.sessionManager.GetInt64(ctx, lastActiveSessionKey), 0)
+		if t := lastActive.Add(idle); t.Before(expiry) {
+			expiry = t
+			reason = "You were logged out after " + formatDuration(idle) + " of inactivity. Please log in again."
+		}
+	}
+
+	return expiry, reason
+}
+
+// Record activity on the session. Written at most once per
+// sessionTouchInterval to avoid saving the session on every request.
+func (app *application) touchSession(ctx context.Context) {
+	lastActive := time.Unix(app.sessionManager.GetInt64(ctx, lastActiveSessionKey), 0)
+	if time.Since(lastActive) >= sessionTouchInterval {
+		app.sessionManager.Put(ctx, lastActiveSessionKey, time.Now().Unix())
+	}
+}
+
+// Log out an expired session. Unlike logout, the device stays remembered.
+func (app *application) expireSession(r *http.Request) error {
+	err := app.models.UserSession.Delete(r.Context(), app.sessionTokenHash(r.Context()))
+	if err != nil {
+		return err
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Remove(r.Context(), authenticatedUserIDSessionKey)
+	app.sessionManager.Remove(r.Context(), rememberFamilySessionKey)
+
+	return nil
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int(d/time.Hour), "hour")
+	case d >= time.Minute:
+		return plural(int(d.Round(time.Minute)/time.Minute), "minute")
+	default:
+		return plural(int(d.Round(time.Second)/time.Second), "second")
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+
+	return fmt.Sprintf("%d %ss", n, unit)
+}
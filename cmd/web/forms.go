@@ -12,6 +12,9 @@ import (
 
 const formErrorsSessionKey = "form-errors"
 
+// Form error shown when models.ErrEditConflict is returned
+const editConflictMessage = "this record was changed by someone else, please reload and try again"
+
 type FormErrors map[string]string
 
 func (formErrors FormErrors) Error() string {
@@ -61,7 +64,13 @@ func (app *application) parseForm(r *http.Request, dst any) error {
 		}
 	}
 
-	err = app.validate.Struct(dst)
+	return app.validateStruct(dst)
+}
+
+// Check the validate tags of a decoded form or JSON body. Failures return
+// FormErrors keyed by struct field name.
+func (app *application) validateStruct(dst any) error {
+	err := app.validate.Struct(dst)
 	if err != nil {
 		var validationErrors validator.ValidationErrors
 		switch {
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+const grantAdminUsage = "usage: web grant-admin <username>"
+
+// Grant the admin permission to an existing account, such as the first one
+// to sign up on a fresh install. Further admins can be made from the console.
+func runGrantAdmin(m models.Models, args []string) error {
+	if len(args) != 1 {
+		return errors.New(grantAdminUsage)
+	}
+
+	ctx := context.Background()
+
+	user, err := m.User.GetWithUsername(ctx, args[0])
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return fmt.Errorf("no user %q", args[0])
+		}
+
+		return err
+	}
+
+	err = m.Permission.Grant(ctx, user.ID, "admin")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("granted admin to %s\n", user.Username)
+
+	return nil
+}
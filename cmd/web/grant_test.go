@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGrantAdmin(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApplication(t)
+
+	// Not even the first account to sign up is an admin
+	r := httptest.NewRequest(http.MethodPost, "/auth/signup", nil)
+	err := app.signup(r, "alice", "", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := app.models.User.GetWithUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isAdmin, err := app.models.Permission.Check(ctx, alice.ID, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isAdmin {
+		t.Fatal("first account to sign up is an admin")
+	}
+
+	err = runGrantAdmin(app.models, []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isAdmin, err = app.models.Permission.Check(ctx, alice.ID, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isAdmin {
+		t.Error("granted account is not an admin")
+	}
+
+	err = runGrantAdmin(app.models, []string{"bob"})
+	if err == nil {
+		t.Error("unknown user: got nil, want error")
+	}
+
+	err = runGrantAdmin(app.models, nil)
+	if err == nil || err.Error() != grantAdminUsage {
+		t.Errorf("no username: got %v, want %q", err, grantAdminUsage)
+	}
+}
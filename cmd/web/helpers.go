@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var errInvalidIDParam = errors.New("invalid id parameter")
+
+// Read the positive integer "id" URL parameter
+func readIDParam(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id < 1 {
+		return 0, errInvalidIDParam
+	}
+
+	return id, nil
+}
+
+// Read an integer from the query string, falling back to defaultValue if the
+// key is missing or malformed.
+func readInt(qs url.Values, key string, defaultValue int) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return defaultValue
+	}
+
+	return i
+}
+
+// Client IP address of the request. X-Forwarded-For is only honored when the
+// connection comes from a trusted proxy, in which case the right-most address
+// that is not itself a trusted proxy is used.
+func (app *application) clientIP(r *http.Request) string {
+	ip := hostOnly(r.RemoteAddr)
+	if !app.config.isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		ip = hop
+		if !app.config.isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// Strip the port from host:port, returning the input if it has none
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// Largest JSON request body accepted by readJSON
+const maxJSONBodySize = 1 << 20
+
+var errInvalidJSON = errors.New("invalid JSON body")
+
+// Decode a single JSON value from the request body into dst. Malformed or
+// oversized bodies return an error wrapping errInvalidJSON.
+func readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(dst)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidJSON, err)
+	}
+
+	if dec.Decode(&struct{}{}) != io.EOF {
+		return fmt.Errorf("%w: body must contain a single value", errInvalidJSON)
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(js, '\n'))
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+const importUsersUsage = "usage: web import-users <file.csv | ->"
+
+// Time allowed for the whole import
+const importTimeout = 5 * time.Minute
+
+// Create users from a CSV file of "username,password hash" records, such as
+// an export from another system. argon2id and bcrypt hashes are accepted;
+// both are upgraded to the current argon2id parameters on first login. The
+// import is all or nothing.
+func runImportUsers(m models.Models, args []string) error {
+	if len(args) != 1 {
+		return errors.New(importUsersUsage)
+	}
+
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), importTimeout)
+	defer cancel()
+
+	count := 0
+	err := m.WithTx(ctx, func(m models.Models) error {
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			line, _ := cr.FieldPos(0)
+
+			// Optional header
+			if line == 1 && record[0] == "username" {
+				continue
+			}
+
+			err = models.ValidatePasswordHash(record[1])
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+
+			user := &models.User{Username: record[0], PasswordHash: record[1]}
+			err = m.User.Insert(ctx, user)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+
+			count++
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d users\n", count)
+
+	return nil
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"log/slog"
-	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/alexedwards/scs/sqlite3store"
@@ -17,54 +20,110 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/lmittmann/tint"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/micahco/web-lite/internal/auth"
+	"github.com/micahco/web-lite/internal/mailer"
 	"github.com/micahco/web-lite/internal/models"
+	"github.com/micahco/web-lite/internal/oidc"
 )
 
-type config struct {
-	port int
-	dev  bool
-	db   struct {
-		dsn string
-	}
-}
-
 type application struct {
-	config         config
-	logger         *slog.Logger
-	models         models.Models
+	config config
+	logger *slog.Logger
+	mailer *mailer.Mailer
+	models models.Models
+	// Checks login passwords against the configured backends
+	authenticator auth.Authenticator
+	// Nil when single sign-on is not configured
+	oidc           *oidc.Client
 	sessionManager *scs.SessionManager
-	templateCache  map[string]*template.Template
-	formDecoder    *form.Decoder
-	validate       *validator.Validate
+	// Store of sessionManager, for destroying sessions found in the index
+	sessionStore  hashedSessionStore
+	templateCache map[string]*template.Template
+	formDecoder   *form.Decoder
+	validate      *validator.Validate
+	// OpenAPI document of the API, generated by serve
+	apiSpec []byte
+	// Background goroutines, see app.background
+	wg             sync.WaitGroup
+	backgroundCtx  context.Context
+	stopBackground context.CancelFunc
 }
 
 func main() {
-	var cfg config
-
-	// Default flag values for production
-	flag.IntVar(&cfg.port, "port", 8080, "API server port")
-	flag.BoolVar(&cfg.dev, "dev", false, "Development mode")
-	flag.StringVar(&cfg.db.dsn, "db-dsn", "pricetag.db", "SQLite DSN")
-	flag.Parse()
+	cfg, args, err := loadConfig(os.Args[1:], os.Stdout)
+	if err != nil {
+		switch {
+		case errors.Is(err, errPrintedConfig), errors.Is(err, flag.ErrHelp):
+			return
+		default:
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
 
 	// Logger
-	h := newSlogHandler(cfg.dev)
+	h := newSlogHandler(cfg)
 	logger := slog.New(h)
 	// Create error log for http.Server
 	errLog := slog.NewLogLogger(h, slog.LevelError)
 
 	// Database
-	db, err := initDB(cfg.db.dsn)
+	db, err := openDB(cfg.db.dsn)
+	if err != nil {
+		logger.Error("unable to open db", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	// Subcommands
+	if len(args) > 0 && args[0] == "migrate" {
+		err = runMigrate(db, args[1:])
+		db.Close()
+		if err != nil {
+			logger.Error("migrate", slog.Any("err", err))
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// Bring the schema up to date before serving
+	err = migrateUp(db, logger)
 	if err != nil {
-		logger.Error("unable to initialize db", slog.Any("err", err))
+		logger.Error("unable to migrate db", slog.Any("err", err))
 		os.Exit(1)
 	}
-	defer db.Close()
+
+	m := models.New(db, cfg.passwordParams())
+
+	if len(args) > 0 && args[0] == "import-users" {
+		err = runImportUsers(m, args[1:])
+		db.Close()
+		if err != nil {
+			logger.Error("import users", slog.Any("err", err))
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(args) > 0 && args[0] == "grant-admin" {
+		err = runGrantAdmin(m, args[1:])
+		db.Close()
+		if err != nil {
+			logger.Error("grant admin", slog.Any("err", err))
+			os.Exit(1)
+		}
+
+		return
+	}
 
 	// Session manager
+	sqlStore := sqlite3store.New(db)
+	store := hashedSessionStore{sqlStore}
 	sm := scs.New()
-	sm.Store = sqlite3store.New(db)
-	sm.Lifetime = 12 * time.Hour
+	sm.Store = store
+	sm.Lifetime = cfg.session.lifetime + sessionExpiredNoticeWindow
+	sm.Cookie.Secure = cfg.session.cookieSecure
 	gob.Register(FlashMessage{})
 	gob.Register(FormErrors{})
 
@@ -75,86 +134,124 @@ func main() {
 		os.Exit(1)
 	}
 
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
 	app := &application{
 		config:         cfg,
 		logger:         logger,
-		models:         models.New(db),
+		mailer:         mailer.New(newMailSender(cfg, logger)),
+		models:         m,
+		authenticator:  newAuthenticator(cfg, m, logger),
+		oidc:           newOIDCClient(cfg),
 		sessionManager: sm,
+		sessionStore:   store,
 		templateCache:  tc,
 		formDecoder:    form.NewDecoder(),
 		validate:       validator.New(),
+		backgroundCtx:  bgCtx,
+		stopBackground: stopBackground,
+	}
+
+	app.backgroundTicker(time.Hour, func(ctx context.Context) {
+		err := app.models.Token.DeleteExpired(ctx)
+		if err != nil {
+			logger.Error("delete expired tokens", slog.Any("err", err))
+		}
+
+		err = app.models.LoginThrottle.DeleteExpired(ctx, loginFailureWindow)
+		if err != nil {
+			logger.Error("delete expired login throttles", slog.Any("err", err))
+		}
+
+		err = app.models.RateLimit.DeleteExpired(ctx)
+		if err != nil {
+			logger.Error("delete expired rate limits", slog.Any("err", err))
+		}
+
+		err = app.models.UserSession.DeleteExpired(ctx)
+		if err != nil {
+			logger.Error("delete expired sessions", slog.Any("err", err))
+		}
+
+		err = app.models.AccessToken.DeleteExpired(ctx)
+		if err != nil {
+			logger.Error("delete expired access tokens", slog.Any("err", err))
+		}
+
+		err = app.models.RememberToken.DeleteExpired(ctx)
+		if err != nil {
+			logger.Error("delete expired remember tokens", slog.Any("err", err))
+		}
+	})
+
+	err = app.serve(errLog)
+	if err != nil {
+		logger.Error("server error", slog.Any("err", err))
 	}
 
-	srv := &http.Server{
-		Addr:     fmt.Sprintf(":%d", cfg.port),
-		Handler:  app.routes(),
-		ErrorLog: errLog,
+	// Nothing may touch the database past this point
+	sqlStore.StopCleanup()
+	err = db.Close()
+	if err != nil {
+		logger.Error("unable to close db", slog.Any("err", err))
+		os.Exit(1)
 	}
 
-	logger.Info("starting server", "addr", srv.Addr)
-	err = srv.ListenAndServe()
-	logger.Error(err.Error())
+	logger.Info("closed database")
 }
 
-func newSlogHandler(dev bool) slog.Handler {
-	if dev {
-		// Development text hanlder
+func newSlogHandler(cfg config) slog.Handler {
+	if cfg.log.format == "text" {
+		// Human readable text handler, with source locations in development
 		return tint.NewHandler(os.Stdout, &tint.Options{
-			AddSource:  true,
-			Level:      slog.LevelDebug,
+			AddSource:  cfg.dev,
+			Level:      cfg.log.level,
 			TimeFormat: time.Kitchen,
 		})
 	}
 
-	// Production use JSON handler with default opts
-	return slog.NewJSONHandler(os.Stdout, nil)
+	return slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: cfg.log.level,
+	})
+}
+
+// Deliver emails over SMTP when a host is configured, otherwise log them,
+// which config validation only allows with -dev.
+func newMailSender(cfg config, logger *slog.Logger) mailer.Sender {
+	if cfg.smtp.host == "" {
+		return mailer.LogSender{Logger: logger}
+	}
+
+	return mailer.SMTPSender{
+		Host:     cfg.smtp.host,
+		Port:     cfg.smtp.port,
+		Username: cfg.smtp.username,
+		Password: cfg.smtp.password,
+		From:     cfg.smtp.sender,
+	}
 }
 
-func initDB(dsn string) (*sql.DB, error) {
+// Open the SQLite database with foreign key enforcement, which SQLite leaves
+// off by default and can only be enabled per connection.
+func openDB(dsn string) (*sql.DB, error) {
+	if !strings.Contains(dsn, "_foreign_keys=") && !strings.Contains(dsn, "_fk=") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+
+		dsn += sep + "_foreign_keys=on"
+	}
+
 	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	query := `
-		CREATE TABLE IF NOT EXISTS sessions (
-			token TEXT PRIMARY KEY,
-			data BLOB NOT NULL,
-			expiry REAL NOT NULL
-		);
-
-		CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions(expiry);
-		
-		CREATE TABLE IF NOT EXISTS User (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT NOT NULL UNIQUE,
-			password TEXT NOT NULL
-		);
-		
-		CREATE TABLE IF NOT EXISTS Permission (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL UNIQUE
-		);
-
-		CREATE TABLE IF NOT EXISTS UserPermission (
-			user_id INTEGER NOT NULL,
-			permission_id INTEGER NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE,
-			FOREIGN KEY (permission_id) REFERENCES Permissions (id) ON DELETE CASCADE,
-			PRIMARY KEY (user_id, permission_id)
-		);
-
-		INSERT INTO Permission (name)
-		VALUES
-			('admin'),
-			('services'),
-			('tags'),
-			('forwarding'),
-			('logs')
-		ON CONFLICT (name) DO NOTHING;`
-
-	_, err = db.Exec(query)
+	err = db.Ping()
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
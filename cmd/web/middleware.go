@@ -2,19 +2,159 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"log/slog"
 	"net/http"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/justinas/nosurf"
 )
 
+const requestIDHeader = "X-Request-ID"
+
+// Request scoped logging state. Stored as a pointer so inner middleware, such
+// as authenticate, can add to it after logRequest has created it.
+type requestLog struct {
+	logger *slog.Logger
+	userID int
+}
+
+// Log every request with a request ID that is propagated from, or added to,
+// the X-Request-ID header. Handlers log through app.requestLogger so their
+// entries carry the same request ID.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		rl := &requestLog{
+			logger: app.logger.With(slog.String("request_id", id)),
+		}
+
+		ctx := context.WithValue(r.Context(), requestLogContextKey, rl)
+		r = r.WithContext(ctx)
+
+		rec := &responseRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		next.ServeHTTP(rec, r)
+
+		var route string
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.statusCode()),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("ip", app.clientIP(r)),
+		}
+
+		rl.logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// Logger for the request, falling back to the application logger outside of
+// logRequest.
+func (app *application) requestLogger(r *http.Request) *slog.Logger {
+	rl, ok := r.Context().Value(requestLogContextKey).(*requestLog)
+	if !ok {
+		return app.logger
+	}
+
+	return rl.logger
+}
+
+// Attach the authenticated user to the request log.
+func (app *application) setRequestUserID(r *http.Request, id int) {
+	rl, ok := r.Context().Value(requestLogContextKey).(*requestLog)
+	if !ok || rl.userID == id {
+		return
+	}
+
+	rl.userID = id
+	rl.logger = rl.logger.With(slog.Int("user_id", id))
+}
+
+// Accept client supplied request IDs only if they are short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// responseRecorder captures the status code and body size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.status == 0 {
+		rec.status = statusCode
+	}
+
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+
+	return n, err
+}
+
+// Let http.ResponseController reach the underlying writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *responseRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+
+	return rec.status
+}
+
 func (app *application) recovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
 				w.Header().Set("Connection", "close")
 
-				app.logger.Error("recovered from panic", slog.Any("err", err))
+				app.requestLogger(r).Error("recovered from panic", slog.Any("err", err))
 
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
@@ -42,7 +182,7 @@ func (app *application) noSurf(next http.Handler) http.Handler {
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
-		Secure:   true,
+		Secure:   app.config.session.cookieSecure,
 		SameSite: http.SameSiteStrictMode,
 	})
 	csrfHandler.SetFailureHandler(app.csrfFailureHandler())
@@ -52,9 +192,10 @@ func (app *application) noSurf(next http.Handler) http.Handler {
 
 func (app *application) csrfFailureHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		app.logger.Error("csrf failure handler",
+		app.requestLogger(r).Error("csrf failure handler",
 			slog.String("method", r.Method),
-			slog.String("uri", r.URL.RequestURI()),
+			slog.String("path", r.URL.Path),
+			slog.String("ip", app.clientIP(r)),
 		)
 
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -63,10 +204,68 @@ func (app *application) csrfFailureHandler() http.Handler {
 
 // Reads session authenticated user id key and checks if that user exists.
 // If all systems check, then set authenticated context to the request.
+// Sessions past their idle or absolute limit are logged out, unless the device
+// is remembered.
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverError := func(err error) {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			app.requestLogger(r).Error("middleware authenticate", slog.Any("err", err))
+		}
+
+		var idle time.Duration
+		var expired string
+
 		id := app.sessionManager.GetInt(r.Context(), authenticatedUserIDSessionKey)
+		if id != 0 {
+			var err error
+			idle, err = app.idleTimeout(r.Context(), id)
+			if err != nil {
+				serverError(err)
+
+				return
+			}
+
+			expiry, reason := app.sessionExpiry(r.Context(), idle)
+			if time.Now().After(expiry) {
+				err = app.expireSession(r)
+				if err != nil {
+					serverError(err)
+
+					return
+				}
+
+				expired = reason
+				id = 0
+			}
+		}
+
+		if id == 0 {
+			// The session may have expired on a remembered device
+			var err error
+			id, err = app.loginWithRememberToken(w, r)
+			if err != nil {
+				serverError(err)
+
+				return
+			}
+
+			if id != 0 {
+				idle, err = app.idleTimeout(r.Context(), id)
+				if err != nil {
+					serverError(err)
+
+					return
+				}
+			}
+		}
+
 		if id == 0 {
+			if expired != "" {
+				app.putFlash(r, FlashMessage{Type: FlashInfo, Message: expired})
+				app.saveReturnPath(r)
+			}
+
 			// Not authenticated, continue without context
 			next.ServeHTTP(w, r)
 
@@ -74,10 +273,9 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// Check if user with ID exists in database
-		exists, err := app.models.User.Exists(id)
+		exists, err := app.models.User.Exists(r.Context(), id)
 		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			app.logger.Error("middleware authenticate", slog.Any("err", err))
+			serverError(err)
 
 			return
 		}
@@ -86,6 +284,17 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		if exists {
 			ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
 			r = r.WithContext(ctx)
+
+			app.setRequestUserID(r, id)
+			app.touchSession(r.Context())
+
+			expiry, _ := app.sessionExpiry(r.Context(), idle)
+			err = app.trackSession(r, id, expiry)
+			if err != nil {
+				serverError(err)
+
+				return
+			}
 		}
 
 		next.ServeHTTP(w, r)
@@ -95,6 +304,8 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 func (app *application) requireAuthentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.isAuthenticated(r) {
+			// Come back here after logging in
+			app.saveReturnPath(r)
 			http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
 			return
 		}
@@ -105,3 +316,85 @@ func (app *application) requireAuthentication(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Only allow authenticated users that hold the named permission. Must be
+// used after requireAuthentication.
+func (app *application) requirePermission(code string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			suid, err := app.getSessionUserID(r)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				app.requestLogger(r).Error("middleware require permission", slog.Any("err", err))
+
+				return
+			}
+
+			ok, err := app.models.Permission.Check(r.Context(), suid, code)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				app.requestLogger(r).Error("middleware require permission", slog.Any("err", err))
+
+				return
+			}
+
+			if !ok {
+				app.renderError(w, r, http.StatusForbidden, "missing permission: "+code)
+
+				return
+			}
+
+			// Permissions held before the email address was verified, such as
+			// one granted with grant-admin right after signup, wait until it is
+			user, err := app.models.User.GetWithID(r.Context(), suid)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				app.requestLogger(r).Error("middleware require permission", slog.Any("err", err))
+
+				return
+			}
+
+			if user.Unverified() {
+				app.renderError(w, r, http.StatusForbidden, "verify your email address to use the "+code+" permission")
+
+				return
+			}
+
+			// Sensitive permissions may only be used with two-factor enabled
+			enrolled, err := app.twoFactorSatisfied(r, suid, code)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				app.requestLogger(r).Error("middleware require permission", slog.Any("err", err))
+
+				return
+			}
+
+			if !enrolled {
+				f := FlashMessage{
+					Type:    FlashInfo,
+					Message: "Set up two-factor authentication to use the " + code + " permission.",
+				}
+				app.putFlash(r, f)
+				http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Check the user has two-factor enabled if the permission requires it.
+func (app *application) twoFactorSatisfied(r *http.Request, userID int, code string) (bool, error) {
+	required, err := app.models.Permission.GetAllRequiringTwoFactor(r.Context())
+	if err != nil {
+		return false, err
+	}
+
+	if !required.Include(code) {
+		return true, nil
+	}
+
+	return app.models.TwoFactor.Enabled(r.Context(), userID)
+}
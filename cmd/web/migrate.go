@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/micahco/web-lite/internal/migrate"
+	"github.com/micahco/web-lite/migrations"
+)
+
+const migrateUsage = "usage: web migrate up|down|status|goto <version>"
+
+// Migrations may rebuild large tables, so allow far more than ctxTimeout.
+const migrateTimeout = 5 * time.Minute
+
+// Apply pending migrations on boot.
+func migrateUp(db *sql.DB, logger *slog.Logger) error {
+	m, err := migrate.New(db, migrations.Files)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	err = m.Up(ctx)
+	switch {
+	case errors.Is(err, migrate.ErrNoChange):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	logger.Info("applied database migrations")
+
+	return nil
+}
+
+// Handle the migrate subcommand.
+func runMigrate(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	m, err := migrate.New(db, migrations.Files)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	switch args[0] {
+	case "up":
+		err = m.Up(ctx)
+	case "down":
+		err = m.Down(ctx)
+	case "goto":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+
+		var version int
+		version, err = strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+
+		err = m.Goto(ctx, version)
+	case "status":
+		return printMigrateStatus(ctx, m)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	if errors.Is(err, migrate.ErrNoChange) {
+		fmt.Println("no change")
+
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return printMigrateStatus(ctx, m)
+}
+
+func printMigrateStatus(ctx context.Context, m *migrate.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+
+	for _, s := range statuses {
+		applied := "pending"
+		if !s.AppliedAt.IsZero() {
+			applied = s.AppliedAt.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+
+	return tw.Flush()
+}
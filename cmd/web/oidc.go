@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/micahco/web-lite/internal/auth"
+	"github.com/micahco/web-lite/internal/models"
+	"github.com/micahco/web-lite/internal/oidc"
+)
+
+const (
+	oidcStateSessionKey    = "oidcState"
+	oidcNonceSessionKey    = "oidcNonce"
+	oidcVerifierSessionKey = "oidcVerifier"
+	oidcExpirySessionKey   = "oidcExpiry"
+	// User linking an identity to their account, zero when logging in
+	oidcLinkUserIDSessionKey = "oidcLinkUserID"
+)
+
+// Create the single sign-on client, nil if no provider is configured.
+func newOIDCClient(cfg config) *oidc.Client {
+	if cfg.oidc.issuer == "" {
+		return nil
+	}
+
+	return oidc.New(oidc.Config{
+		Issuer:       cfg.oidc.issuer,
+		ClientID:     cfg.oidc.clientID,
+		ClientSecret: cfg.oidc.clientSecret,
+		RedirectURL:  cfg.baseURL + "/auth/oidc/callback",
+		Scopes:       cfg.oidc.scopes,
+	}, &http.Client{Timeout: 10 * time.Second})
+}
+
+// Send the user to the provider, keeping the secrets of the login in the
+// session until they come back.
+func (app *application) startOIDC(w http.ResponseWriter, r *http.Request, linkUserID int) error {
+	a, err := app.oidc.AuthCodeURL(r.Context())
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), oidcStateSessionKey, a.State)
+	app.sessionManager.Put(r.Context(), oidcNonceSessionKey, a.Nonce)
+	app.sessionManager.Put(r.Context(), oidcVerifierSessionKey, a.Verifier)
+	app.sessionManager.Put(r.Context(), oidcExpirySessionKey, time.Now().Add(oidc.Timeout).Unix())
+	app.sessionManager.Put(r.Context(), oidcLinkUserIDSessionKey, linkUserID)
+
+	http.Redirect(w, r, a.URL, http.StatusSeeOther)
+
+	return nil
+}
+
+// Take the login in progress out of the session, so that a callback can only
+// be used once. Returns nil if there is none or it expired.
+func (app *application) popOIDC(r *http.Request) (*oidc.AuthRequest, int) {
+	a := &oidc.AuthRequest{
+		State:    app.sessionManager.PopString(r.Context(), oidcStateSessionKey),
+		Nonce:    app.sessionManager.PopString(r.Context(), oidcNonceSessionKey),
+		Verifier: app.sessionManager.PopString(r.Context(), oidcVerifierSessionKey),
+	}
+	expiry := app.sessionManager.GetInt64(r.Context(), oidcExpirySessionKey)
+	app.sessionManager.Remove(r.Context(), oidcExpirySessionKey)
+	linkUserID := app.sessionManager.PopInt(r.Context(), oidcLinkUserIDSessionKey)
+
+	if a.State == "" || time.Now().Unix() > expiry {
+		return nil, 0
+	}
+
+	return a, linkUserID
+}
+
+func (app *application) failOIDC(w http.ResponseWriter, r *http.Request, redirect, msg string) {
+	f := FlashMessage{
+		Type:    FlashError,
+		Message: msg,
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+func (app *application) handleAuthOIDCGet(w http.ResponseWriter, r *http.Request) error {
+	if app.oidc == nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	if app.isAuthenticated(r) {
+		return app.renderError(w, r, http.StatusBadRequest, "already authenticated")
+	}
+
+	return app.startOIDC(w, r, 0)
+}
+
+func (app *application) handleAuthOIDCCallbackGet(w http.ResponseWriter, r *http.Request) error {
+	if app.oidc == nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	a, linkUserID := app.popOIDC(r)
+
+	failPath := "/auth/login"
+	if linkUserID != 0 {
+		failPath = "/account/identities"
+	}
+
+	q := r.URL.Query()
+
+	// The state ties the callback to the browser that started the login
+	if a == nil || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(a.State)) != 1 {
+		app.failOIDC(w, r, failPath, "Your single sign-on login expired. Please try again.")
+
+		return nil
+	}
+
+	if e := q.Get("error"); e != "" {
+		app.securityEvent(r, "oidc_login_failed", slog.String("error", e), slog.String("description", q.Get("error_description")))
+		app.failOIDC(w, r, failPath, "Single sign-on failed. Please try again.")
+
+		return nil
+	}
+
+	token, err := app.oidc.Exchange(r.Context(), q.Get("code"), a)
+	if err != nil {
+		if errors.Is(err, oidc.ErrInvalidToken) || errors.Is(err, oidc.ErrProvider) {
+			app.securityEvent(r, "oidc_login_failed", slog.Any("err", err))
+			app.failOIDC(w, r, failPath, "Single sign-on failed. Please try again.")
+
+			return nil
+		}
+
+		return err
+	}
+
+	if linkUserID != 0 {
+		return app.linkIdentity(w, r, linkUserID, token)
+	}
+
+	var userID int
+
+	identity, err := app.models.Identity.GetWithSubject(r.Context(), token.Issuer, token.Subject)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		if !app.config.oidc.autoProvision {
+			app.failOIDC(w, r, failPath, "No account is linked to that identity. Log in with your password and link it from the single sign-on page.")
+
+			return nil
+		}
+
+		userID, err = app.provisionUser(r.Context(), token)
+		if err != nil {
+			if errors.Is(err, models.ErrDuplicateUsername) || errors.Is(err, models.ErrDuplicateEmail) {
+				app.failOIDC(w, r, failPath, "An account with your username or email already exists. Log in with your password and link your identity from the single sign-on page.")
+
+				return nil
+			}
+
+			if errors.Is(err, errNoUsernameClaim) {
+				app.failOIDC(w, r, failPath, "Your identity provider did not share a username.")
+
+				return nil
+			}
+
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		userID = identity.UserID
+
+		err = app.models.Identity.Use(r.Context(), identity.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The provider vouches for the first factor only
+	pending, err := app.beginTwoFactor(w, r, userID, false)
+	if err != nil {
+		return err
+	}
+
+	if pending {
+		return nil
+	}
+
+	err = app.login(r, userID)
+	if err != nil {
+		return err
+	}
+
+	redirect, err := app.afterLoginPath(r, userID)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+
+	return nil
+}
+
+var errNoUsernameClaim = errors.New("no username claim")
+
+// Name the identity is shown with
+func identityName(token *oidc.IDToken) string {
+	if token.Email != "" {
+		return token.Email
+	}
+
+	if token.PreferredUsername != "" {
+		return token.PreferredUsername
+	}
+
+	return token.Subject
+}
+
+// Create an account for a new identity, with the permissions its groups map
+// to. The account gets a random password, which its owner can replace with
+// a password reset.
+func (app *application) provisionUser(ctx context.Context, token *oidc.IDToken) (int, error) {
+	user := &models.User{Username: token.PreferredUsername}
+	if user.Username == "" {
+		user.Username = token.Email
+	}
+
+	if user.Username == "" {
+		return 0, errNoUsernameClaim
+	}
+
+	// Only addresses the provider vouches for are kept, so that they count
+	// as verified
+	if token.Email != "" && token.EmailVerified {
+		user.Email = token.Email
+		user.VerifiedAt = time.Now()
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return 0, err
+	}
+
+	err = app.models.User.SetPassword(user, base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		return 0, err
+	}
+
+	var grants []string
+	for _, group := range token.Strings(app.config.oidc.groupsClaim) {
+		if code, ok := app.config.oidc.groupPermissions[group]; ok {
+			grants = append(grants, code)
+		}
+	}
+
+	err = app.models.WithTx(ctx, func(m models.Models) error {
+		err := m.User.Insert(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		err = m.Identity.Insert(ctx, &models.Identity{
+			UserID:  user.ID,
+			Issuer:  token.Issuer,
+			Subject: token.Subject,
+			Name:    identityName(token),
+		})
+		if err != nil {
+			return err
+		}
+
+		return m.Permission.Grant(ctx, user.ID, grants...)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	app.logger.Info("provisioned user",
+		slog.Int("user_id", user.ID),
+		slog.String("username", user.Username),
+		slog.Any("permissions", grants))
+
+	return user.ID, nil
+}
+
+// Finish linking an identity to the account that started it.
+func (app *application) linkIdentity(w http.ResponseWriter, r *http.Request, linkUserID int, token *oidc.IDToken) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	if !app.isAuthenticated(r) || suid != linkUserID {
+		app.failOIDC(w, r, "/auth/login", "Your single sign-on login expired. Please try again.")
+
+		return nil
+	}
+
+	err = app.models.Identity.Insert(r.Context(), &models.Identity{
+		UserID:  suid,
+		Issuer:  token.Issuer,
+		Subject: token.Subject,
+		Name:    identityName(token),
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateIdentity) {
+			app.failOIDC(w, r, "/account/identities", "That identity is already linked to an account.")
+
+			return nil
+		}
+
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Linked " + identityName(token) + ".",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/identities", http.StatusSeeOther)
+
+	return nil
+}
+
+// Identities the user linked through single sign-on. Links made by the LDAP
+// backend are left out: the directory manages them, and without one the user
+// could not log in.
+func (app *application) oidcIdentities(ctx context.Context, userID int) ([]*models.Identity, error) {
+	identities, err := app.models.Identity.GetAllForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(identities, auth.IsLDAPIdentity), nil
+}
+
+func (app *application) handleAccountIdentitiesGet(w http.ResponseWriter, r *http.Request) error {
+	if app.oidc == nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Identities []*models.Identity
+	}
+
+	data.Identities, err = app.oidcIdentities(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	return app.render(w, r, http.StatusOK, "account-identities.tmpl", data)
+}
+
+func (app *application) handleAccountIdentitiesLinkPost(w http.ResponseWriter, r *http.Request) error {
+	if app.oidc == nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	return app.startOIDC(w, r, suid)
+}
+
+func (app *application) handleAccountIdentityDeletePost(w http.ResponseWriter, r *http.Request) error {
+	if app.oidc == nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(r)
+	if err != nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	identities, err := app.oidcIdentities(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	if !slices.ContainsFunc(identities, func(i *models.Identity) bool { return i.ID == id }) {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	err = app.models.Identity.Delete(r.Context(), id, suid)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		}
+
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Unlinked the identity.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/identities", http.StatusSeeOther)
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/micahco/web-lite/internal/auth"
+	"github.com/micahco/web-lite/internal/models"
+)
+
+func TestIdentitiesLeaveOutLDAPLinks(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApplication(t, "-oidc-issuer=https://idp.example.com", "-oidc-client-id=web")
+	ts := newTestServer(t, app.routes())
+
+	user, err := app.models.User.New(ctx, "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sso := &models.Identity{UserID: user.ID, Issuer: "https://idp.example.com", Subject: "1", Name: "alice@idp.example.com"}
+	ldap := &models.Identity{UserID: user.ID, Issuer: auth.LDAPIssuerPrefix + "dc=example,dc=com", Subject: "uid=alice,dc=example,dc=com", Name: "uid=alice,dc=example,dc=com"}
+	for _, i := range []*models.Identity{sso, ldap} {
+		err = app.models.Identity.Insert(ctx, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := ts.postForm(t, "/auth/login", "/auth/login", url.Values{
+		"username": {"alice"},
+		"password": {"password123"},
+	})
+	if res.status != http.StatusSeeOther || res.location != "/" {
+		t.Fatalf("login: got %+v, want redirect to /", res)
+	}
+
+	res = ts.get(t, "/account/identities")
+	if !strings.Contains(res.body, sso.Name) {
+		t.Errorf("page does not list %s", sso.Name)
+	}
+
+	if strings.Contains(res.body, ldap.Name) {
+		t.Errorf("page lists %s", ldap.Name)
+	}
+
+	deletePath := func(i *models.Identity) string {
+		return fmt.Sprintf("/account/identities/%d/delete", i.ID)
+	}
+
+	res = ts.postForm(t, "/account/identities", deletePath(ldap), url.Values{})
+	if res.status != http.StatusNotFound {
+		t.Errorf("delete LDAP link: got %d, want %d", res.status, http.StatusNotFound)
+	}
+
+	res = ts.postForm(t, "/account/identities", deletePath(sso), url.Values{})
+	if res.status != http.StatusSeeOther {
+		t.Errorf("delete single sign-on link: got %d, want %d", res.status, http.StatusSeeOther)
+	}
+
+	identities, err := app.models.Identity.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(identities) != 1 || identities[0].ID != ldap.ID {
+		t.Errorf("got %d identities left, want only the LDAP link", len(identities))
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/micahco/web-lite/internal/openapi"
+	"github.com/micahco/web-lite/ui"
+)
+
+// Prefix of the routes the OpenAPI document must describe
+const apiVersionPrefix = "/api/v1/"
+
+// apiOperation documents an API route: the request and response bodies are
+// described from their Go types, the errors from how the route is protected.
+type apiOperation struct {
+	method string
+	path   string
+	id     string
+	tag    string
+	// First line of the summary, then the description
+	doc string
+	// Anyone may call it, no access token is needed
+	public bool
+	// Permission the access token must be scoped to
+	permission string
+	query      []openapi.Parameter
+	request    any
+	// Status and body of a success, nil for no body
+	status   int
+	response any
+	// Errors other than those implied by the fields above
+	errors []int
+}
+
+var apiOperations = []apiOperation{
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/auth/signup",
+		id:       "signup",
+		tag:      "auth",
+		doc:      "Create an account\nThe response is the same whether or not the username was available. When email verification is enabled, email is required and a verification link is sent to it.",
+		public:   true,
+		request:  apiSignupRequest{},
+		status:   http.StatusAccepted,
+		response: apiMessageResponse{},
+		errors:   []int{http.StatusTooManyRequests},
+	},
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/auth/reset",
+		id:       "requestPasswordReset",
+		tag:      "auth",
+		doc:      "Request a password reset link\nThe link is emailed to the account's address. The response is the same whether or not the account exists.",
+		public:   true,
+		request:  apiResetRequest{},
+		status:   http.StatusAccepted,
+		response: apiMessageResponse{},
+		errors:   []int{http.StatusTooManyRequests},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/user",
+		id:       "getCurrentUser",
+		tag:      "user",
+		doc:      "Get the user of the access token\nIncludes the token, with the permissions it may use right now.",
+		status:   http.StatusOK,
+		response: apiCurrentUserResponse{},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/user/tokens",
+		id:       "listTokens",
+		tag:      "user",
+		doc:      "List the access tokens of the user",
+		status:   http.StatusOK,
+		response: apiTokensResponse{},
+	},
+	{
+		method: http.MethodDelete,
+		path:   "/api/v1/user/tokens/{id}",
+		id:     "revokeToken",
+		tag:    "user",
+		doc:    "Revoke an access token of the user\nThe token may be the one making the request.",
+		status: http.StatusNoContent,
+	},
+	{
+		method:     http.MethodGet,
+		path:       "/api/v1/users",
+		id:         "listUsers",
+		tag:        "admin",
+		doc:        "List users",
+		permission: "admin",
+		query: []openapi.Parameter{
+			{Name: "q", In: "query", Description: "Search usernames", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "page", In: "query", Schema: &openapi.Schema{Type: "integer", Minimum: ptr(1.0)}},
+			{Name: "page_size", In: "query", Schema: &openapi.Schema{Type: "integer", Minimum: ptr(1.0), Maximum: ptr(100.0)}},
+		},
+		status:   http.StatusOK,
+		response: apiUsersResponse{},
+	},
+	{
+		method:     http.MethodPost,
+		path:       "/api/v1/users",
+		id:         "createUser",
+		tag:        "admin",
+		doc:        "Create a user",
+		permission: "admin",
+		request:    apiCreateUserRequest{},
+		status:     http.StatusCreated,
+		response:   apiUserResponse{},
+		errors:     []int{http.StatusConflict},
+	},
+	{
+		method:     http.MethodGet,
+		path:       "/api/v1/users/{id}",
+		id:         "getUser",
+		tag:        "admin",
+		doc:        "Get a user with their permissions",
+		permission: "admin",
+		status:     http.StatusOK,
+		response:   apiUserDetailResponse{},
+	},
+	{
+		method:     http.MethodDelete,
+		path:       "/api/v1/users/{id}",
+		id:         "deleteUser",
+		tag:        "admin",
+		doc:        "Delete a user\nAdmins can not delete themselves or the last admin.",
+		permission: "admin",
+		status:     http.StatusNoContent,
+		errors:     []int{http.StatusUnprocessableEntity},
+	},
+	{
+		method:     http.MethodPut,
+		path:       "/api/v1/users/{id}/password",
+		id:         "setUserPassword",
+		tag:        "admin",
+		doc:        "Set the password of a user\nThe user is logged out everywhere and their access tokens are revoked. Fails with a conflict if the user changed since version.",
+		permission: "admin",
+		request:    apiSetPasswordRequest{},
+		status:     http.StatusNoContent,
+		errors:     []int{http.StatusConflict},
+	},
+	{
+		method:     http.MethodPut,
+		path:       "/api/v1/users/{id}/permissions/{permission}",
+		id:         "grantPermission",
+		tag:        "admin",
+		doc:        "Grant a permission to a user\nThe user must have verified their email address.",
+		permission: "admin",
+		status:     http.StatusNoContent,
+		errors:     []int{http.StatusUnprocessableEntity},
+	},
+	{
+		method:     http.MethodDelete,
+		path:       "/api/v1/users/{id}/permissions/{permission}",
+		id:         "revokePermission",
+		tag:        "admin",
+		doc:        "Revoke a permission from a user\nAdmins can not revoke their own admin permission, nor that of the last admin.",
+		permission: "admin",
+		status:     http.StatusNoContent,
+		errors:     []int{http.StatusUnprocessableEntity},
+	},
+	{
+		method:     http.MethodGet,
+		path:       "/api/v1/permissions",
+		id:         "listPermissions",
+		tag:        "admin",
+		doc:        "List the permissions that can be granted",
+		permission: "admin",
+		status:     http.StatusOK,
+		response:   apiPermissionsResponse{},
+	},
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Generate the OpenAPI document of the API. TestAPISpecMatchesRoutes keeps
+// the documented operations in step with the routes.
+func newAPISpec() ([]byte, error) {
+	doc := openapi.New(openapi.Info{
+		Title:       "web-lite",
+		Description: "Scripts authenticate with a personal access token, created from the API tokens page of the dashboard, sent as \"Authorization: Bearer <token>\". Creating a token requires a recent password, so admin operations take none. Failed requests have an error body whose code follows the status.",
+		Version:     "1",
+	})
+
+	doc.Components.SecuritySchemes["accessToken"] = openapi.SecurityScheme{
+		Type:         "http",
+		Scheme:       "bearer",
+		BearerFormat: "wlat_...",
+	}
+
+	for _, op := range apiOperations {
+		doc.AddOperation(op.method, op.path, op.describe(doc))
+	}
+
+	return doc.Build()
+}
+
+func (op apiOperation) describe(doc *openapi.Document) *openapi.Operation {
+	summary, description, _ := strings.Cut(op.doc, "\n")
+
+	o := &openapi.Operation{
+		OperationID: op.id,
+		Summary:     summary,
+		Description: description,
+		Tags:        []string{op.tag},
+		Responses:   map[string]openapi.Response{},
+	}
+
+	for _, name := range openapi.PathParams(op.path) {
+		p := openapi.Parameter{Name: name, In: "path", Required: true, Schema: &openapi.Schema{Type: "string"}}
+		if name == "id" {
+			p.Schema = &openapi.Schema{Type: "integer", Format: "int64", Minimum: ptr(1.0)}
+		}
+
+		o.Parameters = append(o.Parameters, p)
+	}
+
+	o.Parameters = append(o.Parameters, op.query...)
+
+	if op.permission != "" {
+		o.Description = strings.TrimSpace(o.Description + " Requires an access token scoped to the " + op.permission + " permission.")
+	}
+
+	success := openapi.Response{Description: http.StatusText(op.status)}
+	if op.response != nil {
+		success.Content = doc.JSONContent(op.response)
+	}
+	o.Responses[strconv.Itoa(op.status)] = success
+
+	failures := slices.Clone(op.errors)
+
+	if op.request != nil {
+		o.RequestBody = &openapi.RequestBody{Required: true, Content: doc.JSONContent(op.request)}
+		failures = append(failures, http.StatusBadRequest, http.StatusUnprocessableEntity)
+	}
+
+	if !op.public {
+		o.Security = []openapi.SecurityRequirement{{"accessToken": {}}}
+		failures = append(failures, http.StatusUnauthorized)
+	}
+
+	if op.permission != "" {
+		failures = append(failures, http.StatusForbidden)
+	}
+
+	if slices.Contains(openapi.PathParams(op.path), "id") {
+		failures = append(failures, http.StatusNotFound)
+	}
+
+	errorContent := doc.JSONContent(apiErrorResponse{})
+	for _, status := range failures {
+		o.Responses[strconv.Itoa(status)] = openapi.Response{
+			Description: apiErrorCode(status),
+			Content:     errorContent,
+		}
+	}
+
+	o.Responses["default"] = openapi.Response{Description: apiCodeInternal, Content: errorContent}
+
+	return o
+}
+
+func (app *application) handleAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(app.apiSpec)
+}
+
+// Self-hosted, so the docs work offline and under the CSP
+func (app *application) handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	if app.config.dev {
+		http.ServeFile(w, r, "./ui/static/api-docs.html")
+
+		return
+	}
+	http.ServeFileFS(w, r, ui.Files, "static/api-docs.html")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAPISpecMatchesRoutes(t *testing.T) {
+	app := newTestApplication(t)
+
+	var documented []string
+	for _, op := range apiOperations {
+		documented = append(documented, op.method+" "+op.path)
+	}
+
+	var registered []string
+	err := chi.Walk(app.routes(), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if strings.HasPrefix(route, apiVersionPrefix) {
+			registered = append(registered, method+" "+route)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range registered {
+		if !slices.Contains(documented, route) {
+			t.Errorf("route %s is not documented", route)
+		}
+	}
+
+	for _, route := range documented {
+		if !slices.Contains(registered, route) {
+			t.Errorf("documented operation %s has no route", route)
+		}
+	}
+
+	_, err = newAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+	"github.com/micahco/web-lite/internal/webauthn"
+)
+
+const (
+	passkeyRegistrationSessionKey = "passkeyRegistration"
+	passkeyLoginSessionKey        = "passkeyLogin"
+)
+
+// Relying party for the configured base URL. Passkeys are bound to its
+// hostname, so changing base-url invalidates every registered passkey.
+func (app *application) relyingParty() webauthn.RelyingParty {
+	u, err := url.Parse(app.config.baseURL)
+	if err != nil || u.Host == "" {
+		return webauthn.RelyingParty{ID: "localhost", Name: "localhost", Origin: "http://localhost"}
+	}
+
+	return webauthn.RelyingParty{
+		ID:     u.Hostname(),
+		Name:   u.Hostname(),
+		Origin: u.Scheme + "://" + u.Host,
+	}
+}
+
+// Start a ceremony, storing its challenge in the session under key.
+func (app *application) newPasskeyChallenge(r *http.Request, key string) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := time.Now().Add(webauthn.Timeout).Unix()
+	app.sessionManager.Put(r.Context(), key, challenge)
+	app.sessionManager.Put(r.Context(), key+"Expiry", expiry)
+
+	return challenge, nil
+}
+
+// Take the challenge stored under key. Each challenge can be answered once;
+// nil if there is none or it expired.
+func (app *application) popPasskeyChallenge(r *http.Request, key string) []byte {
+	expiry := app.sessionManager.GetInt64(r.Context(), key+"Expiry")
+	challenge := app.sessionManager.PopBytes(r.Context(), key)
+	app.sessionManager.Remove(r.Context(), key+"Expiry")
+
+	if time.Now().Unix() > expiry {
+		return nil
+	}
+
+	return challenge
+}
+
+func passkeyUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+type jsonRedirect struct {
+	Redirect string `json:"redirect"`
+}
+
+func (app *application) handleAuthPasskeyOptionsPost(w http.ResponseWriter, r *http.Request) error {
+	if app.isAuthenticated(r) {
+		return writeJSON(w, http.StatusBadRequest, jsonError{"already authenticated"})
+	}
+
+	challenge, err := app.newPasskeyChallenge(r, passkeyLoginSessionKey)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, app.relyingParty().RequestOptions(challenge))
+}
+
+func (app *application) handleAuthPasskeyPost(w http.ResponseWriter, r *http.Request) error {
+	if app.isAuthenticated(r) {
+		return writeJSON(w, http.StatusBadRequest, jsonError{"already authenticated"})
+	}
+
+	challenge := app.popPasskeyChallenge(r, passkeyLoginSessionKey)
+	if challenge == nil {
+		return writeJSON(w, http.StatusBadRequest, jsonError{"login expired, please try again"})
+	}
+
+	var resp webauthn.AssertionResponse
+	err := readJSON(w, r, &resp)
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, jsonError{err.Error()})
+	}
+
+	unauthorized := func(reason string, err error) error {
+		app.securityEvent(r, "passkey_login_failed",
+			slog.String("reason", reason),
+			slog.Any("err", err))
+
+		return writeJSON(w, http.StatusUnauthorized, jsonError{"passkey not recognized"})
+	}
+
+	passkey, err := app.models.Passkey.GetWithCredentialID(r.Context(), resp.RawID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return unauthorized("unknown credential", err)
+		}
+
+		return err
+	}
+
+	cred := &webauthn.Credential{
+		ID:         passkey.CredentialID,
+		PublicKey:  passkey.PublicKey,
+		SignCount:  passkey.SignCount,
+		UserHandle: passkeyUserHandle(passkey.UserID),
+	}
+
+	signCount, err := app.relyingParty().VerifyAssertion(challenge, cred, &resp)
+	if err != nil {
+		return unauthorized("invalid assertion", err)
+	}
+
+	err = app.models.Passkey.Use(r.Context(), passkey.ID, passkey.SignCount, signCount)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return unauthorized("concurrent use", err)
+		}
+
+		return err
+	}
+
+	err = app.login(r, passkey.UserID)
+	if err != nil {
+		return err
+	}
+
+	redirect, err := app.afterLoginPath(r, passkey.UserID)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, jsonRedirect{redirect})
+}
+
+func (app *application) handleAccountPasskeysGet(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Passkeys []*models.Passkey
+	}
+
+	data.Passkeys, err = app.models.Passkey.GetAllForUser(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	return app.render(w, r, http.StatusOK, "account-passkeys.tmpl", data)
+}
+
+func (app *application) handleAccountPasskeysOptionsPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.User.GetWithID(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	passkeys, err := app.models.Passkey.GetAllForUser(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	exclude := make([]webauthn.Credential, len(passkeys))
+	for i, p := range passkeys {
+		exclude[i] = webauthn.Credential{ID: p.CredentialID}
+	}
+
+	challenge, err := app.newPasskeyChallenge(r, passkeyRegistrationSessionKey)
+	if err != nil {
+		return err
+	}
+
+	opts := app.relyingParty().CreationOptions(challenge, passkeyUserHandle(suid), user.Username, exclude)
+
+	return writeJSON(w, http.StatusOK, opts)
+}
+
+func (app *application) handleAccountPasskeysPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	challenge := app.popPasskeyChallenge(r, passkeyRegistrationSessionKey)
+	if challenge == nil {
+		return writeJSON(w, http.StatusBadRequest, jsonError{"registration expired, please try again"})
+	}
+
+	var input struct {
+		Name       string                        `json:"name" validate:"required,max=64"`
+		Credential webauthn.RegistrationResponse `json:"credential"`
+	}
+
+	err = readJSON(w, r, &input)
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, jsonError{err.Error()})
+	}
+
+	err = app.validate.Struct(input)
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, jsonError{"name is required and at most 64 characters"})
+	}
+
+	cred, err := app.relyingParty().VerifyRegistration(challenge, &input.Credential)
+	if err != nil {
+		app.requestLogger(r).Warn("passkey registration failed", slog.Any("err", err))
+
+		return writeJSON(w, http.StatusBadRequest, jsonError{"passkey could not be verified"})
+	}
+
+	passkey := &models.Passkey{
+		UserID:       suid,
+		CredentialID: cred.ID,
+		PublicKey:    cred.PublicKey,
+		SignCount:    cred.SignCount,
+		Name:         input.Name,
+	}
+
+	err = app.models.Passkey.Insert(r.Context(), passkey)
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateCredential) {
+			return writeJSON(w, http.StatusConflict, jsonError{"this passkey is already registered"})
+		}
+
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Passkey added.",
+	}
+	app.putFlash(r, f)
+
+	return writeJSON(w, http.StatusCreated, jsonRedirect{"/account/passkeys"})
+}
+
+func (app *application) handleAccountPasskeyRenamePost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(r)
+	if err != nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	var form struct {
+		Name    string `form:"name" validate:"required,max=64"`
+		Version int    `form:"version" validate:"required"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	passkey := &models.Passkey{
+		ID:      id,
+		UserID:  suid,
+		Name:    form.Name,
+		Version: form.Version,
+	}
+
+	err = app.models.Passkey.Update(r.Context(), passkey)
+	if err != nil {
+		if errors.Is(err, models.ErrEditConflict) {
+			return FormErrors{"Version": editConflictMessage}
+		}
+
+		return err
+	}
+
+	http.Redirect(w, r, "/account/passkeys", http.StatusSeeOther)
+
+	return nil
+}
+
+func (app *application) handleAccountPasskeyDeletePost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(r)
+	if err != nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	err = app.models.Passkey.Delete(r.Context(), id, suid)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		}
+
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Passkey removed.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/passkeys", http.StatusSeeOther)
+
+	return nil
+}
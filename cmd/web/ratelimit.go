@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	// Signups and password reset requests allowed per window. Both create
+	// rows and may send email, so they are limited even when they succeed.
+	maxSignupsPerIP       = 10
+	maxSignupsPerUsername = 3
+	maxResetsPerIP        = 10
+	maxResetsPerUsername  = 3
+	requestLimitWindow    = time.Hour
+)
+
+// Requests allowed for a rate limit key per window
+type requestLimit struct {
+	key string
+	max int
+}
+
+// Count a request against each limit. Returns the time until which requests
+// are refused, zero if this one is allowed.
+func (app *application) rateLimit(ctx context.Context, window time.Duration, limits ...requestLimit) (time.Time, error) {
+	var until time.Time
+
+	for _, l := range limits {
+		hits, expiresAt, err := app.models.RateLimit.Hit(ctx, l.key, window)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if hits > l.max && expiresAt.After(until) {
+			until = expiresAt
+		}
+	}
+
+	return until, nil
+}
+
+// Count a signup against the client and the username. Returns the time until
+// which further signups are refused, zero if this one is allowed.
+func (app *application) recordSignup(r *http.Request, username string) (time.Time, error) {
+	return app.rateLimit(r.Context(), requestLimitWindow,
+		requestLimit{"signup-ip:" + app.clientIP(r), maxSignupsPerIP},
+		requestLimit{"signup-user:" + username, maxSignupsPerUsername})
+}
+
+// Count a password reset request against the client and the username.
+// Unknown usernames are counted too, so rate limiting does not reveal which
+// ones exist.
+func (app *application) recordPasswordReset(r *http.Request, username string) (time.Time, error) {
+	return app.rateLimit(r.Context(), requestLimitWindow,
+		requestLimit{"reset-ip:" + app.clientIP(r), maxResetsPerIP},
+		requestLimit{"reset-user:" + username, maxResetsPerUsername})
+}
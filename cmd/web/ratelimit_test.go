@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+func TestResetFormRateLimit(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	request := func() string {
+		res := ts.postForm(t, "/auth/reset", "/auth/reset", url.Values{"username": {"alice"}})
+		if res.status != http.StatusSeeOther || res.location != "/auth/reset" {
+			t.Fatalf("got %+v, want redirect to /auth/reset", res)
+		}
+
+		return ts.get(t, "/auth/reset").body
+	}
+
+	for i := range maxResetsPerUsername {
+		if body := request(); !strings.Contains(body, "a password reset link has been sent") {
+			t.Fatalf("request %d: not accepted", i)
+		}
+	}
+
+	if body := request(); !strings.Contains(body, "Too many password reset requests") {
+		t.Error("request over the limit: not refused")
+	}
+}
+
+func TestVerificationEmailRateLimit(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApplication(t)
+
+	for i := range maxVerificationEmails {
+		until, err := app.recordVerificationEmail(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !until.IsZero() {
+			t.Fatalf("email %d: refused until %v", i, until)
+		}
+	}
+
+	until, err := app.recordVerificationEmail(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if until.IsZero() {
+		t.Error("email over the limit: not refused")
+	}
+
+	// Other users are unaffected
+	until, err = app.recordVerificationEmail(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !until.IsZero() {
+		t.Errorf("other user: refused until %v", until)
+	}
+
+	// Emails are not failed logins
+	_, err = app.models.LoginThrottle.Get(ctx, verificationRateLimitKey(1))
+	if !errors.Is(err, models.ErrNoRecord) {
+		t.Errorf("login throttle: got %v, want %v", err, models.ErrNoRecord)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+// Require the user to have entered their password recently before a
+// sensitive action. A session taken over by someone else, or restored from a
+// remembered device, cannot perform it without knowing the password. Must be
+// used after requireAuthentication.
+func (app *application) requireReauthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authTime := time.Unix(app.sessionManager.GetInt64(r.Context(), authTimeSessionKey), 0)
+		if time.Since(authTime) <= app.config.session.reauthWindow {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		app.saveReturnPath(r)
+
+		f := FlashMessage{
+			Type:    FlashInfo,
+			Message: "Please confirm your password to continue.",
+		}
+		app.putFlash(r, f)
+		http.Redirect(w, r, "/auth/reauth", http.StatusSeeOther)
+	})
+}
+
+func (app *application) handleAuthReauthGet(w http.ResponseWriter, r *http.Request) error {
+	return app.render(w, r, http.StatusOK, "reauth.tmpl", nil)
+}
+
+func (app *application) handleAuthReauthPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	var form struct {
+		Password string `form:"password" validate:"required"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.User.GetWithID(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	// Throttled like logins, or a stolen session could guess the password
+	until, err := app.loginBlockedUntil(r, user.Username)
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		app.securityEvent(r, "login_throttled",
+			slog.String("username", user.Username),
+			slog.Time("until", until))
+
+		return FormErrors{"Password": "Too many failed attempts. Try again " + retryIn(time.Until(until)) + "."}
+	}
+
+	err = app.checkPassword(r.Context(), user, form.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCredentials):
+			_, err := app.recordLoginFailure(r, user.Username)
+			if err != nil {
+				return err
+			}
+
+			return FormErrors{"Password": "incorrect password"}
+		default:
+			return app.passwordCheckFailed(r, err)
+		}
+	}
+
+	err = app.models.LoginThrottle.Reset(r.Context(), usernameThrottleKey(user.Username))
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), authTimeSessionKey, time.Now().Unix())
+	http.Redirect(w, r, app.popReturnPath(r, "/"), http.StatusSeeOther)
+
+	return nil
+}
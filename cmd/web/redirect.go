@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// Page to return to once the user has logged in
+const returnPathSessionKey = "returnPath"
+
+// Check that target is a page on this site and return its path and query.
+// Absolute URLs, as sent in the Referer header, are accepted for the host of
+// the request. Anything a browser could resolve to another origin, such as
+// "//host" or "/\host", is refused.
+func localPath(r *http.Request, target string) (string, bool) {
+	if target == "" || strings.ContainsRune(target, '\\') || strings.IndexFunc(target, unicode.IsControl) >= 0 {
+		return "", false
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Opaque != "" || u.User != nil {
+		return "", false
+	}
+
+	if u.Scheme != "" || u.Host != "" {
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host != r.Host {
+			return "", false
+		}
+	}
+
+	path := u.RequestURI()
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return "", false
+	}
+
+	return path, true
+}
+
+// The page the request came from, or fallback if it is missing or not on
+// this site.
+func refererPath(r *http.Request, fallback string) string {
+	path, ok := localPath(r, r.Header.Get("Referer"))
+	if !ok {
+		return fallback
+	}
+
+	return path
+}
+
+// Remember the page of the request, to return to it after logging in. For
+// requests that cannot be repeated, such as form submissions, that is the
+// page the form was on.
+func (app *application) saveReturnPath(r *http.Request) {
+	target := r.URL.RequestURI()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		target = r.Header.Get("Referer")
+	}
+
+	path, ok := localPath(r, target)
+	if !ok {
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), returnPathSessionKey, path)
+}
+
+// Pop the saved return path, or fallback if there is none.
+func (app *application) popReturnPath(r *http.Request, fallback string) string {
+	path, ok := localPath(r, app.sessionManager.PopString(r.Context(), returnPathSessionKey))
+	if !ok {
+		return fallback
+	}
+
+	return path
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   string
+		ok     bool
+	}{
+		{"path", "/account", "/account", true},
+		{"path with query", "/admin/users?q=al&page=2", "/admin/users?q=al&page=2", true},
+		{"same host", "http://example.com/account?tab=1", "/account?tab=1", true},
+		{"same host over https", "https://example.com/", "/", true},
+		{"escaped slashes in path", "/%2F%2Fevil.com", "/%2F%2Fevil.com", true},
+		{"empty", "", "", false},
+		{"relative path", "account", "", false},
+		{"dot relative path", "../account", "", false},
+		{"protocol relative", "//evil.com", "", false},
+		{"protocol relative with path", "//evil.com/account", "", false},
+		{"backslash", `/\evil.com`, "", false},
+		{"double backslash", `\\evil`, "", false},
+		{"other host", "https://evil", "", false},
+		{"other host with port", "http://example.com:8080/", "", false},
+		{"escaped slashes", "%2F%2Fevil", "", false},
+		{"javascript", "javascript:alert(1)", "", false},
+		{"data", "data:text/html,hi", "", false},
+		{"other scheme", "ftp://example.com/", "", false},
+		{"userinfo", "http://evil@example.com/", "", false},
+		{"tab", "/\t/evil.com", "", false},
+		{"newline", "/account\n", "", false},
+		{"triple slash", "///evil.com", "", false},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := localPath(r, tt.target)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRedirectToReferer(t *testing.T) {
+	app := newTestApplication(t)
+
+	handlers := map[string]http.Handler{
+		"form errors": app.handle(func(w http.ResponseWriter, r *http.Request) error {
+			return FormErrors{"username": "taken"}
+		}),
+		"refresh": http.HandlerFunc(app.refresh),
+	}
+
+	tests := []struct {
+		referer string
+		want    string
+	}{
+		{"http://example.com/admin/users?page=2", "/admin/users?page=2"},
+		{"/account", "/account"},
+		{"", "/"},
+		{"https://evil.com/account", "/"},
+		{"//evil.com", "/"},
+		{`/\evil.com`, "/"},
+		{"javascript:alert(1)", "/"},
+	}
+
+	for name, h := range handlers {
+		h = app.sessionManager.LoadAndSave(h)
+
+		for _, tt := range tests {
+			r := httptest.NewRequest(http.MethodPost, "http://example.com/form", nil)
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, r)
+
+			if rr.Code != http.StatusSeeOther {
+				t.Errorf("%s, referer %q: got status %d, want %d", name, tt.referer, rr.Code, http.StatusSeeOther)
+			}
+
+			if got := rr.Header().Get("Location"); got != tt.want {
+				t.Errorf("%s, referer %q: got location %q, want %q", name, tt.referer, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+const (
+	rememberCookieName = "remember_token"
+
+	// Token family the current session was logged in with, so that logging
+	// the session out also forgets the device
+	rememberFamilySessionKey = "rememberFamily"
+
+	// A rotated token presented again within this time is assumed to come
+	// from concurrent requests of the same browser rather than a thief
+	rememberReuseGrace = 10 * time.Second
+)
+
+func (app *application) setRememberCookie(w http.ResponseWriter, t *models.RememberToken) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookieName,
+		Value:    t.Plaintext,
+		Path:     "/",
+		Expires:  t.Expiry,
+		MaxAge:   int(time.Until(t.Expiry).Seconds()),
+		HttpOnly: true,
+		Secure:   app.config.session.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (app *application) clearRememberCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   app.config.session.cookieSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Keep the device logged in after the session expires. Must be called after
+// app.login, which renews the session token.
+func (app *application) rememberDevice(w http.ResponseWriter, r *http.Request, userID int) error {
+	t, err := app.models.RememberToken.New(r.Context(), userID, "", app.config.session.rememberLifetime)
+	if err != nil {
+		return err
+	}
+
+	app.setRememberCookie(w, t)
+	app.sessionManager.Put(r.Context(), rememberFamilySessionKey, t.Family)
+
+	return nil
+}
+
+// Forget the device the current session was logged in from.
+func (app *application) forgetDevice(w http.ResponseWriter, r *http.Request) error {
+	family := app.sessionManager.GetString(r.Context(), rememberFamilySessionKey)
+	if family != "" {
+		err := app.models.RememberToken.DeleteFamily(r.Context(), family)
+		if err != nil {
+			return err
+		}
+	}
+
+	app.sessionManager.Remove(r.Context(), rememberFamilySessionKey)
+	app.clearRememberCookie(w)
+
+	return nil
+}
+
+// Log in with the remember me cookie, if there is a valid one, and replace it
+// with a new token. Returns the ID of the user, zero if not logged in.
+//
+// A token that was already replaced must have been copied. The whole family
+// is then revoked, logging out both the thief and the owner.
+func (app *application) loginWithRememberToken(w http.ResponseWriter, r *http.Request) (int, error) {
+	cookie, err := r.Cookie(rememberCookieName)
+	if err != nil {
+		return 0, nil
+	}
+
+	selector, validator, ok := models.ParseRememberToken(cookie.Value)
+	if !ok {
+		app.clearRememberCookie(w)
+
+		return 0, nil
+	}
+
+	t, err := app.models.RememberToken.Get(r.Context(), selector)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clearRememberCookie(w)
+
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	if !t.Matches(validator) {
+		app.securityEvent(r, "remember_token_invalid", slog.Int("user_id", t.UserID))
+		app.clearRememberCookie(w)
+
+		return 0, nil
+	}
+
+	if t.Used() {
+		if time.Since(t.UsedAt) < rememberReuseGrace {
+			return 0, nil
+		}
+
+		err = app.models.RememberToken.DeleteFamily(r.Context(), t.Family)
+		if err != nil {
+			return 0, err
+		}
+
+		app.securityEvent(r, "remember_token_reused", slog.Int("user_id", t.UserID))
+		app.clearRememberCookie(w)
+
+		return 0, nil
+	}
+
+	var next *models.RememberToken
+	err = app.models.WithTx(r.Context(), func(m models.Models) error {
+		err := m.RememberToken.Use(r.Context(), t.Selector)
+		if err != nil {
+			return err
+		}
+
+		next, err = m.RememberToken.New(r.Context(), t.UserID, t.Family, app.config.session.rememberLifetime)
+
+		return err
+	})
+	if err != nil {
+		// Lost the race against a concurrent request with the same token
+		if errors.Is(err, models.ErrNoRecord) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	err = app.login(r, t.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	app.setRememberCookie(w, next)
+	app.sessionManager.Put(r.Context(), rememberFamilySessionKey, next.Family)
+	// The password was not entered, so sensitive actions still ask for it
+	app.sessionManager.Remove(r.Context(), authTimeSessionKey)
+
+	return t.UserID, nil
+}
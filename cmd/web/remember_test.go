@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+// Request the dashboard with only a remember me cookie, as a browser does
+// once its session has expired. Returns whether the request was logged in,
+// and the remember me cookie of the response, nil if it set none.
+func (ts *testServer) getRemembered(t *testing.T, token string) (bool, *http.Cookie) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: rememberCookieName, Value: token})
+
+	// Without the cookie jar of ts, so every request starts a new session
+	client := &http.Client{
+		Transport: ts.Client().Transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	for _, c := range res.Cookies() {
+		if c.Name == rememberCookieName {
+			return res.StatusCode == http.StatusOK, c
+		}
+	}
+
+	return res.StatusCode == http.StatusOK, nil
+}
+
+func newTestRememberToken(t *testing.T, app *application, userID int) string {
+	t.Helper()
+
+	token, err := app.models.RememberToken.New(context.Background(), userID, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token.Plaintext
+}
+
+// Whether the token of the plaintext is still stored
+func rememberTokenExists(t *testing.T, app *application, plaintext string) bool {
+	t.Helper()
+
+	selector, _, ok := models.ParseRememberToken(plaintext)
+	if !ok {
+		t.Fatalf("invalid remember token %q", plaintext)
+	}
+
+	_, err := app.models.RememberToken.Get(context.Background(), selector)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		return false
+	case err != nil:
+		t.Fatal(err)
+	}
+
+	return true
+}
+
+func TestRememberTokenRotation(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	user, err := app.models.User.New(context.Background(), "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := newTestRememberToken(t, app, user.ID)
+
+	for i := range 3 {
+		ok, cookie := ts.getRemembered(t, token)
+		if !ok {
+			t.Fatalf("rotation %d: not logged in", i)
+		}
+
+		if cookie == nil || cookie.Value == "" || cookie.Value == token {
+			t.Fatalf("rotation %d: got cookie %v, want a new token", i, cookie)
+		}
+
+		token = cookie.Value
+	}
+
+	ok, _ := ts.getRemembered(t, "not-a-token")
+	if ok {
+		t.Error("malformed token: logged in")
+	}
+
+	selector, _, _ := models.ParseRememberToken(token)
+	ok, _ = ts.getRemembered(t, selector+".wrongvalidator")
+	if ok {
+		t.Error("wrong validator: logged in")
+	}
+
+	// A wrong guess does not revoke the real token
+	if ok, _ := ts.getRemembered(t, token); !ok {
+		t.Error("after wrong validator: not logged in")
+	}
+}
+
+func TestRememberTokenReuse(t *testing.T) {
+	app, db := newTestApplicationDB(t)
+	ts := newTestServer(t, app.routes())
+
+	user, err := app.models.User.New(context.Background(), "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stolen := newTestRememberToken(t, app, user.ID)
+	other := newTestRememberToken(t, app, user.ID)
+
+	ok, cookie := ts.getRemembered(t, stolen)
+	if !ok || cookie == nil {
+		t.Fatal("not logged in")
+	}
+	rotated := cookie.Value
+
+	t.Run("within grace period", func(t *testing.T) {
+		// A concurrent request of the same browser
+		ok, cookie := ts.getRemembered(t, stolen)
+		if ok {
+			t.Error("logged in with a used token")
+		}
+
+		if cookie != nil {
+			t.Errorf("got cookie %v, want the cookie left alone", cookie)
+		}
+
+		if !rememberTokenExists(t, app, rotated) {
+			t.Error("family revoked within the grace period")
+		}
+	})
+
+	t.Run("after grace period", func(t *testing.T) {
+		_, err := db.Exec("UPDATE RememberToken SET used_at = ? WHERE used_at IS NOT NULL;",
+			time.Now().UTC().Add(-rememberReuseGrace-time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ok, cookie := ts.getRemembered(t, stolen)
+		if ok {
+			t.Error("logged in with a reused token")
+		}
+
+		if cookie == nil || cookie.MaxAge >= 0 {
+			t.Errorf("got cookie %v, want it cleared", cookie)
+		}
+
+		// The thief or the owner, whoever holds the rotated token, is
+		// logged out too
+		if ok, _ := ts.getRemembered(t, rotated); ok {
+			t.Error("logged in with the rotated token of a revoked family")
+		}
+
+		// Other devices keep their tokens
+		if !rememberTokenExists(t, app, other) {
+			t.Error("token of another family revoked")
+		}
+	})
+}
+
+func TestRememberTokenRevoked(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("on logout", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+
+		user, err := app.models.User.New(ctx, "alice", "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other := newTestRememberToken(t, app, user.ID)
+
+		res := ts.postForm(t, "/auth/login", "/auth/login", url.Values{
+			"username": {"alice"},
+			"password": {"password123"},
+			"remember": {"true"},
+		})
+		if res.status != http.StatusSeeOther || res.location != "/" {
+			t.Fatalf("login: got %+v, want redirect to /", res)
+		}
+
+		u, err := url.Parse(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var token string
+		for _, c := range ts.Client().Jar.Cookies(u) {
+			if c.Name == rememberCookieName {
+				token = c.Value
+			}
+		}
+		if token == "" {
+			t.Fatal("login set no remember me cookie")
+		}
+
+		res = ts.postForm(t, "/", "/auth/logout", url.Values{})
+		if res.status != http.StatusSeeOther {
+			t.Fatalf("logout: got %+v, want redirect", res)
+		}
+
+		if ok, _ := ts.getRemembered(t, token); ok {
+			t.Error("logged in with the token of a logged out session")
+		}
+
+		// Logging out forgets this device only
+		if ok, _ := ts.getRemembered(t, other); !ok {
+			t.Error("other device: not logged in")
+		}
+	})
+
+	t.Run("on password change", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+
+		user, err := app.models.User.New(ctx, "alice", "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token := newTestRememberToken(t, app, user.ID)
+
+		err = app.setUserPassword(ctx, user, "newpassword1", user.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok, _ := ts.getRemembered(t, token); ok {
+			t.Error("logged in with a token issued before the password change")
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+func (app *application) handleAuthResetGet(w http.ResponseWriter, r *http.Request) error {
+	return app.render(w, r, http.StatusOK, "reset.tmpl", nil)
+}
+
+func (app *application) handleAuthResetPost(w http.ResponseWriter, r *http.Request) error {
+	var form struct {
+		Username string `form:"username" validate:"required,max=254"`
+	}
+
+	err := app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	until, err := app.recordPasswordReset(r, form.Username)
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		f := FlashMessage{
+			Type:    FlashError,
+			Message: "Too many password reset requests. Try again " + retryIn(time.Until(until)) + ".",
+		}
+		app.putFlash(r, f)
+		http.Redirect(w, r, "/auth/reset", http.StatusSeeOther)
+
+		return nil
+	}
+
+	err = app.requestPasswordReset(r, form.Username)
+	if err != nil {
+		return err
+	}
+
+	// Respond the same whether or not the account exists so the form
+	// cannot be used to discover usernames.
+	f := FlashMessage{
+		Type:    FlashInfo,
+		Message: "If an account with that username exists, a password reset link has been sent.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/auth/reset", http.StatusSeeOther)
+
+	return nil
+}
+
+// Email a password reset link to the user, if there is one. Shared by the
+// reset form and the API.
+func (app *application) requestPasswordReset(r *http.Request, username string) error {
+	user, err := app.models.User.GetWithUsername(r.Context(), username)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return nil
+		}
+
+		return err
+	}
+
+	to := resetEmailAddress(user)
+	if to == "" {
+		app.requestLogger(r).Warn("password reset for account without email address",
+			slog.Int("user_id", user.ID))
+
+		return nil
+	}
+
+	// Only the most recently requested link is valid
+	var token *models.Token
+	err = app.models.WithTx(r.Context(), func(m models.Models) error {
+		err := m.Token.DeleteAllForUser(r.Context(), models.ScopePasswordReset, user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err = m.Token.New(r.Context(), user.ID, app.config.resetTokenTTL, models.ScopePasswordReset)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	data := map[string]any{
+		"Username": user.Username,
+		"URL":      app.config.baseURL + "/auth/reset/confirm?token=" + url.QueryEscape(token.Plaintext),
+		"Expiry":   app.config.resetTokenTTL.String(),
+	}
+
+	logger := app.requestLogger(r)
+	app.background(func(ctx context.Context) {
+		err := app.mailer.Send(to, "password_reset.tmpl", data)
+		if err != nil {
+			logger.Error("send password reset email", slog.Any("err", err))
+		}
+	})
+
+	return nil
+}
+
+// Address to send a user's password reset link to. Accounts without an email
+// address, such as those created before addresses were collected, get it at
+// their username if that is an address. Empty if there is nowhere to send it.
+func resetEmailAddress(user *models.User) string {
+	if user.Email != "" {
+		return user.Email
+	}
+
+	addr, err := mail.ParseAddress(user.Username)
+	if err != nil || addr.Address != user.Username {
+		return ""
+	}
+
+	return user.Username
+}
+
+func (app *application) handleAuthResetConfirmGet(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		Token string
+	}
+
+	data.Token = r.URL.Query().Get("token")
+
+	return app.render(w, r, http.StatusOK, "reset-confirm.tmpl", data)
+}
+
+func (app *application) handleAuthResetConfirmPost(w http.ResponseWriter, r *http.Request) error {
+	var form struct {
+		Token    string `form:"token" validate:"required"`
+		Password string `form:"password" validate:"required,min=8,max=72"`
+	}
+
+	err := app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.User.GetForToken(r.Context(), models.ScopePasswordReset, form.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return FormErrors{"Token": "invalid or expired password reset link"}
+		}
+
+		return err
+	}
+
+	err = app.models.User.SetPassword(user, form.Password)
+	if err != nil {
+		return err
+	}
+
+	// Tokens are single-use, so consume it together with the update
+	err = app.models.WithTx(r.Context(), func(m models.Models) error {
+		err := m.User.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		return m.Token.DeleteAllForUser(r.Context(), models.ScopePasswordReset, user.ID)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrEditConflict) {
+			return FormErrors{"Version": editConflictMessage}
+		}
+
+		return err
+	}
+
+	// Sign the user out everywhere, including the current request.
+	err = app.revokeSessions(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.logout(w, r)
+	if err != nil {
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Your password has been reset. Please log in.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+
+	return nil
+}
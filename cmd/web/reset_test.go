@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+func TestResetEmailAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		user models.User
+		want string
+	}{
+		{"email", models.User{Username: "alice", Email: "alice@example.com"}, "alice@example.com"},
+		{"email over address username", models.User{Username: "old@example.com", Email: "new@example.com"}, "new@example.com"},
+		{"address username", models.User{Username: "alice@example.com"}, "alice@example.com"},
+		{"plain username", models.User{Username: "alice"}, ""},
+		{"named address username", models.User{Username: "Alice <alice@example.com>"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resetEmailAddress(&tt.user); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -21,10 +21,10 @@ func (app *application) handle(h withError) http.HandlerFunc {
 			case errors.As(err, &formErrors):
 				// Redirect to referer with form errors as session data
 				app.putFormErrors(r, formErrors)
-				http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther)
+				http.Redirect(w, r, refererPath(r, "/"), http.StatusSeeOther)
 			default:
 				// Log unexpected error and return internal server error
-				app.logger.Error("handled unexpected error", slog.Any("err", err), slog.String("type", fmt.Sprintf("%T", err)))
+				app.requestLogger(r).Error("handled unexpected error", slog.Any("err", err), slog.String("type", fmt.Sprintf("%T", err)))
 
 				http.Error(w,
 					http.StatusText(http.StatusInternalServerError),
@@ -36,8 +36,9 @@ func (app *application) handle(h withError) http.HandlerFunc {
 }
 
 // App router
-func (app *application) routes() http.Handler {
+func (app *application) routes() *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(app.logRequest)
 	r.Use(app.recovery)
 	r.Use(secureHeaders)
 
@@ -45,6 +46,45 @@ func (app *application) routes() http.Handler {
 	r.Handle("/static/*", app.handleStatic())
 	r.Get("/favicon.ico", app.handleFavicon)
 
+	// Scripts authenticate with a bearer token instead of a session, so the
+	// API loads no session and needs no CSRF token
+	r.Route("/api", func(r chi.Router) {
+		r.NotFound(app.handleAPINotFound)
+		r.MethodNotAllowed(app.handleAPIMethodNotAllowed)
+
+		r.Get("/openapi.json", app.handleAPISpec)
+		r.Get("/docs", app.handleAPIDocs)
+
+		r.Route("/v1", func(r chi.Router) {
+			r.Post("/auth/signup", app.handleAPI(app.handleAPIAuthSignupPost))
+			r.Post("/auth/reset", app.handleAPI(app.handleAPIAuthResetPost))
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.authenticateToken)
+
+				r.Get("/user", app.handleAPI(app.handleAPIUserGet))
+				r.Get("/user/tokens", app.handleAPI(app.handleAPIUserTokensGet))
+				r.Delete("/user/tokens/{id}", app.handleAPI(app.handleAPIUserTokenDelete))
+
+				// Unlike the admin console, these ask for no recent password:
+				// a token can only be created right after reauthenticating,
+				// and holding it stands in for one until it is revoked
+				r.Group(func(r chi.Router) {
+					r.Use(app.requireTokenPermission("admin"))
+
+					r.Get("/users", app.handleAPI(app.handleAPIUsersGet))
+					r.Post("/users", app.handleAPI(app.handleAPIUsersPost))
+					r.Get("/users/{id}", app.handleAPI(app.handleAPIUserDetailGet))
+					r.Delete("/users/{id}", app.handleAPI(app.handleAPIUserDelete))
+					r.Put("/users/{id}/password", app.handleAPI(app.handleAPIUserPasswordPut))
+					r.Put("/users/{id}/permissions/{permission}", app.handleAPI(app.handleAPIUserPermissionPut))
+					r.Delete("/users/{id}/permissions/{permission}", app.handleAPI(app.handleAPIUserPermissionDelete))
+					r.Get("/permissions", app.handleAPI(app.handleAPIPermissionsGet))
+				})
+			})
+		})
+	})
+
 	r.Route("/", func(r chi.Router) {
 		r.Use(app.sessionManager.LoadAndSave)
 		r.Use(app.noSurf)
@@ -55,6 +95,62 @@ func (app *application) routes() http.Handler {
 			r.Post("/login", app.handle(app.handleAuthLoginPost))
 			r.Post("/logout", app.handle(app.handleAuthLogoutPost))
 			r.Post("/signup", app.handle(app.handleAuthSignupPost))
+			r.Get("/reset", app.handle(app.handleAuthResetGet))
+			r.Post("/reset", app.handle(app.handleAuthResetPost))
+			r.Get("/reset/confirm", app.handle(app.handleAuthResetConfirmGet))
+			r.Post("/reset/confirm", app.handle(app.handleAuthResetConfirmPost))
+			r.Get("/verify", app.handle(app.handleAuthVerifyGet))
+			r.Post("/verify", app.handle(app.handleAuthVerifyPost))
+			r.Get("/2fa", app.handle(app.handleAuthTwoFactorGet))
+			r.Post("/2fa", app.handle(app.handleAuthTwoFactorPost))
+			r.With(app.requireAuthentication).Get("/reauth", app.handle(app.handleAuthReauthGet))
+			r.With(app.requireAuthentication).Post("/reauth", app.handle(app.handleAuthReauthPost))
+			r.Post("/passkey/options", app.handle(app.handleAuthPasskeyOptionsPost))
+			r.Post("/passkey", app.handle(app.handleAuthPasskeyPost))
+			r.Get("/oidc", app.handle(app.handleAuthOIDCGet))
+			r.Get("/oidc/callback", app.handle(app.handleAuthOIDCCallbackGet))
+		})
+
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(app.requireAuthentication)
+			r.Use(app.requirePermission("admin"))
+
+			r.Get("/users", app.handle(app.handleAdminUsersGet))
+			r.Post("/users", app.handle(app.handleAdminUsersPost))
+			r.Get("/users/{id}", app.handle(app.handleAdminUserGet))
+			r.With(app.requireReauthentication).Post("/users/{id}/password", app.handle(app.handleAdminUserPasswordPost))
+			r.Post("/users/{id}/unlock", app.handle(app.handleAdminUserUnlockPost))
+			r.Post("/users/{id}/sessions/revoke", app.handle(app.handleAdminUserSessionsRevokePost))
+			r.With(app.requireReauthentication).Post("/users/{id}/permissions/grant", app.handle(app.handleAdminUserGrantPost))
+			r.With(app.requireReauthentication).Post("/users/{id}/permissions/revoke", app.handle(app.handleAdminUserRevokePost))
+			r.With(app.requireReauthentication).Post("/users/{id}/delete", app.handle(app.handleAdminUserDeletePost))
+			r.Get("/permissions", app.handle(app.handleAdminPermissionsGet))
+			r.With(app.requireReauthentication).Post("/permissions/two-factor", app.handle(app.handleAdminPermissionsTwoFactorPost))
+		})
+
+		r.Route("/account", func(r chi.Router) {
+			r.Use(app.requireAuthentication)
+
+			r.Post("/verify/resend", app.handle(app.handleAccountVerifyResendPost))
+			r.Get("/2fa", app.handle(app.handleAccountTwoFactorGet))
+			r.Post("/2fa/enroll", app.handle(app.handleAccountTwoFactorEnrollPost))
+			r.Post("/2fa/confirm", app.handle(app.handleAccountTwoFactorConfirmPost))
+			r.With(app.requireReauthentication).Post("/2fa/recovery-codes", app.handle(app.handleAccountTwoFactorRecoveryCodesPost))
+			r.With(app.requireReauthentication).Post("/2fa/disable", app.handle(app.handleAccountTwoFactorDisablePost))
+			r.Get("/passkeys", app.handle(app.handleAccountPasskeysGet))
+			r.Post("/passkeys", app.handle(app.handleAccountPasskeysPost))
+			r.Post("/passkeys/options", app.handle(app.handleAccountPasskeysOptionsPost))
+			r.Post("/passkeys/{id}/rename", app.handle(app.handleAccountPasskeyRenamePost))
+			r.With(app.requireReauthentication).Post("/passkeys/{id}/delete", app.handle(app.handleAccountPasskeyDeletePost))
+			r.Get("/identities", app.handle(app.handleAccountIdentitiesGet))
+			r.With(app.requireReauthentication).Post("/identities/link", app.handle(app.handleAccountIdentitiesLinkPost))
+			r.With(app.requireReauthentication).Post("/identities/{id}/delete", app.handle(app.handleAccountIdentityDeletePost))
+			r.Get("/tokens", app.handle(app.handleAccountTokensGet))
+			r.With(app.requireReauthentication).Post("/tokens", app.handle(app.handleAccountTokensPost))
+			r.Post("/tokens/{id}/delete", app.handle(app.handleAccountTokenDeletePost))
+			r.Get("/sessions", app.handle(app.handleAccountSessionsGet))
+			r.Post("/sessions/{id}/revoke", app.handle(app.handleAccountSessionRevokePost))
+			r.Post("/sessions/revoke-others", app.handle(app.handleAccountSessionsRevokeOthersPost))
 		})
 
 		r.Route("/", func(r chi.Router) {
@@ -68,7 +164,7 @@ func (app *application) routes() http.Handler {
 }
 
 func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, r.Header.Get("Referer"), http.StatusSeeOther)
+	http.Redirect(w, r, refererPath(r, "/"), http.StatusSeeOther)
 }
 
 func (app *application) handleStatic() http.Handler {
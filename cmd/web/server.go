@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Serve until SIGINT or SIGTERM, then stop accepting connections, drain
+// in-flight requests and wait for background tasks. Both phases share the
+// configured shutdown timeout.
+func (app *application) serve(errLog *log.Logger) error {
+	routes := app.routes()
+
+	var err error
+	app.apiSpec, err = newAPISpec()
+	if err != nil {
+		return fmt.Errorf("api spec: %w", err)
+	}
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      routes,
+		ErrorLog:     errLog,
+		ReadTimeout:  app.config.server.readTimeout,
+		WriteTimeout: app.config.server.writeTimeout,
+		IdleTimeout:  app.config.server.idleTimeout,
+	}
+
+	shutdownErr := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Info("shutting down server", slog.String("signal", s.String()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+
+		app.logger.Info("completing background tasks")
+
+		// Background tasks use the database, which main closes as soon as
+		// serve returns, so drain them even if requests are still running
+		shutdownErr <- errors.Join(err, app.drainBackground(ctx))
+	}()
+
+	app.logger.Info("starting server", slog.String("addr", srv.Addr))
+
+	err = srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		ctx, cancel := context.WithTimeout(context.Background(), app.config.shutdownTimeout)
+		defer cancel()
+
+		return errors.Join(err, app.drainBackground(ctx))
+	}
+
+	err = <-shutdownErr
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("stopped server", slog.String("addr", srv.Addr))
+
+	return nil
+}
+
+// Tell long-running background tasks to stop and wait for every task to
+// return, or for ctx to be done.
+func (app *application) drainBackground(ctx context.Context) error {
+	app.stopBackground()
+
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background tasks: %w", ctx.Err())
+	}
+}
+
+// Run fn in a goroutine that shutdown waits for. The context is cancelled
+// when shutdown begins so long-running workers can return; one-off tasks may
+// ignore it and finish their work.
+func (app *application) background(fn func(ctx context.Context)) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.Error("recovered from background panic", slog.Any("err", err))
+			}
+		}()
+
+		fn(app.backgroundCtx)
+	}()
+}
+
+// Run fn every interval until shutdown.
+func (app *application) backgroundTicker(interval time.Duration, fn func(ctx context.Context)) {
+	app.background(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(ctx)
+			}
+		}
+	})
+}
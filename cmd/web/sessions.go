@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/micahco/web-lite/internal/models"
+)
+
+// How often the last seen time of a session is written
+const sessionTouchInterval = time.Minute
+
+// Hash of the current session token, nil for sessions not yet committed
+func (app *application) sessionTokenHash(ctx context.Context) []byte {
+	token := app.sessionManager.Token(ctx)
+	if token == "" {
+		return nil
+	}
+
+	return models.HashSessionToken(token)
+}
+
+// Record the authenticated session in the session index.
+func (app *application) trackSession(r *http.Request, userID int, expiry time.Time) error {
+	hash := app.sessionTokenHash(r.Context())
+	if hash == nil {
+		return nil
+	}
+
+	s := &models.UserSession{
+		UserID:    userID,
+		TokenHash: hash,
+		Expiry:    expiry,
+		IP:        app.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	return app.models.UserSession.Touch(r.Context(), s, sessionTouchInterval)
+}
+
+// Session store that keys sessions by the hash of their token, the hash the
+// session index keeps. Indexed sessions can then be found without scanning
+// the store, and the store holds no tokens a reader could log in with.
+type hashedSessionStore struct {
+	store scs.Store
+}
+
+func (s hashedSessionStore) key(hash []byte) string {
+	return hex.EncodeToString(hash)
+}
+
+func (s hashedSessionStore) Find(token string) ([]byte, bool, error) {
+	return s.findHash(models.HashSessionToken(token))
+}
+
+func (s hashedSessionStore) Commit(token string, b []byte, expiry time.Time) error {
+	return s.store.Commit(s.key(models.HashSessionToken(token)), b, expiry)
+}
+
+func (s hashedSessionStore) Delete(token string) error {
+	return s.deleteHash(models.HashSessionToken(token))
+}
+
+func (s hashedSessionStore) findHash(hash []byte) ([]byte, bool, error) {
+	return s.store.Find(s.key(hash))
+}
+
+func (s hashedSessionStore) deleteHash(hash []byte) error {
+	return s.store.Delete(s.key(hash))
+}
+
+// Destroy the stored sessions with the token hashes, forget the devices they
+// were logged in from and remove them from the session index. The session of
+// the current request is held in memory and must be handled by the caller.
+func (app *application) destroySessions(ctx context.Context, hashes ...[]byte) error {
+	for _, hash := range hashes {
+		b, found, err := app.sessionStore.findHash(hash)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			_, values, err := app.sessionManager.Codec.Decode(b)
+			if err != nil {
+				return err
+			}
+
+			// Devices could otherwise log back in without a session
+			family, _ := values[rememberFamilySessionKey].(string)
+			if family != "" {
+				err = app.models.RememberToken.DeleteFamily(ctx, family)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = app.sessionStore.deleteHash(hash)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = app.models.UserSession.Delete(ctx, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (app *application) handleAccountSessionsGet(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := app.models.UserSession.GetAllForUser(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	type session struct {
+		*models.UserSession
+		Current bool
+	}
+
+	var data struct {
+		Sessions []session
+	}
+
+	current := app.sessionTokenHash(r.Context())
+	for _, s := range sessions {
+		data.Sessions = append(data.Sessions, session{s, bytes.Equal(s.TokenHash, current)})
+	}
+
+	return app.render(w, r, http.StatusOK, "account-sessions.tmpl", data)
+}
+
+// Log out a single device
+func (app *application) handleAccountSessionRevokePost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(r)
+	if err != nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	s, err := app.models.UserSession.GetForUser(r.Context(), id, suid)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		}
+
+		return err
+	}
+
+	if bytes.Equal(s.TokenHash, app.sessionTokenHash(r.Context())) {
+		err = app.logout(w, r)
+		if err != nil {
+			return err
+		}
+
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+
+		return nil
+	}
+
+	err = app.destroySessions(r.Context(), s.TokenHash)
+	if err != nil {
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Logged out the device.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+
+	return nil
+}
+
+// Log out every device except this one
+func (app *application) handleAccountSessionsRevokeOthersPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	hashes, err := app.models.UserSession.GetTokenHashesForUser(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	current := app.sessionTokenHash(r.Context())
+	hashes = slices.DeleteFunc(hashes, func(hash []byte) bool {
+		return bytes.Equal(hash, current)
+	})
+
+	err = app.destroySessions(r.Context(), hashes...)
+	if err != nil {
+		return err
+	}
+
+	// Including devices whose session already expired
+	family := app.sessionManager.GetString(r.Context(), rememberFamilySessionKey)
+	err = app.models.RememberToken.DeleteAllForUserExcept(r.Context(), suid, family)
+	if err != nil {
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Logged out all other devices.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+
+	return nil
+}
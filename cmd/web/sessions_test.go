@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+// Issue an API access token to the user, with the given permissions.
+func newTestAccessToken(t *testing.T, app *application, userID int, codes ...string) *models.AccessToken {
+	t.Helper()
+
+	var token *models.AccessToken
+	err := app.models.WithTx(context.Background(), func(m models.Models) error {
+		var err error
+		token, err = m.AccessToken.New(context.Background(), userID, "script", time.Hour, codes)
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestPasswordChangeRevokesAccessTokens(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("set by an admin", func(t *testing.T) {
+		app := newTestApplication(t)
+
+		user, err := app.models.User.New(ctx, "alice", "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token := newTestAccessToken(t, app, user.ID)
+
+		err = app.setUserPassword(ctx, user, "newpassword1", user.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = app.models.AccessToken.GetForPlaintext(ctx, token.Plaintext)
+		if !errors.Is(err, models.ErrNoRecord) {
+			t.Errorf("got %v, want %v", err, models.ErrNoRecord)
+		}
+	})
+
+	t.Run("reset by the user", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+
+		user, err := app.models.User.New(ctx, "alice", "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token := newTestAccessToken(t, app, user.ID)
+
+		other, err := app.models.User.New(ctx, "bob", "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		otherToken := newTestAccessToken(t, app, other.ID)
+
+		reset, err := app.models.Token.New(ctx, user.ID, time.Hour, models.ScopePasswordReset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		page := "/auth/reset/confirm?token=" + url.QueryEscape(reset.Plaintext)
+		res := ts.postForm(t, page, "/auth/reset/confirm", url.Values{
+			"token":    {reset.Plaintext},
+			"password": {"newpassword1"},
+		})
+
+		if res.status != http.StatusSeeOther || res.location != "/auth/login" {
+			t.Fatalf("got %+v, want redirect to /auth/login", res)
+		}
+
+		_, err = app.models.AccessToken.GetForPlaintext(ctx, token.Plaintext)
+		if !errors.Is(err, models.ErrNoRecord) {
+			t.Errorf("got %v, want %v", err, models.ErrNoRecord)
+		}
+
+		// Tokens of other users are left alone
+		_, err = app.models.AccessToken.GetForPlaintext(ctx, otherToken.Plaintext)
+		if err != nil {
+			t.Errorf("other user: got %v, want nil", err)
+		}
+	})
+}
+
+// Log in as the user on ts, as a device of its own
+func loginTestServer(t *testing.T, ts *testServer, username string) {
+	t.Helper()
+
+	res := ts.postForm(t, "/auth/login", "/auth/login", url.Values{
+		"username": {username},
+		"password": {"password123"},
+	})
+	if res.status != http.StatusSeeOther || res.location != "/" {
+		t.Fatalf("login: got %+v, want redirect to /", res)
+	}
+}
+
+func loggedIn(t *testing.T, ts *testServer) bool {
+	t.Helper()
+
+	return ts.get(t, "/").status == http.StatusOK
+}
+
+func TestDestroySessions(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("other devices", func(t *testing.T) {
+		app := newTestApplication(t)
+
+		for _, username := range []string{"alice", "bob"} {
+			_, err := app.models.User.New(ctx, username, "password123")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		current := newTestServer(t, app.routes())
+		other := newTestServer(t, app.routes())
+		bob := newTestServer(t, app.routes())
+
+		loginTestServer(t, current, "alice")
+		loginTestServer(t, other, "alice")
+		loginTestServer(t, bob, "bob")
+
+		res := current.postForm(t, "/account/sessions", "/account/sessions/revoke-others", url.Values{})
+		if res.status != http.StatusSeeOther || res.location != "/account/sessions" {
+			t.Fatalf("got %+v, want redirect to /account/sessions", res)
+		}
+
+		if !loggedIn(t, current) {
+			t.Error("current device: logged out")
+		}
+
+		if loggedIn(t, other) {
+			t.Error("other device: still logged in")
+		}
+
+		if !loggedIn(t, bob) {
+			t.Error("other user: logged out")
+		}
+	})
+
+	t.Run("single device", func(t *testing.T) {
+		app := newTestApplication(t)
+
+		user, err := app.models.User.New(ctx, "alice", "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		current := newTestServer(t, app.routes())
+		other := newTestServer(t, app.routes())
+		kept := newTestServer(t, app.routes())
+
+		loginTestServer(t, current, "alice")
+		loginTestServer(t, kept, "alice")
+
+		before, err := app.models.UserSession.GetAllForUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loginTestServer(t, other, "alice")
+
+		sessions, err := app.models.UserSession.GetAllForUser(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var id int
+		for _, s := range sessions {
+			if !slices.ContainsFunc(before, func(b *models.UserSession) bool { return b.ID == s.ID }) {
+				id = s.ID
+			}
+		}
+
+		path := fmt.Sprintf("/account/sessions/%d/revoke", id)
+		res := current.postForm(t, "/account/sessions", path, url.Values{})
+		if res.status != http.StatusSeeOther || res.location != "/account/sessions" {
+			t.Fatalf("got %+v, want redirect to /account/sessions", res)
+		}
+
+		if loggedIn(t, other) {
+			t.Error("revoked device: still logged in")
+		}
+
+		if !loggedIn(t, current) || !loggedIn(t, kept) {
+			t.Error("other devices: logged out")
+		}
+
+		_, err = app.models.UserSession.GetForUser(ctx, id, user.ID)
+		if !errors.Is(err, models.ErrNoRecord) {
+			t.Errorf("index entry: got %v, want %v", err, models.ErrNoRecord)
+		}
+	})
+
+	t.Run("without a request since logging in", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+
+		user, err := app.models.User.New(ctx, "alice", "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the login itself, so the session was indexed there
+		loginTestServer(t, ts, "alice")
+
+		err = app.setUserPassword(ctx, user, "newpassword1", user.Version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if loggedIn(t, ts) {
+			t.Error("still logged in after the password change")
+		}
+	})
+}
+
+func TestSessionStoreKeyedByHash(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	_, err := app.models.User.New(context.Background(), "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loginTestServer(t, ts, "alice")
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var token string
+	for _, c := range ts.Client().Jar.Cookies(u) {
+		if c.Name == app.sessionManager.Cookie.Name {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("no session cookie")
+	}
+
+	_, found, err := app.sessionStore.store.Find(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("session stored under its token")
+	}
+
+	_, found, err = app.sessionStore.findHash(models.HashSessionToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Error("session not stored under the hash of its token")
+	}
+}
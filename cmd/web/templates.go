@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/justinas/nosurf"
+	"github.com/micahco/web-lite/internal/models"
 	"github.com/micahco/web-lite/ui"
 )
 
@@ -19,6 +20,7 @@ type templateData struct {
 	Flash           *FlashMessage
 	FormErrors      FormErrors
 	IsAuthenticated bool
+	Permissions     models.Permissions
 	Data            any
 }
 
@@ -33,6 +35,19 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, statusCod
 		Data:            data,
 	}
 
+	// Let templates hide links the user cannot use
+	if td.IsAuthenticated {
+		suid, err := app.getSessionUserID(r)
+		if err != nil {
+			return err
+		}
+
+		td.Permissions, err = app.models.Permission.GetAllForUser(r.Context(), suid)
+		if err != nil {
+			return err
+		}
+	}
+
 	// In production, use template cache
 	if !app.config.dev {
 		return app.renderFromCache(w, statusCode, page, td)
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/go-playground/form/v4"
+	"github.com/go-playground/validator/v10"
+	"github.com/micahco/web-lite/internal/mailer"
+	"github.com/micahco/web-lite/internal/migrate"
+	"github.com/micahco/web-lite/internal/models"
+	"github.com/micahco/web-lite/migrations"
+)
+
+// Create an application backed by a migrated in-memory database. args are
+// command line flags applied on top of cheap password hashing and cookies
+// that work without TLS. Emails are logged to nowhere, never sent.
+func newTestApplication(t *testing.T, args ...string) *application {
+	t.Helper()
+
+	app, _ := newTestApplicationDB(t, args...)
+
+	return app
+}
+
+// Like newTestApplication, for tests that also change the database directly.
+func newTestApplicationDB(t *testing.T, args ...string) (*application, *sql.DB) {
+	t.Helper()
+
+	args = append([]string{
+		"-session-cookie-secure=false",
+		"-password-memory=64",
+		"-password-iterations=1",
+		"-password-parallelism=1",
+		"-smtp-host=mail.invalid",
+	}, args...)
+
+	cfg, _, err := loadConfig(args, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// Each connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+
+	mg, err := migrate.New(db, migrations.Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mg.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := models.New(db, cfg.passwordParams())
+
+	// Sessions are kept in memory
+	store := hashedSessionStore{memstore.New()}
+	sm := scs.New()
+	sm.Store = store
+	sm.Cookie.Secure = false
+	gob.Register(FlashMessage{})
+	gob.Register(FormErrors{})
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	t.Cleanup(stopBackground)
+
+	return &application{
+		config:         cfg,
+		logger:         logger,
+		mailer:         mailer.New(mailer.LogSender{Logger: logger}),
+		models:         m,
+		authenticator:  newAuthenticator(cfg, m, logger),
+		oidc:           newOIDCClient(cfg),
+		sessionManager: sm,
+		sessionStore:   store,
+		templateCache:  tc,
+		formDecoder:    form.NewDecoder(),
+		validate:       validator.New(),
+		backgroundCtx:  bgCtx,
+		stopBackground: stopBackground,
+	}, db
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+// Start a server for the handler with a client that keeps cookies and does
+// not follow redirects.
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	t.Helper()
+
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.Client().Jar = jar
+	ts.Client().CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	return &testServer{ts}
+}
+
+type testResponse struct {
+	status   int
+	location string
+	body     string
+}
+
+func (ts *testServer) do(t *testing.T, req *http.Request) testResponse {
+	t.Helper()
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testResponse{
+		status:   res.StatusCode,
+		location: res.Header.Get("Location"),
+		body:     string(bytes.TrimSpace(body)),
+	}
+}
+
+func (ts *testServer) get(t *testing.T, path string) testResponse {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ts.do(t, req)
+}
+
+// Submit a form with the CSRF token of the page it is on.
+func (ts *testServer) postForm(t *testing.T, page, path string, data url.Values) testResponse {
+	t.Helper()
+
+	data.Set("csrf_token", extractCSRFToken(t, ts.get(t, page).body))
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", ts.URL+page)
+
+	return ts.do(t, req)
+}
+
+var csrfTokenRX = regexp.MustCompile(`<input type="hidden" name="csrf_token" value="([^"]+)"`)
+
+func extractCSRFToken(t *testing.T, body string) string {
+	t.Helper()
+
+	matches := csrfTokenRX.FindStringSubmatch(body)
+	if len(matches) < 2 {
+		t.Fatal("no csrf token found in body")
+	}
+
+	return html.UnescapeString(matches[1])
+}
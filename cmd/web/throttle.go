@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// Failures allowed before attempts are delayed. An IP may be shared by
+	// many users behind NAT, so it is allowed more.
+	freeUsernameFailures = 3
+	freeIPFailures       = 10
+
+	// Failures are forgotten after a day without any
+	loginFailureWindow = 24 * time.Hour
+)
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func usernameThrottleKey(username string) string {
+	return "user:" + username
+}
+
+// Log a security relevant event, such as a failed or refused login.
+func (app *application) securityEvent(r *http.Request, event string, attrs ...any) {
+	attrs = append([]any{slog.String("event", event), slog.String("ip", app.clientIP(r))}, attrs...)
+
+	app.requestLogger(r).Warn("security event", attrs...)
+}
+
+// Delay imposed after the given number of failures, doubling with each
+// failure past the free ones.
+func (app *application) loginBackoff(failures, free int) time.Duration {
+	if failures <= free {
+		return 0
+	}
+
+	d := app.config.login.backoffBase << min(failures-free-1, 20)
+
+	return min(d, app.config.login.backoffMax)
+}
+
+// Time until which logins for the username, or from the client, are refused.
+// Zero if they are allowed.
+func (app *application) loginBlockedUntil(r *http.Request, username string) (time.Time, error) {
+	return app.models.LoginThrottle.BlockedUntil(r.Context(),
+		ipThrottleKey(app.clientIP(r)),
+		usernameThrottleKey(username))
+}
+
+// Count a failed login against the client and the username, blocking either
+// if needed. Failures are counted for unknown usernames too, so throttling
+// does not reveal which ones exist. Returns the time until which further
+// attempts are refused, zero if they are not.
+func (app *application) recordLoginFailure(r *http.Request, username string) (time.Time, error) {
+	now := time.Now()
+	var blockedUntil time.Time
+
+	ipKey := ipThrottleKey(app.clientIP(r))
+	ipFailures, err := app.models.LoginThrottle.RecordFailure(r.Context(), ipKey, loginFailureWindow)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if d := app.loginBackoff(ipFailures, freeIPFailures); d > 0 {
+		blockedUntil = now.Add(d)
+
+		err = app.models.LoginThrottle.Block(r.Context(), ipKey, blockedUntil)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	userKey := usernameThrottleKey(username)
+	userFailures, err := app.models.LoginThrottle.RecordFailure(r.Context(), userKey, loginFailureWindow)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	app.securityEvent(r, "login_failed",
+		slog.String("username", username),
+		slog.Int("username_failures", userFailures),
+		slog.Int("ip_failures", ipFailures))
+
+	d := app.loginBackoff(userFailures, freeUsernameFailures)
+	if userFailures >= app.config.login.maxFailures {
+		d = app.config.login.lockout
+
+		app.securityEvent(r, "account_locked",
+			slog.String("username", username),
+			slog.Duration("duration", d))
+	}
+
+	if d > 0 {
+		until := now.Add(d)
+		if until.After(blockedUntil) {
+			blockedUntil = until
+		}
+
+		err = app.models.LoginThrottle.Block(r.Context(), userKey, until)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return blockedUntil, nil
+}
+
+// Send the client back to the login form, explaining when to retry.
+func (app *application) refuseLogin(w http.ResponseWriter, r *http.Request, until time.Time) {
+	f := FlashMessage{
+		Type:    FlashError,
+		Message: "Too many failed login attempts. Try again " + retryIn(time.Until(until)) + ".",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+}
+
+func retryIn(d time.Duration) string {
+	switch {
+	case d <= time.Second:
+		return "now"
+	case d < time.Minute:
+		return fmt.Sprintf("in %d seconds", int(d.Round(time.Second).Seconds()))
+	}
+
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes == 1 {
+		return "in 1 minute"
+	}
+
+	return fmt.Sprintf("in %d minutes", minutes)
+}
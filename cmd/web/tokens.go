@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+// Plaintext of a token just created, shown once
+const newAccessTokenSessionKey = "newAccessToken"
+
+// Get the access token that authenticated an API request, set by
+// authenticateToken.
+func (app *application) accessToken(r *http.Request) *models.AccessToken {
+	t, ok := r.Context().Value(accessTokenContextKey).(*models.AccessToken)
+	if !ok {
+		panic("missing access token in request context")
+	}
+
+	return t
+}
+
+// Authenticate API requests with an "Authorization: Bearer" access token.
+// Unlike authenticate, no session is involved: the API is mounted outside of
+// LoadAndSave and noSurf, as a request carrying no cookies can not be forged
+// from another site.
+func (app *application) authenticateToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses belong to a single token holder
+		w.Header().Add("Cache-Control", "no-store")
+
+		scheme, plaintext, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		plaintext = strings.TrimSpace(plaintext)
+		if !strings.EqualFold(scheme, "Bearer") || plaintext == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			app.apiError(w, r, http.StatusUnauthorized, "missing bearer token")
+
+			return
+		}
+
+		t, err := app.models.AccessToken.GetForPlaintext(r.Context(), plaintext)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				app.securityEvent(r, "access_token_rejected")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+				app.apiError(w, r, http.StatusUnauthorized, "invalid or expired token")
+
+				return
+			}
+
+			app.requestLogger(r).Error("middleware authenticate token", slog.Any("err", err))
+			app.apiError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+
+			return
+		}
+
+		err = app.models.AccessToken.Use(r.Context(), t.ID, sessionTouchInterval)
+		if err != nil {
+			app.requestLogger(r).Error("middleware authenticate token", slog.Any("err", err))
+			app.apiError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+
+			return
+		}
+
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, isAuthenticatedContextKey, true)
+		ctx = context.WithValue(ctx, accessTokenContextKey, t)
+		r = r.WithContext(ctx)
+
+		app.setRequestUserID(r, t.UserID)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Only allow access tokens scoped to the named permission, held by a user
+// that may use it. Must be used after authenticateToken.
+func (app *application) requireTokenPermission(code string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := app.accessToken(r)
+
+			serverError := func(err error) {
+				app.requestLogger(r).Error("middleware require token permission", slog.Any("err", err))
+				app.apiError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			}
+
+			if !t.Permissions.Include(code) {
+				app.apiError(w, r, http.StatusForbidden, "token is missing permission: "+code)
+
+				return
+			}
+
+			user, err := app.models.User.GetWithID(r.Context(), t.UserID)
+			if err != nil {
+				serverError(err)
+
+				return
+			}
+
+			if user.Unverified() {
+				app.apiError(w, r, http.StatusForbidden, "verify your email address to use the "+code+" permission")
+
+				return
+			}
+
+			// Tokens are no way around two-factor authentication
+			enrolled, err := app.twoFactorSatisfied(r, t.UserID, code)
+			if err != nil {
+				serverError(err)
+
+				return
+			}
+
+			if !enrolled {
+				app.apiError(w, r, http.StatusForbidden, "set up two-factor authentication to use the "+code+" permission")
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (app *application) handleAccountTokensGet(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Tokens      []*models.AccessToken
+		Permissions models.Permissions
+		NewToken    string
+		Now         time.Time
+	}
+
+	data.Tokens, err = app.models.AccessToken.GetAllForUser(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	data.Permissions, err = app.models.Permission.GetAllForUser(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	// Only the hash is kept, so the plaintext can only ever be shown once
+	data.NewToken = app.sessionManager.PopString(r.Context(), newAccessTokenSessionKey)
+	data.Now = time.Now()
+
+	return app.render(w, r, http.StatusOK, "account-tokens.tmpl", data)
+}
+
+func (app *application) handleAccountTokensPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	var form struct {
+		Name        string   `form:"name" validate:"required,max=64"`
+		ExpiresIn   int      `form:"expires_in" validate:"required,oneof=7 30 90 365"`
+		Permissions []string `form:"permissions" validate:"dive,max=64"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range form.Permissions {
+		enrolled, err := app.twoFactorSatisfied(r, suid, code)
+		if err != nil {
+			return err
+		}
+
+		if !enrolled {
+			return FormErrors{"Permissions": "set up two-factor authentication to use the " + code + " permission"}
+		}
+	}
+
+	var t *models.AccessToken
+
+	err = app.models.WithTx(r.Context(), func(m models.Models) error {
+		var err error
+		t, err = m.AccessToken.New(r.Context(), suid, form.Name, time.Duration(form.ExpiresIn)*24*time.Hour, form.Permissions)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	app.securityEvent(r, "access_token_created",
+		slog.Int("token_id", t.ID),
+		slog.Any("permissions", t.Permissions))
+
+	app.sessionManager.Put(r.Context(), newAccessTokenSessionKey, t.Plaintext)
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Created " + t.Name + ". Copy the token now, it will not be shown again.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/tokens", http.StatusSeeOther)
+
+	return nil
+}
+
+func (app *application) handleAccountTokenDeletePost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := readIDParam(r)
+	if err != nil {
+		return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+
+	err = app.models.AccessToken.Delete(r.Context(), id, suid)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return app.renderError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		}
+
+		return err
+	}
+
+	app.securityEvent(r, "access_token_revoked", slog.Int("token_id", id))
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Revoked the token.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/tokens", http.StatusSeeOther)
+
+	return nil
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+	"github.com/micahco/web-lite/internal/totp"
+)
+
+const (
+	pendingTwoFactorUserIDSessionKey   = "pendingTwoFactorUserID"
+	pendingTwoFactorExpirySessionKey   = "pendingTwoFactorExpiry"
+	pendingTwoFactorAttemptsSessionKey = "pendingTwoFactorAttempts"
+	pendingTwoFactorRememberSessionKey = "pendingTwoFactorRemember"
+	recoveryCodesSessionKey            = "recoveryCodes"
+
+	// Time allowed between the password and the second factor
+	pendingTwoFactorTTL = 5 * time.Minute
+	// Invalid codes allowed before the password must be entered again
+	maxTwoFactorAttempts = 5
+)
+
+// Complete a password login, unless the user must enter a second factor
+// first.
+func (app *application) loginWithPassword(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) error {
+	pending, err := app.beginTwoFactor(w, r, user.ID, remember)
+	if err != nil {
+		return err
+	}
+
+	if pending {
+		return nil
+	}
+
+	return app.completeLogin(w, r, user, remember)
+}
+
+// Users enrolled in TOTP are left in a "first factor verified, two-factor
+// pending" state and sent to the second step; nobody is authenticated until
+// that step succeeds. Reports whether the user was sent there.
+func (app *application) beginTwoFactor(w http.ResponseWriter, r *http.Request, userID int, remember bool) (bool, error) {
+	enabled, err := app.models.TwoFactor.Enabled(r.Context(), userID)
+	if err != nil {
+		return false, err
+	}
+
+	if !enabled {
+		return false, nil
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		return false, err
+	}
+
+	expiry := time.Now().Add(pendingTwoFactorTTL).Unix()
+	app.sessionManager.Put(r.Context(), pendingTwoFactorUserIDSessionKey, userID)
+	app.sessionManager.Put(r.Context(), pendingTwoFactorExpirySessionKey, expiry)
+	app.sessionManager.Remove(r.Context(), pendingTwoFactorAttemptsSessionKey)
+	app.sessionManager.Put(r.Context(), pendingTwoFactorRememberSessionKey, remember)
+
+	http.Redirect(w, r, "/auth/2fa", http.StatusSeeOther)
+
+	return true, nil
+}
+
+// Authenticate a user whose every factor has been checked. Only now are the
+// failed attempts counted against their username forgiven.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) error {
+	err := app.login(r, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.LoginThrottle.Reset(r.Context(), usernameThrottleKey(user.Username))
+	if err != nil {
+		return err
+	}
+
+	if remember {
+		err = app.rememberDevice(w, r, user.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	redirect, err := app.afterLoginPath(r, user.ID)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+
+	return nil
+}
+
+// Where to send a user who just logged in: the page they were on when their
+// session expired, if any. Holders of sensitive permissions who have not
+// enrolled in TOTP must do so before anything else.
+func (app *application) afterLoginPath(r *http.Request, userID int) (string, error) {
+	required, err := app.models.Permission.RequiresTwoFactor(r.Context(), userID)
+	if err != nil {
+		return "", err
+	}
+
+	if required {
+		enabled, err := app.models.TwoFactor.Enabled(r.Context(), userID)
+		if err != nil {
+			return "", err
+		}
+
+		if !enabled {
+			f := FlashMessage{
+				Type:    FlashInfo,
+				Message: "Your permissions require two-factor authentication. Please set it up now.",
+			}
+			app.putFlash(r, f)
+
+			return "/account/2fa", nil
+		}
+	}
+
+	return app.popReturnPath(r, "/"), nil
+}
+
+func (app *application) clearPendingTwoFactor(r *http.Request) {
+	app.sessionManager.Remove(r.Context(), pendingTwoFactorUserIDSessionKey)
+	app.sessionManager.Remove(r.Context(), pendingTwoFactorExpirySessionKey)
+	app.sessionManager.Remove(r.Context(), pendingTwoFactorAttemptsSessionKey)
+	app.sessionManager.Remove(r.Context(), pendingTwoFactorRememberSessionKey)
+}
+
+// User waiting for the second login step, zero if none or expired
+func (app *application) pendingTwoFactorUserID(r *http.Request) int {
+	expiry := app.sessionManager.GetInt64(r.Context(), pendingTwoFactorExpirySessionKey)
+	if time.Now().Unix() > expiry {
+		return 0
+	}
+
+	return app.sessionManager.GetInt(r.Context(), pendingTwoFactorUserIDSessionKey)
+}
+
+// Check a TOTP code, or a recovery code, for the user. Accepted codes are
+// consumed and cannot be used again.
+func (app *application) verifySecondFactor(ctx context.Context, userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+
+	if strings.Contains(code, "-") {
+		err := app.models.TwoFactor.UseRecoveryCode(ctx, userID, code)
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	t, err := app.models.TwoFactor.Get(ctx, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if !t.Confirmed() {
+		return false, nil
+	}
+
+	counter, ok := totp.Validate(t.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	err = app.models.TwoFactor.UseCounter(ctx, userID, counter)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		// Replayed code
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (app *application) handleAuthTwoFactorGet(w http.ResponseWriter, r *http.Request) error {
+	if app.pendingTwoFactorUserID(r) == 0 {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+
+		return nil
+	}
+
+	return app.render(w, r, http.StatusOK, "two-factor.tmpl", nil)
+}
+
+func (app *application) handleAuthTwoFactorPost(w http.ResponseWriter, r *http.Request) error {
+	expired := func() error {
+		app.clearPendingTwoFactor(r)
+
+		f := FlashMessage{
+			Type:    FlashError,
+			Message: "Your login expired. Please try again.",
+		}
+		app.putFlash(r, f)
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+
+		return nil
+	}
+
+	userID := app.pendingTwoFactorUserID(r)
+	if userID == 0 {
+		return expired()
+	}
+
+	user, err := app.models.User.GetWithID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return expired()
+		}
+
+		return err
+	}
+
+	var form struct {
+		Code string `form:"code" validate:"required,max=32"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	// Codes are guessed against the same throttle as passwords, which a new
+	// session for each guess would otherwise escape
+	until, err := app.loginBlockedUntil(r, user.Username)
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		app.securityEvent(r, "login_throttled",
+			slog.String("username", user.Username),
+			slog.Time("until", until))
+		app.clearPendingTwoFactor(r)
+		app.refuseLogin(w, r, until)
+
+		return nil
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), userID, form.Code)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		until, err := app.recordLoginFailure(r, user.Username)
+		if err != nil {
+			return err
+		}
+
+		if !until.IsZero() {
+			app.clearPendingTwoFactor(r)
+			app.refuseLogin(w, r, until)
+
+			return nil
+		}
+
+		attempts := app.sessionManager.GetInt(r.Context(), pendingTwoFactorAttemptsSessionKey) + 1
+		if attempts >= maxTwoFactorAttempts {
+			app.clearPendingTwoFactor(r)
+
+			f := FlashMessage{
+				Type:    FlashError,
+				Message: "Too many invalid codes. Please log in again.",
+			}
+			app.putFlash(r, f)
+			http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+
+			return nil
+		}
+
+		app.sessionManager.Put(r.Context(), pendingTwoFactorAttemptsSessionKey, attempts)
+
+		return FormErrors{"Code": "invalid code"}
+	}
+
+	// Read before login clears the pending state
+	remember := app.sessionManager.GetBool(r.Context(), pendingTwoFactorRememberSessionKey)
+
+	return app.completeLogin(w, r, user, remember)
+}
+
+func (app *application) handleAccountTwoFactorGet(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.User.GetWithID(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	var data struct {
+		Enabled           bool
+		Required          bool
+		Secret            string
+		URI               template.URL
+		RecoveryCodes     []string
+		RecoveryCodesLeft int
+	}
+
+	data.Required, err = app.models.Permission.RequiresTwoFactor(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	t, err := app.models.TwoFactor.Get(r.Context(), suid)
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+	case err != nil:
+		return err
+	case t.Confirmed():
+		data.Enabled = true
+
+		data.RecoveryCodesLeft, err = app.models.TwoFactor.CountRecoveryCodes(r.Context(), suid)
+		if err != nil {
+			return err
+		}
+	default:
+		// Enrollment in progress
+		data.Secret = t.Secret
+		data.URI = template.URL(totp.URI(app.totpIssuer(), user.Username, t.Secret))
+	}
+
+	// Freshly generated codes are only ever shown once
+	codes, ok := app.sessionManager.Pop(r.Context(), recoveryCodesSessionKey).([]string)
+	if ok {
+		data.RecoveryCodes = codes
+	}
+
+	return app.render(w, r, http.StatusOK, "account-two-factor.tmpl", data)
+}
+
+func (app *application) handleAccountTwoFactorEnrollPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+
+	err = app.models.TwoFactor.Begin(r.Context(), suid, secret)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+
+	return nil
+}
+
+func (app *application) handleAccountTwoFactorConfirmPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	var form struct {
+		Code string `form:"code" validate:"required,len=6,numeric"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	t, err := app.models.TwoFactor.Get(r.Context(), suid)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return FormErrors{"Code": "start enrollment first"}
+		}
+
+		return err
+	}
+
+	counter, ok := totp.Validate(t.Secret, form.Code, time.Now())
+	if !ok {
+		return FormErrors{"Code": "invalid code"}
+	}
+
+	var codes []string
+	err = app.models.WithTx(r.Context(), func(m models.Models) error {
+		err := m.TwoFactor.Confirm(r.Context(), suid, counter)
+		if err != nil {
+			return err
+		}
+
+		codes, err = m.TwoFactor.NewRecoveryCodes(r.Context(), suid)
+
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return FormErrors{"Code": "two-factor authentication is already enabled"}
+		}
+
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), recoveryCodesSessionKey, codes)
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Two-factor authentication enabled. Save your recovery codes.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+
+	return nil
+}
+
+func (app *application) handleAccountTwoFactorRecoveryCodesPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	var form struct {
+		Code string `form:"code" validate:"required,max=32"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), suid, form.Code)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return FormErrors{"Code": "invalid code"}
+	}
+
+	var codes []string
+
+	err = app.models.WithTx(r.Context(), func(m models.Models) error {
+		var err error
+		codes, err = m.TwoFactor.NewRecoveryCodes(r.Context(), suid)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	app.sessionManager.Put(r.Context(), recoveryCodesSessionKey, codes)
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+
+	return nil
+}
+
+func (app *application) handleAccountTwoFactorDisablePost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	var form struct {
+		Password string `form:"password" validate:"required"`
+	}
+
+	err = app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	required, err := app.models.Permission.RequiresTwoFactor(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	if required {
+		return FormErrors{"Password": "your permissions require two-factor authentication"}
+	}
+
+	user, err := app.models.User.GetWithID(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	err = app.checkPassword(r.Context(), user, form.Password)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			return FormErrors{"Password": "incorrect password"}
+		}
+
+		return app.passwordCheckFailed(r, err)
+	}
+
+	err = app.models.WithTx(r.Context(), func(m models.Models) error {
+		return m.TwoFactor.Delete(r.Context(), suid)
+	})
+	if err != nil {
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Two-factor authentication disabled.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+
+	return nil
+}
+
+// Name shown in authenticator apps
+func (app *application) totpIssuer() string {
+	u, err := url.Parse(app.config.baseURL)
+	if err != nil {
+		return "web"
+	}
+
+	return u.Hostname()
+}
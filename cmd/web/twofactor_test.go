@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micahco/web-lite/internal/totp"
+)
+
+func TestSecondFactorReplay(t *testing.T) {
+	ctx := context.Background()
+	app := newTestApplication(t)
+
+	user, err := app.models.User.New(ctx, "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.TwoFactor.Begin(ctx, user.ID, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := totp.Counter(time.Now())
+
+	// Enrolled with the code of the previous step
+	err = app.models.TwoFactor.Confirm(ctx, user.ID, now-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := func(counter int64) string {
+		c, err := totp.Code(secret, counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	steps := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"enrollment code", code(now - 1), false},
+		{"current code", code(now), true},
+		{"current code again", code(now), false},
+		{"next code", code(now + 1), true},
+		{"current code after next", code(now), false},
+	}
+
+	for _, step := range steps {
+		ok, err := app.verifySecondFactor(ctx, user.ID, step.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != step.ok {
+			t.Errorf("%s: got %v, want %v", step.name, ok, step.ok)
+		}
+	}
+
+	tf, err := app.models.TwoFactor.Get(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf.LastCounter != now+1 {
+		t.Errorf("last counter: got %d, want %d", tf.LastCounter, now+1)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+const (
+	// Verification emails sent to an account per window, including the one
+	// sent at signup
+	maxVerificationEmails   = 3
+	verificationEmailWindow = time.Hour
+)
+
+func verificationRateLimitKey(userID int) string {
+	return "verify:" + strconv.Itoa(userID)
+}
+
+// Count a verification email against the user. Returns the time until which
+// no more may be sent, zero if more are allowed.
+func (app *application) recordVerificationEmail(ctx context.Context, userID int) (time.Time, error) {
+	return app.rateLimit(ctx, verificationEmailWindow,
+		requestLimit{verificationRateLimitKey(userID), maxVerificationEmails})
+}
+
+// Replace the user's verification link with a new one and email it.
+func (app *application) sendVerificationEmail(r *http.Request, user *models.User) error {
+	// Only the most recently sent link is valid
+	var token *models.Token
+	err := app.models.WithTx(r.Context(), func(m models.Models) error {
+		err := m.Token.DeleteAllForUser(r.Context(), models.ScopeEmailVerification, user.ID)
+		if err != nil {
+			return err
+		}
+
+		token, err = m.Token.New(r.Context(), user.ID, app.config.verificationTokenTTL, models.ScopeEmailVerification)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	data := map[string]any{
+		"Username": user.Username,
+		"URL":      app.config.baseURL + "/auth/verify?token=" + url.QueryEscape(token.Plaintext),
+		"Expiry":   app.config.verificationTokenTTL.String(),
+	}
+
+	logger := app.requestLogger(r)
+	app.background(func(ctx context.Context) {
+		err := app.mailer.Send(user.Email, "email_verification.tmpl", data)
+		if err != nil {
+			logger.Error("send verification email", slog.Any("err", err))
+		}
+	})
+
+	return nil
+}
+
+// The link in the email leads to a page that confirms with a POST, so that
+// link scanners in mail clients cannot use up the token.
+func (app *application) handleAuthVerifyGet(w http.ResponseWriter, r *http.Request) error {
+	var data struct {
+		Token string
+	}
+
+	data.Token = r.URL.Query().Get("token")
+
+	return app.render(w, r, http.StatusOK, "verify.tmpl", data)
+}
+
+func (app *application) handleAuthVerifyPost(w http.ResponseWriter, r *http.Request) error {
+	var form struct {
+		Token string `form:"token" validate:"required"`
+	}
+
+	err := app.parseForm(r, &form)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.User.GetForToken(r.Context(), models.ScopeEmailVerification, form.Token)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return FormErrors{"Token": "invalid or expired verification link, log in to request a new one"}
+		}
+
+		return err
+	}
+
+	user.VerifiedAt = time.Now()
+
+	err = app.models.WithTx(r.Context(), func(m models.Models) error {
+		err := m.User.Update(r.Context(), user)
+		if err != nil {
+			return err
+		}
+
+		return m.Token.DeleteAllForUser(r.Context(), models.ScopeEmailVerification, user.ID)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrEditConflict) {
+			return FormErrors{"Token": editConflictMessage}
+		}
+
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashSuccess,
+		Message: "Your email address has been verified.",
+	}
+	app.putFlash(r, f)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+func (app *application) handleAccountVerifyResendPost(w http.ResponseWriter, r *http.Request) error {
+	suid, err := app.getSessionUserID(r)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.models.User.GetWithID(r.Context(), suid)
+	if err != nil {
+		return err
+	}
+
+	if !user.Unverified() {
+		return app.renderError(w, r, http.StatusBadRequest, "email address already verified")
+	}
+
+	until, err := app.recordVerificationEmail(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		f := FlashMessage{
+			Type:    FlashError,
+			Message: "Too many verification emails sent. Try again " + retryIn(time.Until(until)) + ".",
+		}
+		app.putFlash(r, f)
+		app.refresh(w, r)
+
+		return nil
+	}
+
+	err = app.sendVerificationEmail(r, user)
+	if err != nil {
+		return err
+	}
+
+	f := FlashMessage{
+		Type:    FlashInfo,
+		Message: "A new verification link has been sent to " + user.Email + ".",
+	}
+	app.putFlash(r, f)
+	app.refresh(w, r)
+
+	return nil
+}
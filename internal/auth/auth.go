@@ -0,0 +1,102 @@
+// Package auth checks the username and password of a login against one or
+// more backends: the password hashes stored with each user, or an LDAP
+// directory.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/micahco/web-lite/internal/models"
+)
+
+// Authenticator checks a username and password and returns the user they
+// belong to. Rejected credentials return models.ErrInvalidCredentials, any
+// other error means the backend could not decide.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (*models.User, error)
+}
+
+// Wrapped with models.ErrInvalidCredentials by a backend that rejects a user
+// whose password it does not hold, such as an unknown one.
+var errPasswordNotHeld = errors.New("auth: no password held for the user")
+
+// Chain tries each authenticator in order until one accepts the credentials.
+//
+// A backend that fails, such as an unreachable directory, does not stop the
+// others from being tried. Its error is returned only if no backend that
+// holds the password of the user rejected the credentials. An outage of one
+// backend can then not be used to get around the login throttle of another,
+// while users of the failed backend are told to try later rather than having
+// failed logins counted against them.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	var failure error
+	rejected := false
+
+	for _, a := range c {
+		u, err := a.Authenticate(ctx, username, password)
+		switch {
+		case err == nil:
+			return u, nil
+		case errors.Is(err, errPasswordNotHeld):
+		case errors.Is(err, models.ErrInvalidCredentials):
+			rejected = true
+		case failure == nil:
+			failure = err
+		}
+	}
+
+	if rejected || failure == nil {
+		return nil, models.ErrInvalidCredentials
+	}
+
+	return nil, failure
+}
+
+// Local checks the password hash stored with the user. Users provisioned by
+// the LDAP backend have a random password that only the directory replaces.
+type Local struct {
+	Users      *models.UserModel
+	Identities *models.IdentityModel
+}
+
+func (l Local) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	u, err := l.Users.GetForCredentials(ctx, username, password)
+	if !errors.Is(err, models.ErrInvalidCredentials) {
+		return u, err
+	}
+
+	held, err := l.holdsPassword(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if !held {
+		return nil, fmt.Errorf("%w: %w", models.ErrInvalidCredentials, errPasswordNotHeld)
+	}
+
+	return nil, models.ErrInvalidCredentials
+}
+
+// Report whether the user exists and has a password of their own.
+func (l Local) holdsPassword(ctx context.Context, username string) (bool, error) {
+	u, err := l.Users.GetWithUsername(ctx, username)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	identities, err := l.Identities.GetAllForUser(ctx, u.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return !slices.ContainsFunc(identities, IsLDAPIdentity), nil
+}
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/micahco/web-lite/internal/migrate"
+	"github.com/micahco/web-lite/internal/models"
+	"github.com/micahco/web-lite/migrations"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// Models on a migrated in-memory database, closed when the test ends.
+func newTestModels(t *testing.T) models.Models {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// Each connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+
+	m, err := migrate.New(db, migrations.Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cheap enough to hash a password per test
+	return models.New(db, &argon2id.Params{
+		Memory:      64,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	})
+}
+
+// Authenticator with a fixed answer that counts its calls
+type stubAuthenticator struct {
+	user  *models.User
+	err   error
+	calls int
+}
+
+func (s *stubAuthenticator) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	s.calls++
+
+	return s.user, s.err
+}
+
+func TestChain(t *testing.T) {
+	errDown := errors.New("backend down")
+
+	accept := func(id int) *stubAuthenticator { return &stubAuthenticator{user: &models.User{ID: id}} }
+	reject := func() *stubAuthenticator { return &stubAuthenticator{err: models.ErrInvalidCredentials} }
+	fail := func() *stubAuthenticator { return &stubAuthenticator{err: errDown} }
+	notHeld := func() *stubAuthenticator {
+		return &stubAuthenticator{err: fmt.Errorf("%w: %w", models.ErrInvalidCredentials, errPasswordNotHeld)}
+	}
+
+	tests := []struct {
+		name     string
+		backends []*stubAuthenticator
+		wantID   int
+		wantErr  error
+		// Backends expected to be asked, by index
+		called []bool
+	}{
+		{
+			name:     "first accepts",
+			backends: []*stubAuthenticator{accept(1), accept(2)},
+			wantID:   1,
+			called:   []bool{true, false},
+		},
+		{
+			name:     "later accepts",
+			backends: []*stubAuthenticator{reject(), accept(2)},
+			wantID:   2,
+			called:   []bool{true, true},
+		},
+		{
+			name:     "accepts after failure",
+			backends: []*stubAuthenticator{fail(), accept(2)},
+			wantID:   2,
+			called:   []bool{true, true},
+		},
+		{
+			name:     "all reject",
+			backends: []*stubAuthenticator{reject(), reject()},
+			wantErr:  models.ErrInvalidCredentials,
+			called:   []bool{true, true},
+		},
+		{
+			name:     "failure hidden by rejection",
+			backends: []*stubAuthenticator{fail(), reject()},
+			wantErr:  models.ErrInvalidCredentials,
+			called:   []bool{true, true},
+		},
+		{
+			name:     "rejection before failure",
+			backends: []*stubAuthenticator{reject(), fail()},
+			wantErr:  models.ErrInvalidCredentials,
+			called:   []bool{true, true},
+		},
+		{
+			name:     "only failures",
+			backends: []*stubAuthenticator{fail(), fail()},
+			wantErr:  errDown,
+			called:   []bool{true, true},
+		},
+		{
+			name:     "failure where the password is not held",
+			backends: []*stubAuthenticator{notHeld(), fail()},
+			wantErr:  errDown,
+			called:   []bool{true, true},
+		},
+		{
+			name:     "password not held",
+			backends: []*stubAuthenticator{notHeld(), reject()},
+			wantErr:  models.ErrInvalidCredentials,
+			called:   []bool{true, true},
+		},
+		{
+			name:     "password held nowhere",
+			backends: []*stubAuthenticator{notHeld(), notHeld()},
+			wantErr:  models.ErrInvalidCredentials,
+			called:   []bool{true, true},
+		},
+		{
+			name:    "empty",
+			wantErr: models.ErrInvalidCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chain Chain
+			for _, b := range tt.backends {
+				chain = append(chain, b)
+			}
+
+			u, err := chain.Authenticate(context.Background(), "alice", "password")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr == nil && u.ID != tt.wantID {
+				t.Errorf("got user %d, want %d", u.ID, tt.wantID)
+			}
+
+			for i, b := range tt.backends {
+				if (b.calls > 0) != tt.called[i] {
+					t.Errorf("backend %d: got %d calls, want called %t", i, b.calls, tt.called[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChainLocalThenLDAP(t *testing.T) {
+	ctx := context.Background()
+	m := newTestModels(t)
+	d := newTestDirectory(t)
+
+	local, err := m.User.New(ctx, "alice", "localpass1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := Chain{Local{Users: m.User, Identities: m.Identity}, NewLDAP(d.config(), m, discardLogger)}
+
+	u, err := chain.Authenticate(ctx, "alice", "localpass1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.ID != local.ID {
+		t.Errorf("got user %d, want local user %d", u.ID, local.ID)
+	}
+
+	if n := d.userBinds(); n != 0 {
+		t.Errorf("got %d directory binds, want 0 once the local password matched", n)
+	}
+
+	u, err = chain.Authenticate(ctx, "carol", "carolpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Username != "carol" {
+		t.Errorf("got user %q, want carol", u.Username)
+	}
+
+	_, err = chain.Authenticate(ctx, "carol", "wrongpass")
+	if !errors.Is(err, models.ErrInvalidCredentials) {
+		t.Errorf("got %v, want %v", err, models.ErrInvalidCredentials)
+	}
+
+	// With the directory down, only local passwords can be rejected. Others
+	// get the outage, which is not counted as a failed login.
+	down := d.config()
+	down.URL = "ldap://127.0.0.1:1"
+	chain = Chain{Local{Users: m.User, Identities: m.Identity}, NewLDAP(down, m, discardLogger)}
+
+	tests := []struct {
+		username   string
+		wantReject bool
+	}{
+		{username: "alice", wantReject: true},
+		{username: "carol"},
+		{username: "mallory"},
+	}
+
+	for _, tt := range tests {
+		_, err := chain.Authenticate(ctx, tt.username, "wrongpass")
+		if errors.Is(err, models.ErrInvalidCredentials) != tt.wantReject {
+			t.Errorf("%s with the directory down: got %v, want rejected %t", tt.username, err, tt.wantReject)
+		}
+
+		if err == nil {
+			t.Errorf("%s with the directory down: got nil, want error", tt.username)
+		}
+	}
+}
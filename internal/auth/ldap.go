@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/micahco/web-lite/internal/models"
+)
+
+// LDAPConfig describes how users are found in the directory.
+type LDAPConfig struct {
+	// ldap:// or ldaps:// URL of the server
+	URL string
+	// Upgrade ldap:// connections with StartTLS
+	StartTLS bool
+	// Service account that searches for users, anonymous if empty
+	BindDN       string
+	BindPassword string
+	// Subtree searched for users
+	BaseDN string
+	// Filter matching a single user, with %s for the escaped username,
+	// e.g. "(uid=%s)"
+	UserFilter        string
+	UsernameAttribute string
+	EmailAttribute    string
+	// Attribute listing the DNs of the groups of the user, e.g. "memberOf"
+	GroupAttribute string
+	// Permission granted to members of each group, keyed by the common name
+	// of the group
+	GroupPermissions map[string]string
+	// Limit for each round trip to the server
+	Timeout time.Duration
+}
+
+// Prefix of the issuer of the identities that link users to their directory
+// entries. The rest is the base DN, which unlike the server URL survives a
+// move to another host or to ldaps://.
+const LDAPIssuerPrefix = "ldap:"
+
+// Report whether the identity links a user to a directory entry. Such links
+// belong to the LDAP backend, not to the user.
+func IsLDAPIdentity(i *models.Identity) bool {
+	return strings.HasPrefix(i.Issuer, LDAPIssuerPrefix)
+}
+
+// LDAP checks passwords by binding to the directory as the user.
+//
+// Users are created on their first login and linked to their directory entry
+// with an Identity, so a local account that happens to share a username is
+// never taken over. Permissions named in GroupPermissions follow the groups
+// of the user on every login, others are left alone.
+type LDAP struct {
+	config LDAPConfig
+	models models.Models
+	logger *slog.Logger
+}
+
+func NewLDAP(config LDAPConfig, m models.Models, logger *slog.Logger) *LDAP {
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	return &LDAP{config: config, models: m, logger: logger}
+}
+
+// ldapEntry is the part of a directory entry used to log in
+type ldapEntry struct {
+	DN       string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, username, password string) (*models.User, error) {
+	// An empty password makes the bind unauthenticated, which servers accept
+	// for any DN
+	if username == "" || password == "" {
+		return nil, models.ErrInvalidCredentials
+	}
+
+	entry, err := l.bind(ctx, username, password)
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidCredentials) {
+			l.logger.Error("ldap", slog.String("url", l.config.URL), slog.Any("err", err))
+		}
+
+		return nil, err
+	}
+
+	return l.sync(ctx, entry)
+}
+
+func (l *LDAP) dial(ctx context.Context) (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: l.config.Timeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+
+	conn, err := ldap.DialURL(l.config.URL, ldap.DialWithDialer(dialer))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(l.config.Timeout)
+
+	if l.config.StartTLS {
+		u, err := url.Parse(l.config.URL)
+		if err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		err = conn.StartTLS(&tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+		if err != nil {
+			conn.Close()
+
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// Find the entry of the user and bind as it to check the password.
+func (l *LDAP) bind(ctx context.Context, username, password string) (*ldapEntry, error) {
+	conn, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if l.config.BindDN != "" {
+		err = conn.Bind(l.config.BindDN, l.config.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("service account bind: %w", err)
+		}
+	}
+
+	req := ldap.NewSearchRequest(
+		l.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		// Two is enough to tell the filter is ambiguous
+		2,
+		int(l.config.Timeout/time.Second),
+		false,
+		fmt.Sprintf(l.config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{l.config.UsernameAttribute, l.config.EmailAttribute, l.config.GroupAttribute},
+		nil,
+	)
+
+	res, err := conn.Search(req)
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		l.logger.Warn("ldap user filter matches several entries", slog.String("username", username))
+
+		return nil, models.ErrInvalidCredentials
+	case err != nil:
+		return nil, fmt.Errorf("search: %w", err)
+	case len(res.Entries) != 1:
+		return nil, models.ErrInvalidCredentials
+	}
+
+	e := res.Entries[0]
+
+	err = conn.Bind(e.DN, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, models.ErrInvalidCredentials
+		}
+
+		return nil, fmt.Errorf("user bind: %w", err)
+	}
+
+	entry := &ldapEntry{
+		DN:       e.DN,
+		Username: e.GetEqualFoldAttributeValue(l.config.UsernameAttribute),
+		Email:    e.GetEqualFoldAttributeValue(l.config.EmailAttribute),
+	}
+
+	if entry.Username == "" {
+		entry.Username = username
+	}
+
+	for _, dn := range e.GetEqualFoldAttributeValues(l.config.GroupAttribute) {
+		if cn := commonName(dn); cn != "" {
+			entry.Groups = append(entry.Groups, cn)
+		}
+	}
+
+	return entry, nil
+}
+
+// First common name of a DN, e.g. "admins" for
+// "cn=admins,ou=groups,dc=example,dc=com"
+func commonName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return ""
+	}
+
+	for _, rdn := range parsed.RDNs {
+		for _, attr := range rdn.Attributes {
+			if strings.EqualFold(attr.Type, "cn") {
+				return attr.Value
+			}
+		}
+	}
+
+	return ""
+}
+
+// Get the user linked to the entry, creating it on the first login, and bring
+// the mapped permissions in line with the groups of the entry.
+func (l *LDAP) sync(ctx context.Context, entry *ldapEntry) (*models.User, error) {
+	var grant, revoke []string
+	for group, code := range l.config.GroupPermissions {
+		if containsFold(entry.Groups, group) {
+			grant = append(grant, code)
+		} else {
+			revoke = append(revoke, code)
+		}
+	}
+
+	var user *models.User
+
+	err := l.models.WithTx(ctx, func(m models.Models) error {
+		identity, err := m.Identity.GetWithSubject(ctx, l.issuer(), entry.DN)
+		switch {
+		case errors.Is(err, models.ErrNoRecord):
+			user, err = l.provision(ctx, m, entry)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			user, err = m.User.GetWithID(ctx, identity.UserID)
+			if err != nil {
+				return err
+			}
+
+			err = m.Identity.Use(ctx, identity.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		// A permission mapped from several groups is kept if any of them
+		// grants it
+		err = m.Permission.Revoke(ctx, user.ID, without(revoke, grant)...)
+		if err != nil {
+			return err
+		}
+
+		return m.Permission.Grant(ctx, user.ID, grant...)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrDuplicateUsername) || errors.Is(err, models.ErrDuplicateEmail) {
+			l.logger.Warn("ldap user conflicts with a local account",
+				slog.String("dn", entry.DN),
+				slog.String("username", entry.Username))
+
+			return nil, models.ErrInvalidCredentials
+		}
+
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Create the user for a directory entry. The account gets a random password
+// that is never used, the directory checks the real one.
+func (l *LDAP) provision(ctx context.Context, m models.Models, entry *ldapEntry) (*models.User, error) {
+	user := &models.User{Username: entry.Username}
+
+	// The directory is trusted for the addresses of its users
+	if entry.Email != "" {
+		user.Email = entry.Email
+		user.VerifiedAt = time.Now()
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.User.SetPassword(user, base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.User.Insert(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Identity.Insert(ctx, &models.Identity{
+		UserID:  user.ID,
+		Issuer:  l.issuer(),
+		Subject: entry.DN,
+		Name:    entry.DN,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l.logger.Info("provisioned user",
+		slog.Int("user_id", user.ID),
+		slog.String("username", user.Username),
+		slog.String("dn", entry.DN))
+
+	return user, nil
+}
+
+func (l *LDAP) issuer() string {
+	return LDAPIssuerPrefix + l.config.BaseDN
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func without(list, remove []string) []string {
+	var kept []string
+	for _, v := range list {
+		if !containsFold(remove, v) {
+			kept = append(kept, v)
+		}
+	}
+
+	return kept
+}
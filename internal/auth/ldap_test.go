@@ -0,0 +1,655 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/micahco/web-lite/internal/models"
+)
+
+const (
+	testBaseDN     = "ou=people,dc=example,dc=com"
+	testBindDN     = "cn=svc,dc=example,dc=com"
+	testBindSecret = "svcpass"
+)
+
+type testEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// testDirectory is an in-process stand-in for an LDAP server. It answers
+// simple binds, and searches with equality, presence, and, or and not
+// filters, honouring the size limit. Requests are recorded for inspection.
+type testDirectory struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	entries []testEntry
+	binds   []string
+	filters []string
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &testDirectory{
+		ln: ln,
+		entries: []testEntry{
+			{
+				dn:       "uid=carol," + testBaseDN,
+				password: "carolpass",
+				attrs: map[string][]string{
+					"uid":      {"carol"},
+					"cn":       {"Carol"},
+					"mail":     {"carol@example.com"},
+					"memberOf": {"cn=Admins,ou=groups,dc=example,dc=com"},
+				},
+			},
+			{
+				dn:       "uid=dave," + testBaseDN,
+				password: "davepass",
+				attrs: map[string][]string{
+					"uid": {"dave"},
+					"cn":  {"Sam"},
+				},
+			},
+			{
+				dn:       "uid=erin," + testBaseDN,
+				password: "erinpass",
+				attrs: map[string][]string{
+					"uid":  {"erin"},
+					"cn":   {"Sam"},
+					"mail": {"erin@example.com"},
+				},
+			},
+			{
+				dn:       "uid=frank," + testBaseDN,
+				password: "frankpass",
+				attrs: map[string][]string{
+					"uid": {"frank"},
+					"cn":  {"Sam"},
+				},
+			},
+		},
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.serve(conn)
+			}()
+		}
+	}()
+
+	return d
+}
+
+func (d *testDirectory) config() LDAPConfig {
+	return LDAPConfig{
+		URL:               "ldap://" + d.ln.Addr().String(),
+		BindDN:            testBindDN,
+		BindPassword:      testBindSecret,
+		BaseDN:            testBaseDN,
+		UserFilter:        "(uid=%s)",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		GroupAttribute:    "memberOf",
+	}
+}
+
+// Change the attribute values of the entry with the DN.
+func (d *testDirectory) set(dn, attr string, values ...string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, e := range d.entries {
+		if e.dn == dn {
+			e.attrs[attr] = values
+		}
+	}
+}
+
+// Binds made as a user rather than the service account
+func (d *testDirectory) userBinds() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for _, dn := range d.binds {
+		if dn != testBindDN {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (d *testDirectory) lastFilter() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.filters) == 0 {
+		return ""
+	}
+
+	return d.filters[len(d.filters)-1]
+}
+
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = append(responses, ldapResult(id, ldap.ApplicationBindResponse, d.bind(op)))
+		case ldap.ApplicationSearchRequest:
+			responses = d.search(id, op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		default:
+			responses = append(responses, ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform))
+		}
+
+		for _, r := range responses {
+			_, err = conn.Write(r.Bytes())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (d *testDirectory) bind(op *ber.Packet) uint16 {
+	dn := op.Children[1].Data.String()
+	password := op.Children[2].Data.String()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.binds = append(d.binds, dn)
+
+	if password == "" {
+		return ldap.LDAPResultUnwillingToPerform
+	}
+
+	if dn == testBindDN && password == testBindSecret {
+		return ldap.LDAPResultSuccess
+	}
+
+	for _, e := range d.entries {
+		if e.dn == dn && e.password == password {
+			return ldap.LDAPResultSuccess
+		}
+	}
+
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (d *testDirectory) search(id int64, op *ber.Packet) []*ber.Packet {
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+
+	s, err := ldap.DecompileFilter(filter)
+	if err != nil {
+		return []*ber.Packet{ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.filters = append(d.filters, s)
+
+	var responses []*ber.Packet
+	for _, e := range d.entries {
+		if !matchFilter(filter, e) {
+			continue
+		}
+
+		if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+			return append(responses, ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+
+		responses = append(responses, searchEntry(id, e))
+	}
+
+	return append(responses, ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+func matchFilter(f *ber.Packet, e testEntry) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !matchFilter(c, e) {
+				return false
+			}
+		}
+
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if matchFilter(c, e) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterNot:
+		return !matchFilter(f.Children[0], e)
+	case ldap.FilterEqualityMatch:
+		attr := f.Children[0].Data.String()
+		value := f.Children[1].Data.String()
+
+		for name, values := range e.attrs {
+			if strings.EqualFold(name, attr) && slices.ContainsFunc(values, func(v string) bool {
+				return strings.EqualFold(v, value)
+			}) {
+				return true
+			}
+		}
+	case ldap.FilterPresent:
+		for name := range e.attrs {
+			if strings.EqualFold(name, f.Data.String()) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func ldapResult(id int64, tag ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(r)
+
+	return p
+}
+
+func searchEntry(id int64, e testEntry) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range e.attrs {
+		a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		a.AppendChild(set)
+
+		attrs.AppendChild(a)
+	}
+	r.AppendChild(attrs)
+	p.AppendChild(r)
+
+	return p
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	m := newTestModels(t)
+	d := newTestDirectory(t)
+	l := NewLDAP(d.config(), m, discardLogger)
+
+	// Logins are case insensitive like the directory, the account takes the
+	// username the directory knows
+	u, err := l.Authenticate(ctx, "Carol", "carolpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Username != "carol" || u.Email != "carol@example.com" || u.VerifiedAt.IsZero() {
+		t.Errorf("got %q %q verified %v, want carol carol@example.com verified", u.Username, u.Email, u.VerifiedAt)
+	}
+
+	identity, err := m.Identity.GetWithSubject(ctx, LDAPIssuerPrefix+testBaseDN, "uid=carol,"+testBaseDN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.UserID != u.ID {
+		t.Errorf("identity linked to user %d, want %d", identity.UserID, u.ID)
+	}
+
+	// Later logins find the same account
+	again, err := l.Authenticate(ctx, "carol", "carolpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.ID != u.ID {
+		t.Errorf("got user %d, want %d", again.ID, u.ID)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{"wrong password", "carol", "wrongpass"},
+		{"unknown user", "mallory", "carolpass"},
+		{"empty password", "carol", ""},
+		{"empty username", "", "carolpass"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := l.Authenticate(ctx, tt.username, tt.password)
+			if !errors.Is(err, models.ErrInvalidCredentials) {
+				t.Errorf("got %v, want %v", err, models.ErrInvalidCredentials)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		cfg := d.config()
+		cfg.URL = "ldap://127.0.0.1:1"
+
+		_, err := NewLDAP(cfg, m, discardLogger).Authenticate(ctx, "carol", "carolpass")
+		if err == nil || errors.Is(err, models.ErrInvalidCredentials) {
+			t.Errorf("got %v, want a backend error", err)
+		}
+	})
+}
+
+func TestLDAPServerMove(t *testing.T) {
+	ctx := context.Background()
+	m := newTestModels(t)
+
+	u, err := NewLDAP(newTestDirectory(t).config(), m, discardLogger).Authenticate(ctx, "carol", "carolpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same directory served from another URL keeps its links
+	moved := newTestDirectory(t).config()
+
+	again, err := NewLDAP(moved, m, discardLogger).Authenticate(ctx, "carol", "carolpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.ID != u.ID {
+		t.Errorf("got user %d, want %d", again.ID, u.ID)
+	}
+}
+
+func TestLDAPFilterEscaping(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDirectory(t)
+	l := NewLDAP(d.config(), newTestModels(t), discardLogger)
+
+	tests := []struct {
+		username string
+		filter   string
+	}{
+		{"*", `(uid=\2a)`},
+		{"car*", `(uid=car\2a)`},
+		{"carol)(uid=*", `(uid=carol\29\28uid=\2a)`},
+		{`carol\`, `(uid=carol\5c)`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			_, err := l.Authenticate(ctx, tt.username, "carolpass")
+			if !errors.Is(err, models.ErrInvalidCredentials) {
+				t.Errorf("got %v, want %v", err, models.ErrInvalidCredentials)
+			}
+
+			if got := d.lastFilter(); got != tt.filter {
+				t.Errorf("got filter %s, want %s", got, tt.filter)
+			}
+		})
+	}
+
+	if n := d.userBinds(); n != 0 {
+		t.Errorf("got %d user binds, want 0", n)
+	}
+}
+
+func TestLDAPAmbiguousFilter(t *testing.T) {
+	ctx := context.Background()
+	m := newTestModels(t)
+	d := newTestDirectory(t)
+
+	// Dave, Erin and Frank share a common name
+	tests := []struct {
+		name   string
+		filter string
+		// The server stops at the size limit, which is logged
+		limited bool
+	}{
+		{"two matches", "(&(cn=%s)(!(uid=frank)))", false},
+		{"over the size limit", "(cn=%s)", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+
+			cfg := d.config()
+			cfg.UserFilter = tt.filter
+			l := NewLDAP(cfg, m, slog.New(slog.NewTextHandler(&logs, nil)))
+
+			_, err := l.Authenticate(ctx, "Sam", "davepass")
+			if !errors.Is(err, models.ErrInvalidCredentials) {
+				t.Errorf("got %v, want %v", err, models.ErrInvalidCredentials)
+			}
+
+			if n := d.userBinds(); n != 0 {
+				t.Errorf("got %d user binds, want 0", n)
+			}
+
+			if strings.Contains(logs.String(), "level=ERROR") {
+				t.Errorf("logged an error for an ambiguous filter: %s", logs.String())
+			}
+
+			if got := strings.Contains(logs.String(), "matches several entries"); got != tt.limited {
+				t.Errorf("got size limit warning %t, want %t", got, tt.limited)
+			}
+		})
+	}
+
+	// A unique match still logs in
+	cfg := d.config()
+	cfg.UserFilter = "(cn=%s)"
+
+	u, err := NewLDAP(cfg, m, discardLogger).Authenticate(ctx, "Carol", "carolpass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Username != "carol" {
+		t.Errorf("got user %q, want carol", u.Username)
+	}
+}
+
+func TestLDAPGroupPermissions(t *testing.T) {
+	ctx := context.Background()
+	m := newTestModels(t)
+	d := newTestDirectory(t)
+
+	cfg := d.config()
+	cfg.GroupPermissions = map[string]string{
+		"admins":    "admin",
+		"operators": "logs",
+		"auditors":  "logs",
+	}
+	l := NewLDAP(cfg, m, discardLogger)
+
+	carol := "uid=carol," + testBaseDN
+	group := func(cn string) string { return "cn=" + cn + ",ou=groups,dc=example,dc=com" }
+
+	login := func(groups ...string) models.Permissions {
+		t.Helper()
+
+		d.set(carol, "memberOf", groups...)
+
+		u, err := l.Authenticate(ctx, "carol", "carolpass")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		permissions, err := m.Permission.GetAllForUser(ctx, u.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return permissions
+	}
+
+	// Group names match case insensitively
+	if got := login(group("Admins")); !slices.Equal(got, models.Permissions{"admin"}) {
+		t.Errorf("admins: got %v, want [admin]", got)
+	}
+
+	// Permissions not mapped from any group are left alone
+	u, err := m.User.GetWithUsername(ctx, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Permission.Grant(ctx, u.ID, "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := login(group("operators")); !slices.Equal(got, models.Permissions{"logs", "tags"}) {
+		t.Errorf("operators: got %v, want [logs tags]", got)
+	}
+
+	// A permission mapped from several groups is kept while any grants it
+	if got := login(group("auditors"), group("unrelated")); !slices.Equal(got, models.Permissions{"logs", "tags"}) {
+		t.Errorf("auditors: got %v, want [logs tags]", got)
+	}
+
+	if got := login(); !slices.Equal(got, models.Permissions{"tags"}) {
+		t.Errorf("no groups: got %v, want [tags]", got)
+	}
+}
+
+func TestLDAPProvisionConflict(t *testing.T) {
+	ctx := context.Background()
+	m := newTestModels(t)
+	d := newTestDirectory(t)
+	l := NewLDAP(d.config(), m, discardLogger)
+
+	// Local accounts that share a username or email address with a directory
+	// entry are never taken over
+	dave, err := m.User.New(ctx, "dave", "localpass1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mallory := &models.User{Username: "mallory", Email: "erin@example.com"}
+	err = m.User.SetPassword(mallory, "localpass1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.User.Insert(ctx, mallory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		dn       string
+	}{
+		{"username", "dave", "davepass", "uid=dave," + testBaseDN},
+		{"email", "erin", "erinpass", "uid=erin," + testBaseDN},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := l.Authenticate(ctx, tt.username, tt.password)
+			if !errors.Is(err, models.ErrInvalidCredentials) {
+				t.Fatalf("got %v, want %v", err, models.ErrInvalidCredentials)
+			}
+
+			_, err = m.Identity.GetWithSubject(ctx, LDAPIssuerPrefix+testBaseDN, tt.dn)
+			if !errors.Is(err, models.ErrNoRecord) {
+				t.Errorf("identity: got %v, want %v", err, models.ErrNoRecord)
+			}
+		})
+	}
+
+	// The local account still logs in with its own password
+	u, err := m.User.GetForCredentials(ctx, "dave", "localpass1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.ID != dave.ID {
+		t.Errorf("got user %d, want %d", u.ID, dave.ID)
+	}
+
+	// With the conflict gone, the entry gets an account of its own
+	err = m.User.Delete(ctx, dave.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err = l.Authenticate(ctx, "dave", "davepass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.ID == dave.ID || u.Username != "dave" {
+		t.Errorf("got user %d %q, want a new account for dave", u.ID, u.Username)
+	}
+}
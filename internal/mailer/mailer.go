@@ -0,0 +1,106 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"text/template"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// Message is a rendered email ready to be delivered by a Sender.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers rendered messages. Implementations decide how the message
+// leaves the application (SMTP, log output, ...).
+type Sender interface {
+	Send(msg Message) error
+}
+
+type Mailer struct {
+	sender Sender
+}
+
+func New(sender Sender) *Mailer {
+	return &Mailer{sender: sender}
+}
+
+// Render the embedded template file with data and hand the message to the
+// configured sender. Templates must define "subject" and "plainBody".
+func (m *Mailer) Send(recipient, templateFile string, data any) error {
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return err
+	}
+
+	subject := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return err
+	}
+
+	body := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(body, "plainBody", data)
+	if err != nil {
+		return err
+	}
+
+	return m.sender.Send(Message{
+		To:      recipient,
+		Subject: subject.String(),
+		Body:    body.String(),
+	})
+}
+
+// LogSender writes messages to the logger instead of delivering them. Only
+// for development and tests: bodies include live reset and verification links.
+type LogSender struct {
+	Logger *slog.Logger
+}
+
+func (s LogSender) Send(msg Message) error {
+	s.Logger.Info("email",
+		slog.String("to", msg.To),
+		slog.String("subject", msg.Subject),
+		slog.String("body", msg.Body),
+	)
+
+	return nil
+}
+
+// SMTPSender delivers messages with PLAIN auth to an SMTP server.
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPSender) Send(msg Message) error {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", msg.Subject)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(msg.Body)
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", s.Host, s.Port)
+
+	return smtp.SendMail(addr, auth, s.From, []string{msg.To}, buf.Bytes())
+}
@@ -0,0 +1,312 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	ErrLocked         = errors.New("migrate: another migration is in progress")
+	ErrNoChange       = errors.New("migrate: no change")
+	ErrUnknownVersion = errors.New("migrate: unknown version")
+)
+
+// Migration files are named <version>_<name>.<up|down>.sql, e.g.
+// 0001_init.up.sql. Every version needs both directions.
+var filenameRX = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status of a single migration. AppliedAt is zero if the migration has not
+// been applied.
+type Status struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// Load migrations from the root of fsys.
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, entry := range entries {
+		matches := filenameRX.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		}
+
+		if m.Name != matches[2] {
+			return nil, fmt.Errorf("migrate: version %d has conflicting names %q and %q", version, m.Name, matches[2])
+		}
+
+		switch matches[3] {
+		case "up":
+			m.Up = string(b)
+		case "down":
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrate: version %d is missing its up or down file", m.Version)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return a.Version - b.Version
+	})
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Apply all pending migrations.
+func (m *Migrator) Up(ctx context.Context) error {
+	if len(m.migrations) == 0 {
+		return ErrNoChange
+	}
+
+	return m.Goto(ctx, m.migrations[len(m.migrations)-1].Version)
+}
+
+// Roll back the most recently applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.withLock(ctx, func(tx *sql.Conn, applied map[int]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; ok {
+				return m.apply(ctx, tx, mig, false)
+			}
+		}
+
+		return ErrNoChange
+	})
+}
+
+// Migrate up or down until version is the latest applied migration. Version
+// 0 rolls back every migration.
+func (m *Migrator) Goto(ctx context.Context, version int) error {
+	if version != 0 && !slices.ContainsFunc(m.migrations, func(mig Migration) bool {
+		return mig.Version == version
+	}) {
+		return ErrUnknownVersion
+	}
+
+	return m.withLock(ctx, func(tx *sql.Conn, applied map[int]time.Time) error {
+		changed := false
+
+		// Roll back newer migrations first, newest to oldest
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; ok && mig.Version > version {
+				err := m.apply(ctx, tx, mig, false)
+				if err != nil {
+					return err
+				}
+				changed = true
+			}
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; !ok && mig.Version <= version {
+				err := m.apply(ctx, tx, mig, true)
+				if err != nil {
+					return err
+				}
+				changed = true
+			}
+		}
+
+		if !changed {
+			return ErrNoChange
+		}
+
+		return nil
+	})
+}
+
+// List every known migration and when it was applied. Status only reads, so
+// it runs in a deferred transaction that neither waits for the write lock nor
+// creates schema_migrations.
+func (m *Migrator) Status(ctx context.Context) (statuses []Status, err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Explicit, so a DSN with _txlock=immediate does not take the write lock
+	_, err = conn.ExecContext(ctx, "BEGIN DEFERRED;")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK;")
+
+	var exists bool
+	err = conn.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM sqlite_master
+			WHERE type = 'table' AND name = 'schema_migrations'
+		);`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	if exists {
+		applied, err = appliedVersions(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, mig := range m.migrations {
+		statuses = append(statuses, Status{
+			Version:   mig.Version,
+			Name:      mig.Name,
+			AppliedAt: applied[mig.Version],
+		})
+	}
+
+	return statuses, nil
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration, up bool) error {
+	script := mig.Down
+	if up {
+		script = mig.Up
+	}
+
+	_, err := conn.ExecContext(ctx, script)
+	if err != nil {
+		return fmt.Errorf("migrate: version %d (%s): %w", mig.Version, mig.Name, err)
+	}
+
+	if up {
+		_, err = conn.ExecContext(ctx, `
+			INSERT INTO schema_migrations (version, name, applied_at)
+			VALUES (?, ?, ?);`, mig.Version, mig.Name, time.Now().UTC())
+	} else {
+		_, err = conn.ExecContext(ctx, `
+			DELETE FROM schema_migrations
+			WHERE version = ?;`, mig.Version)
+	}
+
+	return err
+}
+
+// Run fn inside a single write transaction. BEGIN IMMEDIATE takes the SQLite
+// write lock up front, so a second process trying to migrate at the same time
+// fails with ErrLocked instead of interleaving. Any error rolls back every
+// migration applied by fn.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn, applied map[int]time.Time) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE;")
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) &&
+			(sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+			return ErrLocked
+		}
+
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			conn.ExecContext(context.Background(), "ROLLBACK;")
+			return
+		}
+
+		_, err = conn.ExecContext(ctx, "COMMIT;")
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		);`)
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn, applied)
+}
+
+// Read the applied versions from schema_migrations, which must exist.
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
@@ -0,0 +1,321 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/micahco/web-lite/migrations"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testFiles = fstest.MapFS{
+	"0001_a.up.sql":   {Data: []byte(`CREATE TABLE a (id INTEGER PRIMARY KEY);`)},
+	"0001_a.down.sql": {Data: []byte(`DROP TABLE a;`)},
+	"0002_b.up.sql":   {Data: []byte(`CREATE TABLE b (id INTEGER PRIMARY KEY);`)},
+	"0002_b.down.sql": {Data: []byte(`DROP TABLE b;`)},
+}
+
+// Open a database file, closed when the test ends. A file rather than
+// :memory: so that several connections share it.
+func openTestDB(t *testing.T, path string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on&_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func newTestMigrator(t *testing.T, db *sql.DB, fsys fstest.MapFS) *Migrator {
+	t.Helper()
+
+	m, err := New(db, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM sqlite_master
+			WHERE type = 'table' AND name = ?
+		);`, name).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return exists
+}
+
+// Versions that Status reports as applied
+func appliedList(t *testing.T, m *Migrator) []int {
+	t.Helper()
+
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var versions []int
+	for _, s := range statuses {
+		if !s.AppliedAt.IsZero() {
+			versions = append(versions, s.Version)
+		}
+	}
+
+	return versions
+}
+
+func TestUpDownGoto(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	m := newTestMigrator(t, db, testFiles)
+
+	steps := []struct {
+		name    string
+		run     func() error
+		wantErr error
+		wantA   bool
+		wantB   bool
+	}{
+		{"up", func() error { return m.Up(ctx) }, nil, true, true},
+		{"up again", func() error { return m.Up(ctx) }, ErrNoChange, true, true},
+		{"down", func() error { return m.Down(ctx) }, nil, true, false},
+		{"goto 0", func() error { return m.Goto(ctx, 0) }, nil, false, false},
+		{"down with none applied", func() error { return m.Down(ctx) }, ErrNoChange, false, false},
+		{"goto 1", func() error { return m.Goto(ctx, 1) }, nil, true, false},
+		{"goto 2", func() error { return m.Goto(ctx, 2) }, nil, true, true},
+		{"goto 2 again", func() error { return m.Goto(ctx, 2) }, ErrNoChange, true, true},
+		{"goto unknown", func() error { return m.Goto(ctx, 3) }, ErrUnknownVersion, true, true},
+	}
+
+	for _, step := range steps {
+		err := step.run()
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: got %v, want %v", step.name, err, step.wantErr)
+		}
+
+		if got := tableExists(t, db, "a"); got != step.wantA {
+			t.Errorf("%s: table a exists: got %v, want %v", step.name, got, step.wantA)
+		}
+
+		if got := tableExists(t, db, "b"); got != step.wantB {
+			t.Errorf("%s: table b exists: got %v, want %v", step.name, got, step.wantB)
+		}
+	}
+}
+
+func TestFailingMigrationRollsBack(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+
+	files := fstest.MapFS{
+		"0001_a.up.sql":   testFiles["0001_a.up.sql"],
+		"0001_a.down.sql": testFiles["0001_a.down.sql"],
+		"0002_bad.up.sql": {Data: []byte(`
+			CREATE TABLE b (id INTEGER PRIMARY KEY);
+			CREATE TABLE (;`)},
+		"0002_bad.down.sql": {Data: []byte(`DROP TABLE b;`)},
+	}
+	m := newTestMigrator(t, db, files)
+
+	err := m.Up(ctx)
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+
+	for _, table := range []string{"a", "b"} {
+		if tableExists(t, db, table) {
+			t.Errorf("table %s exists after a failed migration", table)
+		}
+	}
+
+	if got := appliedList(t, m); len(got) != 0 {
+		t.Errorf("applied: got %v, want none", got)
+	}
+}
+
+func TestLocked(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	holder := openTestDB(t, path)
+	m := newTestMigrator(t, openTestDB(t, path), testFiles)
+
+	conn, err := holder.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Up(ctx)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("up: got %v, want %v", err, ErrLocked)
+	}
+
+	err = m.Goto(ctx, 1)
+	if !errors.Is(err, ErrLocked) {
+		t.Errorf("goto: got %v, want %v", err, ErrLocked)
+	}
+
+	// Status only reads, so it does not wait for the writer
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("status: got %v, want nil", err)
+	}
+	if len(statuses) != 2 {
+		t.Errorf("status: got %d migrations, want 2", len(statuses))
+	}
+
+	_, err = conn.ExecContext(ctx, "ROLLBACK;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Up(ctx)
+	if err != nil {
+		t.Errorf("up after unlock: got %v, want nil", err)
+	}
+}
+
+func TestStatusDoesNotCreateTable(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	m := newTestMigrator(t, db, testFiles)
+
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range statuses {
+		if !s.AppliedAt.IsZero() {
+			t.Errorf("version %d: got applied at %v, want pending", s.Version, s.AppliedAt)
+		}
+	}
+
+	if tableExists(t, db, "schema_migrations") {
+		t.Error("status created schema_migrations")
+	}
+}
+
+// The schema initDB created before the app had migrations
+const initDBSchema = `
+	CREATE TABLE IF NOT EXISTS sessions (
+		token TEXT PRIMARY KEY,
+		data BLOB NOT NULL,
+		expiry REAL NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions(expiry);
+
+	CREATE TABLE IF NOT EXISTS User (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS Permission (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+	);
+
+	CREATE TABLE IF NOT EXISTS UserPermission (
+		user_id INTEGER NOT NULL,
+		permission_id INTEGER NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE,
+		FOREIGN KEY (permission_id) REFERENCES Permissions (id) ON DELETE CASCADE,
+		PRIMARY KEY (user_id, permission_id)
+	);
+
+	INSERT INTO Permission (name)
+	VALUES
+		('admin'),
+		('services'),
+		('tags'),
+		('forwarding'),
+		('logs')
+	ON CONFLICT (name) DO NOTHING;`
+
+func TestAdoptInitDB(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// initDB did not enable foreign keys, and with them on the broken
+	// UserPermission reference would refuse every insert
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = old.Exec(initDBSchema + `
+		INSERT INTO User (username, password) VALUES ('alice', 'hash');
+		INSERT INTO UserPermission (user_id, permission_id)
+		SELECT User.id, Permission.id FROM User, Permission
+		WHERE User.username = 'alice' AND Permission.name = 'admin';`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDB(t, path)
+	m, err := New(db, migrations.Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var username, permission string
+	err = db.QueryRow(`
+		SELECT User.username, Permission.name
+		FROM User
+		JOIN UserPermission ON UserPermission.user_id = User.id
+		JOIN Permission ON Permission.id = UserPermission.permission_id;`).Scan(&username, &permission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "alice" || permission != "admin" {
+		t.Errorf("got %s with %s, want alice with admin", username, permission)
+	}
+
+	var permissions int
+	err = db.QueryRow(`SELECT COUNT(*) FROM Permission;`).Scan(&permissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permissions != 5 {
+		t.Errorf("permissions: got %d, want 5", permissions)
+	}
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if s.AppliedAt.IsZero() {
+			t.Errorf("version %d: got pending, want applied", s.Version)
+		}
+	}
+}
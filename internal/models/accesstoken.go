@@ -0,0 +1,289 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Marks the plaintext of access tokens so that leaked ones are easy to spot
+const AccessTokenPrefix = "wlat_"
+
+type AccessTokenModel struct {
+	db dbtx
+}
+
+// AccessToken lets a script call the API as its user, limited to the
+// permissions chosen when it was created. Only the hash of the plaintext is
+// stored.
+type AccessToken struct {
+	ID        int
+	Plaintext string
+	TokenHash []byte
+	UserID    int
+	Name      string
+	// Permissions the token may use. Permissions later revoked from the user
+	// are excluded when the token is looked up for a request.
+	Permissions Permissions
+	CreatedAt   time.Time
+	Expiry      time.Time
+	LastUsedAt  time.Time
+}
+
+// Hash of a plaintext token, as stored
+func HashAccessToken(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return hash[:]
+}
+
+// Issue a token for the user, scoped to the named permissions. Names the user
+// does not hold are ignored. Must run in a transaction, see WithTx.
+func (m *AccessTokenModel) New(ctx context.Context, userID int, name string, ttl time.Duration, codes Permissions) (*AccessToken, error) {
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &AccessToken{
+		Plaintext: AccessTokenPrefix + secret,
+		UserID:    userID,
+		Name:      name,
+		Expiry:    time.Now().Add(ttl).UTC(),
+	}
+	t.TokenHash = HashAccessToken(t.Plaintext)
+
+	query := `
+		INSERT INTO AccessToken (token_hash, user_id, name, created_at, expiry)
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING id, created_at;`
+
+	args := []any{t.TokenHash, t.UserID, t.Name, time.Now().UTC(), t.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	err = m.db.QueryRowContext(ctx, query, args...).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if len(codes) == 0 {
+		return t, nil
+	}
+
+	query = `
+		INSERT INTO AccessTokenPermission (access_token_id, permission_id)
+		SELECT ?, Permission.id
+		FROM Permission
+		INNER JOIN UserPermission
+		ON UserPermission.permission_id = Permission.id
+		WHERE UserPermission.user_id = ?
+		AND Permission.name IN (` + placeholders(len(codes)) + `)
+		RETURNING (SELECT name FROM Permission WHERE id = permission_id);`
+
+	args = []any{t.ID, t.UserID}
+	for _, code := range codes {
+		args = append(args, code)
+	}
+
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	t.Permissions, err = scanPermissions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(t.Permissions)
+
+	return t, nil
+}
+
+// Get an unexpired token by its plaintext, with the permissions it may use
+// right now: those it was scoped to that the user still holds.
+func (m *AccessTokenModel) GetForPlaintext(ctx context.Context, plaintext string) (*AccessToken, error) {
+	query := `
+		SELECT id, token_hash, user_id, name, created_at, expiry, last_used_at
+		FROM AccessToken
+		WHERE token_hash = ? AND expiry > ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	t, err := scanAccessToken(m.db.QueryRowContext(ctx, query, HashAccessToken(plaintext), time.Now().UTC()))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecord
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	query = `
+		SELECT Permission.name
+		FROM AccessTokenPermission
+		INNER JOIN Permission
+		ON Permission.id = AccessTokenPermission.permission_id
+		INNER JOIN UserPermission
+		ON UserPermission.permission_id = Permission.id
+		AND UserPermission.user_id = ?
+		WHERE AccessTokenPermission.access_token_id = ?
+		ORDER BY Permission.name;`
+
+	rows, err := m.db.QueryContext(ctx, query, t.UserID, t.ID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	t.Permissions, err = scanPermissions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Tokens of the user with the permissions they were scoped to, newest first.
+// Expired tokens are included until they are deleted.
+func (m *AccessTokenModel) GetAllForUser(ctx context.Context, userID int) ([]*AccessToken, error) {
+	query := `
+		SELECT AccessToken.id, token_hash, user_id, AccessToken.name, created_at, expiry, last_used_at,
+		COALESCE(GROUP_CONCAT(Permission.name, ','), '')
+		FROM AccessToken
+		LEFT JOIN AccessTokenPermission
+		ON AccessTokenPermission.access_token_id = AccessToken.id
+		LEFT JOIN Permission
+		ON Permission.id = AccessTokenPermission.permission_id
+		WHERE user_id = ?
+		GROUP BY AccessToken.id
+		ORDER BY AccessToken.id DESC;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	tokens := []*AccessToken{}
+
+	for rows.Next() {
+		var names string
+
+		t, err := scanAccessToken(rows, &names)
+		if err != nil {
+			return nil, translateError(err)
+		}
+
+		if names != "" {
+			t.Permissions = strings.Split(names, ",")
+			slices.Sort(t.Permissions)
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return tokens, nil
+}
+
+// Record that the token was used. To keep writes down, the time is only
+// updated when interval has passed since the last use.
+func (m *AccessTokenModel) Use(ctx context.Context, id int, interval time.Duration) error {
+	query := `
+		UPDATE AccessToken
+		SET last_used_at = ?
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?);`
+
+	now := time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, now, id, now.Add(-interval))
+
+	return translateError(err)
+}
+
+// Revoke a token of the user.
+func (m *AccessTokenModel) Delete(ctx context.Context, id, userID int) error {
+	query := `
+		DELETE FROM AccessToken
+		WHERE id = ? AND user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// Revoke every token of the user.
+func (m *AccessTokenModel) DeleteAllForUser(ctx context.Context, userID int) error {
+	query := `
+		DELETE FROM AccessToken
+		WHERE user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, userID)
+
+	return translateError(err)
+}
+
+func (m *AccessTokenModel) DeleteExpired(ctx context.Context) error {
+	query := `
+		DELETE FROM AccessToken
+		WHERE expiry <= ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, time.Now().UTC())
+
+	return translateError(err)
+}
+
+func scanAccessToken(row rowScanner, extra ...any) (*AccessToken, error) {
+	var t AccessToken
+	var lastUsedAt sql.NullTime
+
+	dest := []any{
+		&t.ID,
+		&t.TokenHash,
+		&t.UserID,
+		&t.Name,
+		&t.CreatedAt,
+		&t.Expiry,
+		&lastUsedAt,
+	}
+
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	t.LastUsedAt = lastUsedAt.Time
+
+	return &t, nil
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	ErrUniqueViolation     = errors.New("models: unique constraint violation")
+	ErrForeignKeyViolation = errors.New("models: foreign key constraint violation")
+	ErrCheckViolation      = errors.New("models: check constraint violation")
+	ErrNotNullViolation    = errors.New("models: not null constraint violation")
+	ErrBusy                = errors.New("models: database is busy")
+)
+
+// ConstraintError reports a statement rejected by a table constraint. Kind is
+// one of the Err*Violation values so callers can match with errors.Is.
+type ConstraintError struct {
+	Kind error
+	// Table and Columns are set for UNIQUE, PRIMARY KEY and NOT NULL
+	// violations. SQLite does not name the columns of a foreign key.
+	Table   string
+	Columns []string
+	// Constraint is the name of a failed CHECK constraint, if known.
+	Constraint string
+	cause      error
+}
+
+func (e *ConstraintError) Error() string {
+	switch {
+	case e.Constraint != "":
+		return fmt.Sprintf("%s: %s", e.Kind, e.Constraint)
+	case e.Table != "":
+		return fmt.Sprintf("%s: %s(%s)", e.Kind, e.Table, strings.Join(e.Columns, ", "))
+	default:
+		return e.Kind.Error()
+	}
+}
+
+func (e *ConstraintError) Unwrap() []error {
+	return []error{e.Kind, e.cause}
+}
+
+// Check if the constraint covers exactly the given table column.
+func (e *ConstraintError) OnColumn(table, column string) bool {
+	return e.Table == table && len(e.Columns) == 1 && e.Columns[0] == column
+}
+
+// Translate go-sqlite3 errors into model errors using the extended result
+// codes. Any other error is returned unchanged.
+func translateError(err error) error {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return fmt.Errorf("%w: %w", ErrBusy, err)
+	case sqlite3.ErrConstraint:
+	default:
+		return err
+	}
+
+	ce := &ConstraintError{cause: err}
+	// Messages look like "UNIQUE constraint failed: User.username"
+	_, detail, _ := strings.Cut(sqliteErr.Error(), "constraint failed: ")
+
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+		ce.Kind = ErrUniqueViolation
+		ce.Table, ce.Columns = parseColumns(detail)
+	case sqlite3.ErrConstraintNotNull:
+		ce.Kind = ErrNotNullViolation
+		ce.Table, ce.Columns = parseColumns(detail)
+	case sqlite3.ErrConstraintForeignKey:
+		ce.Kind = ErrForeignKeyViolation
+	case sqlite3.ErrConstraintCheck:
+		ce.Kind = ErrCheckViolation
+		ce.Constraint = detail
+	default:
+		return err
+	}
+
+	return ce
+}
+
+// Parse "Table.a, Table.b" into the table name and its columns
+func parseColumns(detail string) (string, []string) {
+	if detail == "" {
+		return "", nil
+	}
+
+	var table string
+	var columns []string
+
+	for _, field := range strings.Split(detail, ", ") {
+		t, column, ok := strings.Cut(field, ".")
+		if !ok {
+			continue
+		}
+
+		table = t
+		columns = append(columns, column)
+	}
+
+	return table, columns
+}
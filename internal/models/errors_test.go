@@ -0,0 +1,208 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestUserConstraints(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestModels(t)
+
+	alice := &User{Username: "alice", Email: "alice@example.com"}
+	err := m.User.SetPassword(alice, "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.User.Insert(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob := newTestUser(t, m, "bob")
+
+	tests := []struct {
+		name string
+		run  func() error
+		want error
+	}{
+		{
+			name: "insert duplicate username",
+			run: func() error {
+				_, err := m.User.New(ctx, "alice", "password123")
+				return err
+			},
+			want: ErrDuplicateUsername,
+		},
+		{
+			name: "insert duplicate email",
+			run: func() error {
+				u := &User{Username: "carol", Email: "alice@example.com", PasswordHash: alice.PasswordHash}
+				return m.User.Insert(ctx, u)
+			},
+			want: ErrDuplicateEmail,
+		},
+		{
+			name: "update to taken username",
+			run: func() error {
+				u := *bob
+				u.Username = "alice"
+				return m.User.Update(ctx, &u)
+			},
+			want: ErrDuplicateUsername,
+		},
+		{
+			name: "update to taken email",
+			run: func() error {
+				u := *bob
+				u.Email = "alice@example.com"
+				return m.User.Update(ctx, &u)
+			},
+			want: ErrDuplicateEmail,
+		},
+		{
+			name: "update stale version",
+			run: func() error {
+				u := *bob
+				u.Version++
+				return m.User.Update(ctx, &u)
+			},
+			want: ErrEditConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityConstraints(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestModels(t)
+
+	user := newTestUser(t, m, "alice")
+
+	err := m.Identity.Insert(ctx, &Identity{UserID: user.ID, Issuer: "https://idp", Subject: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Identity.Insert(ctx, &Identity{UserID: user.ID, Issuer: "https://idp", Subject: "1"})
+	if !errors.Is(err, ErrDuplicateIdentity) {
+		t.Errorf("duplicate identity: got %v, want %v", err, ErrDuplicateIdentity)
+	}
+
+	err = m.Identity.Insert(ctx, &Identity{UserID: user.ID + 100, Issuer: "https://idp", Subject: "2"})
+	if !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("unknown user: got %v, want %v", err, ErrForeignKeyViolation)
+	}
+}
+
+func TestTranslateError(t *testing.T) {
+	ctx := context.Background()
+	m, db := newTestModels(t)
+
+	user := newTestUser(t, m, "alice")
+
+	_, err := db.Exec(`CREATE TABLE Checked (n INTEGER CONSTRAINT positive CHECK (n > 0));`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		args    []any
+		kind    error
+		table   string
+		columns []string
+	}{
+		{
+			name:    "unique",
+			query:   `INSERT INTO User (username, password) VALUES (?, 'x');`,
+			args:    []any{"alice"},
+			kind:    ErrUniqueViolation,
+			table:   "User",
+			columns: []string{"username"},
+		},
+		{
+			name:    "composite primary key",
+			query:   `INSERT INTO UserPermission (user_id, permission_id) SELECT ?, id FROM Permission WHERE name = 'admin';`,
+			args:    []any{user.ID},
+			kind:    ErrUniqueViolation,
+			table:   "UserPermission",
+			columns: []string{"user_id", "permission_id"},
+		},
+		{
+			name:    "not null",
+			query:   `INSERT INTO User (username, password) VALUES (NULL, 'x');`,
+			kind:    ErrNotNullViolation,
+			table:   "User",
+			columns: []string{"username"},
+		},
+		{
+			name:  "foreign key",
+			query: `INSERT INTO UserPermission (user_id, permission_id) VALUES (?, 12345);`,
+			args:  []any{user.ID},
+			kind:  ErrForeignKeyViolation,
+		},
+		{
+			name:  "check",
+			query: `INSERT INTO Checked (n) VALUES (0);`,
+			kind:  ErrCheckViolation,
+		},
+	}
+
+	err = m.Permission.Grant(ctx, user.ID, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := db.Exec(tt.query, tt.args...)
+			err = translateError(err)
+
+			if !errors.Is(err, tt.kind) {
+				t.Fatalf("got %v, want %v", err, tt.kind)
+			}
+
+			var ce *ConstraintError
+			if !errors.As(err, &ce) {
+				t.Fatalf("got %T, want *ConstraintError", err)
+			}
+
+			if ce.Table != tt.table || !slices.Equal(ce.Columns, tt.columns) {
+				t.Errorf("got %s(%v), want %s(%v)", ce.Table, ce.Columns, tt.table, tt.columns)
+			}
+		})
+	}
+
+	t.Run("check constraint name", func(t *testing.T) {
+		_, err := db.Exec(`INSERT INTO Checked (n) VALUES (-1);`)
+
+		var ce *ConstraintError
+		if !errors.As(translateError(err), &ce) || ce.Constraint != "positive" {
+			t.Errorf("got %v, want constraint positive", err)
+		}
+	})
+
+	t.Run("other errors unchanged", func(t *testing.T) {
+		want := errors.New("other")
+		if got := translateError(want); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		if got := translateError(nil); got != nil {
+			t.Errorf("got %v, want nil", got)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package models
+
+import "math"
+
+// Filters holds the pagination of a list query.
+type Filters struct {
+	Page     int
+	PageSize int
+}
+
+func (f Filters) limit() int {
+	return f.PageSize
+}
+
+func (f Filters) offset() int {
+	return (f.Page - 1) * f.PageSize
+}
+
+// Metadata describes the page returned by a list query.
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records"`
+}
+
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
+
+// Pages that come before and after the current one, zero if none.
+func (m Metadata) PrevPage() int {
+	if m.CurrentPage <= m.FirstPage {
+		return 0
+	}
+
+	return m.CurrentPage - 1
+}
+
+func (m Metadata) NextPage() int {
+	if m.CurrentPage >= m.LastPage {
+		return 0
+	}
+
+	return m.CurrentPage + 1
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type IdentityModel struct {
+	db dbtx
+}
+
+// Identity is an account at an external identity provider that the user can
+// log in with
+type Identity struct {
+	ID      int
+	UserID  int
+	Issuer  string
+	Subject string
+	// Email or username at the provider, for display only
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// Link the identity to its user. Returns ErrDuplicateIdentity if it is
+// already linked, to this or another user.
+func (m *IdentityModel) Insert(ctx context.Context, i *Identity) error {
+	query := `
+		INSERT INTO Identity (user_id, issuer, subject, name, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING id, created_at;`
+
+	args := []any{i.UserID, i.Issuer, i.Subject, i.Name, time.Now().UTC()}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	err := m.db.QueryRowContext(ctx, query, args...).Scan(&i.ID, &i.CreatedAt)
+	if err != nil {
+		err = translateError(err)
+
+		if errors.Is(err, ErrUniqueViolation) {
+			return ErrDuplicateIdentity
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Identities linked to the user, oldest first.
+func (m *IdentityModel) GetAllForUser(ctx context.Context, userID int) ([]*Identity, error) {
+	query := `
+		SELECT id, user_id, issuer, subject, name, created_at, last_used_at
+		FROM Identity
+		WHERE user_id = ?
+		ORDER BY id;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+
+	for rows.Next() {
+		i, err := scanIdentity(rows)
+		if err != nil {
+			return nil, translateError(err)
+		}
+
+		identities = append(identities, i)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return identities, nil
+}
+
+func (m *IdentityModel) GetWithSubject(ctx context.Context, issuer, subject string) (*Identity, error) {
+	query := `
+		SELECT id, user_id, issuer, subject, name, created_at, last_used_at
+		FROM Identity
+		WHERE issuer = ? AND subject = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	i, err := scanIdentity(m.db.QueryRowContext(ctx, query, issuer, subject))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecord
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	return i, nil
+}
+
+// Record a login with the identity.
+func (m *IdentityModel) Use(ctx context.Context, id int) error {
+	query := `
+		UPDATE Identity
+		SET last_used_at = ?
+		WHERE id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, time.Now().UTC(), id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// Unlink an identity of the user.
+func (m *IdentityModel) Delete(ctx context.Context, id, userID int) error {
+	query := `
+		DELETE FROM Identity
+		WHERE id = ? AND user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+func scanIdentity(row rowScanner) (*Identity, error) {
+	var i Identity
+	var lastUsedAt sql.NullTime
+
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Issuer,
+		&i.Subject,
+		&i.Name,
+		&i.CreatedAt,
+		&lastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	i.LastUsedAt = lastUsedAt.Time
+
+	return &i, nil
+}
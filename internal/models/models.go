@@ -1,26 +1,101 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
+
+	"github.com/alexedwards/argon2id"
 )
 
+// Upper bound for every query. Callers pass their own context, usually
+// derived from the request, which may be cancelled sooner.
 const ctxTimeout = 3 * time.Second
 
+// dbtx is satisfied by both *sql.DB and *sql.Tx so models can run inside a
+// transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type Models struct {
-	User *UserModel
+	// Nil when the models are bound to a transaction
+	db     *sql.DB
+	hasher *passwordHasher
+
+	AccessToken   *AccessTokenModel
+	Identity      *IdentityModel
+	LoginThrottle *LoginThrottleModel
+	Passkey       *PasskeyModel
+	Permission    *PermissionModel
+	RateLimit     *RateLimitModel
+	RememberToken *RememberTokenModel
+	Token         *TokenModel
+	TwoFactor     *TwoFactorModel
+	User          *UserModel
+	UserSession   *UserSessionModel
 }
 
-func New(db *sql.DB) Models {
+// Create the models. New passwords are hashed with params, or
+// argon2id.DefaultParams if nil.
+func New(db *sql.DB, params *argon2id.Params) Models {
+	m := newModels(db, newPasswordHasher(params))
+	m.db = db
+
+	return m
+}
+
+func newModels(db dbtx, hasher *passwordHasher) Models {
 	return Models{
-		User: &UserModel{db},
+		hasher:        hasher,
+		AccessToken:   &AccessTokenModel{db},
+		Identity:      &IdentityModel{db},
+		LoginThrottle: &LoginThrottleModel{db},
+		Passkey:       &PasskeyModel{db},
+		Permission:    &PermissionModel{db},
+		RateLimit:     &RateLimitModel{db},
+		RememberToken: &RememberTokenModel{db},
+		Token:         &TokenModel{db},
+		TwoFactor:     &TwoFactorModel{db},
+		User:          &UserModel{db, hasher},
+		UserSession:   &UserSessionModel{db},
+	}
+}
+
+// Run fn with models bound to a single transaction. The transaction commits
+// if fn returns nil and rolls back otherwise. Calling WithTx on models that
+// are already bound to a transaction runs fn in that transaction.
+func (m Models) WithTx(ctx context.Context, fn func(Models) error) error {
+	if m.db == nil {
+		return fn(m)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+	defer tx.Rollback()
+
+	err = fn(newModels(tx, m.hasher))
+	if err != nil {
+		return err
 	}
+
+	return translateError(tx.Commit())
 }
 
 var (
-	ErrNoRecord           = errors.New("models: no matching record found")
-	ErrInvalidCredentials = errors.New("models: invalid credentials")
-	ErrDuplicateUsername  = errors.New("models: duplicate username")
-	ErrEditConflict       = errors.New("models: edit conflict")
+	ErrNoRecord            = errors.New("models: no matching record found")
+	ErrInvalidCredentials  = errors.New("models: invalid credentials")
+	ErrDuplicateUsername   = errors.New("models: duplicate username")
+	ErrDuplicateEmail      = errors.New("models: duplicate email")
+	ErrEditConflict        = errors.New("models: edit conflict")
+	ErrDuplicateCredential = errors.New("models: duplicate credential")
+	ErrDuplicateIdentity   = errors.New("models: duplicate identity")
 )
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/micahco/web-lite/internal/migrate"
+	"github.com/micahco/web-lite/migrations"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Cheap enough to hash a password per test
+var testPasswordParams = &argon2id.Params{
+	Memory:      64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Open a migrated in-memory database, closed when the test ends.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// Each connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+
+	m, err := migrate.New(db, migrations.Files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func newTestModels(t *testing.T) (Models, *sql.DB) {
+	t.Helper()
+
+	db := newTestDB(t)
+
+	return New(db, testPasswordParams), db
+}
+
+func newTestUser(t *testing.T, m Models, username string) *User {
+	t.Helper()
+
+	user, err := m.User.New(context.Background(), username, "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
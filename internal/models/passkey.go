@@ -0,0 +1,229 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+type PasskeyModel struct {
+	db dbtx
+}
+
+// Passkey is a WebAuthn credential registered by a user
+type Passkey struct {
+	ID           int
+	UserID       int
+	CredentialID []byte
+	PublicKey    []byte
+	SignCount    uint32
+	Name         string
+	CreatedAt    time.Time
+	LastUsedAt   time.Time
+	// Incremented on every rename for optimistic concurrency control
+	Version int
+}
+
+var passkeyNameRules = []validation.Rule{validation.Required, validation.Length(1, 64)}
+
+func (p Passkey) Validate() error {
+	return validation.ValidateStruct(&p,
+		validation.Field(&p.CredentialID, validation.Required),
+		validation.Field(&p.PublicKey, validation.Required),
+		validation.Field(&p.Name, passkeyNameRules...))
+}
+
+func (m *PasskeyModel) Insert(ctx context.Context, p *Passkey) error {
+	err := p.Validate()
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO Passkey (user_id, credential_id, public_key, sign_count, name, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id, created_at, version;`
+
+	args := []any{p.UserID, p.CredentialID, p.PublicKey, p.SignCount, p.Name, time.Now().UTC()}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	err = m.db.QueryRowContext(ctx, query, args...).Scan(&p.ID, &p.CreatedAt, &p.Version)
+	if err != nil {
+		err = translateError(err)
+
+		var ce *ConstraintError
+		switch {
+		case errors.As(err, &ce) && ce.OnColumn("Passkey", "credential_id"):
+			return ErrDuplicateCredential
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Passkeys of the user, oldest first.
+func (m *PasskeyModel) GetAllForUser(ctx context.Context, userID int) ([]*Passkey, error) {
+	query := `
+		SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at, version
+		FROM Passkey
+		WHERE user_id = ?
+		ORDER BY id;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, translateError(err)
+		}
+
+		passkeys = append(passkeys, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return passkeys, nil
+}
+
+func (m *PasskeyModel) GetWithCredentialID(ctx context.Context, credentialID []byte) (*Passkey, error) {
+	query := `
+		SELECT id, user_id, credential_id, public_key, sign_count, name, created_at, last_used_at, version
+		FROM Passkey
+		WHERE credential_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	p, err := scanPasskey(m.db.QueryRowContext(ctx, query, credentialID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecord
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	return p, nil
+}
+
+// Rename the passkey if it has not been modified since it was read. The name
+// is the only field that can change. Returns ErrEditConflict if the stored
+// version no longer matches p.Version.
+func (m *PasskeyModel) Update(ctx context.Context, p *Passkey) error {
+	err := validation.Validate(p.Name, passkeyNameRules...)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE Passkey
+		SET name = ?, version = version + 1
+		WHERE id = ? AND user_id = ? AND version = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, p.Name, p.ID, p.UserID, p.Version)
+	if err != nil {
+		return translateError(err)
+	}
+
+	err = checkRowsAffected(result)
+	if err != nil {
+		if errors.Is(err, ErrNoRecord) {
+			return ErrEditConflict
+		}
+
+		return err
+	}
+
+	p.Version++
+
+	return nil
+}
+
+// Record a successful assertion. The counter only moves from the value that
+// was verified against, so two concurrent logins with the same counter
+// cannot both succeed. Returns ErrNoRecord if it already moved.
+func (m *PasskeyModel) Use(ctx context.Context, id int, oldSignCount, newSignCount uint32) error {
+	query := `
+		UPDATE Passkey
+		SET sign_count = ?, last_used_at = ?
+		WHERE id = ? AND sign_count = ?;`
+
+	args := []any{newSignCount, time.Now().UTC(), id, oldSignCount}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// Delete a passkey owned by the user.
+func (m *PasskeyModel) Delete(ctx context.Context, id, userID int) error {
+	query := `
+		DELETE FROM Passkey
+		WHERE id = ? AND user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPasskey(row rowScanner) (*Passkey, error) {
+	var p Passkey
+	var lastUsedAt sql.NullTime
+
+	err := row.Scan(
+		&p.ID,
+		&p.UserID,
+		&p.CredentialID,
+		&p.PublicKey,
+		&p.SignCount,
+		&p.Name,
+		&p.CreatedAt,
+		&lastUsedAt,
+		&p.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p.LastUsedAt = lastUsedAt.Time
+
+	return &p, nil
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnsupportedHash = errors.New("models: unsupported password hash")
+
+// passwordHasher hashes new passwords with the configured argon2id parameters
+// and verifies hashes made with older parameters or imported from bcrypt.
+type passwordHasher struct {
+	params *argon2id.Params
+	// Compared against when the username does not exist, so that unknown
+	// users take as long to reject as wrong passwords
+	dummyHash string
+}
+
+func newPasswordHasher(params *argon2id.Params) *passwordHasher {
+	if params == nil {
+		params = argon2id.DefaultParams
+	}
+
+	dummyHash, err := argon2id.CreateHash("not a real password", params)
+	if err != nil {
+		panic(err)
+	}
+
+	return &passwordHasher{params: params, dummyHash: dummyHash}
+}
+
+func (h *passwordHasher) hash(password string) (string, error) {
+	return argon2id.CreateHash(password, h.params)
+}
+
+func (h *passwordHasher) compare(password, hash string) (bool, error) {
+	if isBcryptHash(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	return argon2id.ComparePasswordAndHash(password, hash)
+}
+
+// Check if the hash is weaker than one made with the current parameters.
+// bcrypt hashes are always upgraded.
+func (h *passwordHasher) outdated(hash string) bool {
+	if isBcryptHash(hash) {
+		return true
+	}
+
+	params, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory < h.params.Memory ||
+		params.Iterations < h.params.Iterations ||
+		params.SaltLength < h.params.SaltLength ||
+		params.KeyLength < h.params.KeyLength
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+// Check that a hash imported from another system can be verified at login.
+// Accepts argon2id and bcrypt hashes.
+func ValidatePasswordHash(hash string) error {
+	if isBcryptHash(hash) {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return ErrUnsupportedHash
+		}
+
+		return nil
+	}
+
+	_, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return ErrUnsupportedHash
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+)
+
+type PermissionModel struct {
+	db dbtx
+}
+
+// Permissions is a set of permission names, e.g. "admin" or "logs".
+type Permissions []string
+
+func (p Permissions) Include(code string) bool {
+	return slices.Contains(p, code)
+}
+
+// List every permission that can be granted.
+func (m *PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	query := `
+		SELECT name
+		FROM Permission
+		ORDER BY name;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	return scanPermissions(rows)
+}
+
+// List the permissions granted to a user.
+func (m *PermissionModel) GetAllForUser(ctx context.Context, userID int) (Permissions, error) {
+	query := `
+		SELECT Permission.name
+		FROM Permission
+		INNER JOIN UserPermission
+		ON UserPermission.permission_id = Permission.id
+		WHERE UserPermission.user_id = ?
+		ORDER BY Permission.name;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	return scanPermissions(rows)
+}
+
+// Grant the named permissions to a user. Permissions the user already holds
+// are left untouched and unknown names are ignored.
+func (m *PermissionModel) Grant(ctx context.Context, userID int, codes ...string) error {
+	if len(codes) == 0 {
+		return nil
+	}
+
+	query := `
+		INSERT INTO UserPermission (user_id, permission_id)
+		SELECT ?, id
+		FROM Permission
+		WHERE name IN (` + placeholders(len(codes)) + `)
+		ON CONFLICT DO NOTHING;`
+
+	args := []any{userID}
+	for _, code := range codes {
+		args = append(args, code)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, args...)
+
+	return translateError(err)
+}
+
+// Revoke the named permissions from a user.
+func (m *PermissionModel) Revoke(ctx context.Context, userID int, codes ...string) error {
+	if len(codes) == 0 {
+		return nil
+	}
+
+	query := `
+		DELETE FROM UserPermission
+		WHERE user_id = ?
+		AND permission_id IN (
+			SELECT id
+			FROM Permission
+			WHERE name IN (` + placeholders(len(codes)) + `)
+		);`
+
+	args := []any{userID}
+	for _, code := range codes {
+		args = append(args, code)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, args...)
+
+	return translateError(err)
+}
+
+// Check if a user holds the named permission.
+func (m *PermissionModel) Check(ctx context.Context, userID int, code string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM UserPermission
+			INNER JOIN Permission
+			ON UserPermission.permission_id = Permission.id
+			WHERE UserPermission.user_id = ?
+			AND Permission.name = ?
+		);`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var exists bool
+	err := m.db.QueryRowContext(ctx, query, userID, code).Scan(&exists)
+	if err != nil {
+		return false, translateError(err)
+	}
+
+	return exists, nil
+}
+
+// Count the users that hold the named permission.
+func (m *PermissionModel) CountHolders(ctx context.Context, code string) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM UserPermission
+		INNER JOIN Permission
+		ON UserPermission.permission_id = Permission.id
+		WHERE Permission.name = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var n int
+	err := m.db.QueryRowContext(ctx, query, code).Scan(&n)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return n, nil
+}
+
+// List the permissions whose holders must use two-factor authentication.
+func (m *PermissionModel) GetAllRequiringTwoFactor(ctx context.Context) (Permissions, error) {
+	query := `
+		SELECT name
+		FROM Permission
+		WHERE requires_two_factor = 1
+		ORDER BY name;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	return scanPermissions(rows)
+}
+
+func (m *PermissionModel) SetRequiresTwoFactor(ctx context.Context, code string, required bool) error {
+	query := `
+		UPDATE Permission
+		SET requires_two_factor = ?
+		WHERE name = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, required, code)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// Check if the user holds any permission that requires two-factor
+// authentication.
+func (m *PermissionModel) RequiresTwoFactor(ctx context.Context, userID int) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM UserPermission
+			INNER JOIN Permission
+			ON UserPermission.permission_id = Permission.id
+			WHERE UserPermission.user_id = ?
+			AND Permission.requires_two_factor = 1
+		);`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var required bool
+	err := m.db.QueryRowContext(ctx, query, userID).Scan(&required)
+	if err != nil {
+		return false, translateError(err)
+	}
+
+	return required, nil
+}
+
+func scanPermissions(rows *sql.Rows) (Permissions, error) {
+	var permissions Permissions
+
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, translateError(err)
+		}
+
+		permissions = append(permissions, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return permissions, nil
+}
+
+// Comma separated list of n query placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
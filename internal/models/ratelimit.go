@@ -0,0 +1,52 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+type RateLimitModel struct {
+	db dbtx
+}
+
+// Count a request against key and return the number counted in the current
+// window, this one included, and the end of that window. A window starts
+// with the first request after the previous one ended.
+func (m *RateLimitModel) Hit(ctx context.Context, key string, window time.Duration) (int, time.Time, error) {
+	query := `
+		INSERT INTO RateLimit (key, hits, expires_at)
+		VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE
+		SET hits = CASE WHEN expires_at <= ? THEN 1 ELSE hits + 1 END,
+		expires_at = CASE WHEN expires_at <= ? THEN excluded.expires_at ELSE expires_at END
+		RETURNING hits, expires_at;`
+
+	now := time.Now().UTC()
+	args := []any{key, now.Add(window), now, now}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var hits int
+	var expiresAt time.Time
+	err := m.db.QueryRowContext(ctx, query, args...).Scan(&hits, &expiresAt)
+	if err != nil {
+		return 0, time.Time{}, translateError(err)
+	}
+
+	return hits, expiresAt, nil
+}
+
+// Delete the counts of windows that have ended.
+func (m *RateLimitModel) DeleteExpired(ctx context.Context) error {
+	query := `
+		DELETE FROM RateLimit
+		WHERE expires_at <= ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, time.Now().UTC())
+
+	return translateError(err)
+}
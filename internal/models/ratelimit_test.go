@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimitHit(t *testing.T) {
+	ctx := context.Background()
+	m, db := newTestModels(t)
+
+	start := time.Now()
+
+	var end time.Time
+	for want := 1; want <= 3; want++ {
+		hits, expiresAt, err := m.RateLimit.Hit(ctx, "a", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hits != want {
+			t.Errorf("got %d hits, want %d", hits, want)
+		}
+
+		// Later hits do not move the end of the window
+		if end.IsZero() {
+			end = expiresAt
+		} else if !expiresAt.Equal(end) {
+			t.Errorf("window ends at %v, want %v", expiresAt, end)
+		}
+	}
+
+	if end.Before(start.Add(time.Hour)) || end.After(time.Now().Add(time.Hour)) {
+		t.Errorf("window ends at %v, want an hour from now", end)
+	}
+
+	hits, _, err := m.RateLimit.Hit(ctx, "b", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hits != 1 {
+		t.Errorf("other key: got %d hits, want 1", hits)
+	}
+
+	// A new window starts once the last one has ended
+	_, err = db.Exec("UPDATE RateLimit SET expires_at = ? WHERE key = 'a';", time.Now().UTC().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits, expiresAt, err := m.RateLimit.Hit(ctx, "a", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hits != 1 || !expiresAt.After(time.Now()) {
+		t.Errorf("after the window: got %d hits until %v, want 1 until an hour from now", hits, expiresAt)
+	}
+
+	_, err = db.Exec("UPDATE RateLimit SET expires_at = ? WHERE key = 'b';", time.Now().UTC().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.RateLimit.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	rows, err := db.Query("SELECT key FROM RateLimit;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("got keys %v after deleting expired, want [a]", keys)
+	}
+}
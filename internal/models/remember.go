@@ -0,0 +1,214 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+type RememberTokenModel struct {
+	db dbtx
+}
+
+// RememberToken keeps a device logged in. The plaintext is
+// "selector.validator": the selector finds the token and only the hash of
+// the validator is stored. Tokens issued by rotating one another share a
+// family.
+type RememberToken struct {
+	Plaintext     string
+	Selector      string
+	ValidatorHash []byte
+	UserID        int
+	Family        string
+	Expiry        time.Time
+	UsedAt        time.Time
+}
+
+func (t RememberToken) Used() bool {
+	return !t.UsedAt.IsZero()
+}
+
+// Check the validator half of a plaintext token in constant time.
+func (t RememberToken) Matches(validator string) bool {
+	hash := sha256.Sum256([]byte(validator))
+
+	return subtle.ConstantTimeCompare(hash[:], t.ValidatorHash) == 1
+}
+
+// Split a plaintext token into its selector and validator.
+func ParseRememberToken(plaintext string) (selector, validator string, ok bool) {
+	selector, validator, ok = strings.Cut(plaintext, ".")
+	if !ok || selector == "" || validator == "" {
+		return "", "", false
+	}
+
+	return selector, validator, true
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Issue a token for the user. An empty family starts a new one.
+func (m *RememberTokenModel) New(ctx context.Context, userID int, family string, ttl time.Duration) (*RememberToken, error) {
+	selector, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	validator, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	if family == "" {
+		family, err = randomString(16)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hash := sha256.Sum256([]byte(validator))
+
+	t := &RememberToken{
+		Plaintext:     selector + "." + validator,
+		Selector:      selector,
+		ValidatorHash: hash[:],
+		UserID:        userID,
+		Family:        family,
+		Expiry:        time.Now().Add(ttl).UTC(),
+	}
+
+	query := `
+		INSERT INTO RememberToken (selector, validator_hash, user_id, family, expiry)
+		VALUES (?, ?, ?, ?, ?);`
+
+	args := []any{t.Selector, t.ValidatorHash, t.UserID, t.Family, t.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err = m.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return t, nil
+}
+
+// Get an unexpired token, used or not.
+func (m *RememberTokenModel) Get(ctx context.Context, selector string) (*RememberToken, error) {
+	query := `
+		SELECT selector, validator_hash, user_id, family, expiry, used_at
+		FROM RememberToken
+		WHERE selector = ? AND expiry > ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var t RememberToken
+	var usedAt sql.NullTime
+	err := m.db.QueryRowContext(ctx, query, selector, time.Now().UTC()).Scan(
+		&t.Selector,
+		&t.ValidatorHash,
+		&t.UserID,
+		&t.Family,
+		&t.Expiry,
+		&usedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecord
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	t.UsedAt = usedAt.Time
+
+	return &t, nil
+}
+
+// Mark the token as used. Returns ErrNoRecord if it already was.
+func (m *RememberTokenModel) Use(ctx context.Context, selector string) error {
+	query := `
+		UPDATE RememberToken
+		SET used_at = ?
+		WHERE selector = ? AND used_at IS NULL;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, time.Now().UTC(), selector)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+func (m *RememberTokenModel) DeleteFamily(ctx context.Context, family string) error {
+	query := `
+		DELETE FROM RememberToken
+		WHERE family = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, family)
+
+	return translateError(err)
+}
+
+func (m *RememberTokenModel) DeleteAllForUser(ctx context.Context, userID int) error {
+	query := `
+		DELETE FROM RememberToken
+		WHERE user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, userID)
+
+	return translateError(err)
+}
+
+func (m *RememberTokenModel) DeleteExpired(ctx context.Context) error {
+	query := `
+		DELETE FROM RememberToken
+		WHERE expiry <= ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, time.Now().UTC())
+
+	return translateError(err)
+}
+
+// Delete the tokens of every other device of the user.
+func (m *RememberTokenModel) DeleteAllForUserExcept(ctx context.Context, userID int, family string) error {
+	query := `
+		DELETE FROM RememberToken
+		WHERE user_id = ? AND family != ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, userID, family)
+
+	return translateError(err)
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRememberTokenUse(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestModels(t)
+	user := newTestUser(t, m, "alice")
+
+	token, err := m.RememberToken.New(ctx, user.ID, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selector, validator, ok := ParseRememberToken(token.Plaintext)
+	if !ok || selector != token.Selector {
+		t.Fatalf("got selector %q, %v, want %q, true", selector, ok, token.Selector)
+	}
+
+	got, err := m.RememberToken.Get(ctx, selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.Matches(validator) || got.Matches(validator+"x") {
+		t.Error("validator does not match only itself")
+	}
+
+	if got.Used() {
+		t.Error("new token is used")
+	}
+
+	err = m.RememberToken.Use(ctx, selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of two concurrent rotations wins
+	err = m.RememberToken.Use(ctx, selector)
+	if !errors.Is(err, ErrNoRecord) {
+		t.Errorf("used twice: got %v, want %v", err, ErrNoRecord)
+	}
+
+	got, err = m.RememberToken.Get(ctx, selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.Used() || time.Since(got.UsedAt) > time.Minute {
+		t.Errorf("got used at %v, want now", got.UsedAt)
+	}
+
+	rotated, err := m.RememberToken.New(ctx, user.ID, token.Family, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated.Family != token.Family {
+		t.Errorf("rotated family: got %q, want %q", rotated.Family, token.Family)
+	}
+}
+
+func TestRememberTokenDelete(t *testing.T) {
+	ctx := context.Background()
+	m, db := newTestModels(t)
+	alice := newTestUser(t, m, "alice")
+	bob := newTestUser(t, m, "bob")
+
+	newToken := func(userID int, family string) *RememberToken {
+		t.Helper()
+
+		token, err := m.RememberToken.New(ctx, userID, family, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return token
+	}
+
+	exists := func(token *RememberToken) bool {
+		t.Helper()
+
+		_, err := m.RememberToken.Get(ctx, token.Selector)
+		switch {
+		case errors.Is(err, ErrNoRecord):
+			return false
+		case err != nil:
+			t.Fatal(err)
+		}
+
+		return true
+	}
+
+	phone := newToken(alice.ID, "")
+	phoneRotated := newToken(alice.ID, phone.Family)
+	laptop := newToken(alice.ID, "")
+	tablet := newToken(alice.ID, "")
+	bobs := newToken(bob.ID, "")
+
+	err := m.RememberToken.DeleteFamily(ctx, phone.Family)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(phone) || exists(phoneRotated) {
+		t.Error("delete family: token of the family kept")
+	}
+
+	if !exists(laptop) {
+		t.Error("delete family: token of another family deleted")
+	}
+
+	err = m.RememberToken.DeleteAllForUserExcept(ctx, alice.ID, laptop.Family)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists(laptop) || exists(tablet) {
+		t.Error("delete all except: got the wrong tokens deleted")
+	}
+
+	err = m.RememberToken.DeleteAllForUser(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists(laptop) {
+		t.Error("delete all: token kept")
+	}
+
+	if !exists(bobs) {
+		t.Error("token of another user deleted")
+	}
+
+	_, err = db.Exec("UPDATE RememberToken SET expiry = ?;", time.Now().UTC().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired tokens cannot be used even before they are deleted
+	if exists(bobs) {
+		t.Error("got an expired token")
+	}
+
+	err = m.RememberToken.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM RememberToken;").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 0 {
+		t.Errorf("got %d tokens after deleting expired ones, want 0", count)
+	}
+}
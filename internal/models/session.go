@@ -0,0 +1,204 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Longest user agent stored
+const maxUserAgentLength = 256
+
+type UserSessionModel struct {
+	db dbtx
+}
+
+// UserSession is a device the user is logged in on
+type UserSession struct {
+	ID         int
+	UserID     int
+	TokenHash  []byte
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	Expiry     time.Time
+	IP         string
+	UserAgent  string
+}
+
+// Hash of a session token, as stored in the index
+func HashSessionToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+
+	return hash[:]
+}
+
+// Record that the session was seen. To keep writes down, a known session is
+// only updated when interval has passed since it was last seen or the client
+// IP changed.
+func (m *UserSessionModel) Touch(ctx context.Context, s *UserSession, interval time.Duration) error {
+	if len(s.UserAgent) > maxUserAgentLength {
+		s.UserAgent = s.UserAgent[:maxUserAgentLength]
+	}
+
+	query := `
+		INSERT INTO UserSession (token_hash, user_id, created_at, last_seen_at, expiry, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (token_hash) DO UPDATE
+		SET last_seen_at = excluded.last_seen_at,
+		expiry = excluded.expiry,
+		ip = excluded.ip,
+		user_agent = excluded.user_agent
+		WHERE last_seen_at < ? OR ip != excluded.ip;`
+
+	now := time.Now().UTC()
+	args := []any{s.TokenHash, s.UserID, now, now, s.Expiry.UTC(), s.IP, s.UserAgent, now.Add(-interval)}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, args...)
+
+	return translateError(err)
+}
+
+// Unexpired sessions of the user, most recently seen first.
+func (m *UserSessionModel) GetAllForUser(ctx context.Context, userID int) ([]*UserSession, error) {
+	query := `
+		SELECT id, user_id, token_hash, created_at, last_seen_at, expiry, ip, user_agent
+		FROM UserSession
+		WHERE user_id = ? AND expiry > ?
+		ORDER BY last_seen_at DESC;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query, userID, time.Now().UTC())
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	sessions := []*UserSession{}
+
+	for rows.Next() {
+		s, err := scanUserSession(rows)
+		if err != nil {
+			return nil, translateError(err)
+		}
+
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return sessions, nil
+}
+
+// Get a session of the user.
+func (m *UserSessionModel) GetForUser(ctx context.Context, id, userID int) (*UserSession, error) {
+	query := `
+		SELECT id, user_id, token_hash, created_at, last_seen_at, expiry, ip, user_agent
+		FROM UserSession
+		WHERE id = ? AND user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	s, err := scanUserSession(m.db.QueryRowContext(ctx, query, id, userID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecord
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	return s, nil
+}
+
+// Token hashes of every indexed session of the user, expired or not.
+func (m *UserSessionModel) GetTokenHashesForUser(ctx context.Context, userID int) ([][]byte, error) {
+	query := `
+		SELECT token_hash
+		FROM UserSession
+		WHERE user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	defer rows.Close()
+
+	var hashes [][]byte
+
+	for rows.Next() {
+		var hash []byte
+
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, translateError(err)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, translateError(err)
+	}
+
+	return hashes, nil
+}
+
+func (m *UserSessionModel) Delete(ctx context.Context, tokenHash []byte) error {
+	query := `
+		DELETE FROM UserSession
+		WHERE token_hash = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, tokenHash)
+
+	return translateError(err)
+}
+
+func (m *UserSessionModel) DeleteExpired(ctx context.Context) error {
+	query := `
+		DELETE FROM UserSession
+		WHERE expiry <= ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, time.Now().UTC())
+
+	return translateError(err)
+}
+
+func scanUserSession(row rowScanner) (*UserSession, error) {
+	var s UserSession
+
+	err := row.Scan(
+		&s.ID,
+		&s.UserID,
+		&s.TokenHash,
+		&s.CreatedAt,
+		&s.LastSeenAt,
+		&s.Expiry,
+		&s.IP,
+		&s.UserAgent,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
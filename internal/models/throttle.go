@@ -0,0 +1,168 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type LoginThrottleModel struct {
+	db dbtx
+}
+
+// LoginThrottle counts failed logins against a key, such as a client IP or a
+// username.
+type LoginThrottle struct {
+	Key          string
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+}
+
+func (t LoginThrottle) Blocked() bool {
+	return t.BlockedUntil.After(time.Now())
+}
+
+func (m *LoginThrottleModel) Get(ctx context.Context, key string) (*LoginThrottle, error) {
+	query := `
+		SELECT key, failures, last_failure, blocked_until
+		FROM LoginThrottle
+		WHERE key = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var t LoginThrottle
+	var blockedUntil sql.NullTime
+	err := m.db.QueryRowContext(ctx, query, key).Scan(
+		&t.Key,
+		&t.Failures,
+		&t.LastFailure,
+		&blockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecord
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	t.BlockedUntil = blockedUntil.Time
+
+	return &t, nil
+}
+
+// Latest time any of the keys is blocked until. Zero if none are blocked.
+func (m *LoginThrottleModel) BlockedUntil(ctx context.Context, keys ...string) (time.Time, error) {
+	if len(keys) == 0 {
+		return time.Time{}, nil
+	}
+
+	query := `
+		SELECT blocked_until
+		FROM LoginThrottle
+		WHERE key IN (` + placeholders(len(keys)) + `)
+		AND blocked_until > ?
+		ORDER BY blocked_until DESC
+		LIMIT 1;`
+
+	args := make([]any, 0, len(keys)+1)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, time.Now().UTC())
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var until time.Time
+	err := m.db.QueryRowContext(ctx, query, args...).Scan(&until)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, nil
+		default:
+			return time.Time{}, translateError(err)
+		}
+	}
+
+	return until, nil
+}
+
+// Count a failed login against key and return the number of failures. The
+// count starts over when the previous failure is older than window.
+func (m *LoginThrottleModel) RecordFailure(ctx context.Context, key string, window time.Duration) (int, error) {
+	query := `
+		INSERT INTO LoginThrottle (key, failures, last_failure)
+		VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE WHEN last_failure < ? THEN 1 ELSE failures + 1 END,
+		last_failure = excluded.last_failure
+		RETURNING failures;`
+
+	now := time.Now().UTC()
+	args := []any{key, now, now.Add(-window)}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var failures int
+	err := m.db.QueryRowContext(ctx, query, args...).Scan(&failures)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return failures, nil
+}
+
+// Refuse logins for key until the given time.
+func (m *LoginThrottleModel) Block(ctx context.Context, key string, until time.Time) error {
+	query := `
+		UPDATE LoginThrottle
+		SET blocked_until = ?
+		WHERE key = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, until.UTC(), key)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// Forget the failures counted against key, lifting any block.
+func (m *LoginThrottleModel) Reset(ctx context.Context, key string) error {
+	query := `
+		DELETE FROM LoginThrottle
+		WHERE key = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, key)
+
+	return translateError(err)
+}
+
+// Delete unblocked keys whose last failure is older than window.
+func (m *LoginThrottleModel) DeleteExpired(ctx context.Context, window time.Duration) error {
+	query := `
+		DELETE FROM LoginThrottle
+		WHERE last_failure < ?
+		AND (blocked_until IS NULL OR blocked_until < ?);`
+
+	now := time.Now().UTC()
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, now.Add(-window), now)
+
+	return translateError(err)
+}
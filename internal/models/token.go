@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"time"
+)
+
+const (
+	ScopePasswordReset     = "password-reset"
+	ScopeEmailVerification = "email-verification"
+)
+
+type TokenModel struct {
+	db dbtx
+}
+
+// Token is a single-use secret bound to a user and scope. Only the hash of
+// the plaintext is stored in the database.
+type Token struct {
+	Plaintext string
+	Hash      []byte
+	UserID    int
+	Expiry    time.Time
+	Scope     string
+}
+
+func generateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
+	token := &Token{
+		UserID: userID,
+		Expiry: time.Now().Add(ttl).UTC(),
+		Scope:  scope,
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+
+	return token, nil
+}
+
+func (m *TokenModel) New(ctx context.Context, userID int, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+
+	return token, err
+}
+
+func (m *TokenModel) Insert(ctx context.Context, token *Token) error {
+	query := `
+		INSERT INTO Token (hash, user_id, expiry, scope)
+		VALUES (?, ?, ?, ?);`
+
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, args...)
+
+	return translateError(err)
+}
+
+func (m *TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int) error {
+	query := `
+		DELETE FROM Token
+		WHERE scope = ? AND user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, scope, userID)
+
+	return translateError(err)
+}
+
+func (m *TokenModel) DeleteExpired(ctx context.Context) error {
+	query := `
+		DELETE FROM Token
+		WHERE expiry <= ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, time.Now().UTC())
+
+	return translateError(err)
+}
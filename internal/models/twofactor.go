@@ -0,0 +1,265 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+type TwoFactorModel struct {
+	db dbtx
+}
+
+// TOTP enrollment of a user
+type TOTP struct {
+	UserID      int
+	Secret      string
+	ConfirmedAt time.Time
+	LastCounter int64
+}
+
+func (t TOTP) Confirmed() bool {
+	return !t.ConfirmedAt.IsZero()
+}
+
+func (m *TwoFactorModel) Get(ctx context.Context, userID int) (*TOTP, error) {
+	query := `
+		SELECT user_id, secret, confirmed_at, last_counter
+		FROM UserTOTP
+		WHERE user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var t TOTP
+	var confirmedAt sql.NullTime
+	err := m.db.QueryRowContext(ctx, query, userID).Scan(
+		&t.UserID,
+		&t.Secret,
+		&confirmedAt,
+		&t.LastCounter,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecord
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	t.ConfirmedAt = confirmedAt.Time
+
+	return &t, nil
+}
+
+// Check if the user has confirmed TOTP enrollment.
+func (m *TwoFactorModel) Enabled(ctx context.Context, userID int) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM UserTOTP
+			WHERE user_id = ?
+			AND confirmed_at IS NOT NULL
+		);`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var enabled bool
+	err := m.db.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	if err != nil {
+		return false, translateError(err)
+	}
+
+	return enabled, nil
+}
+
+// Start enrollment with a new secret. Replaces an unconfirmed secret, but
+// never a confirmed one.
+func (m *TwoFactorModel) Begin(ctx context.Context, userID int, secret string) error {
+	query := `
+		INSERT INTO UserTOTP (user_id, secret)
+		VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = excluded.secret, last_counter = 0
+		WHERE confirmed_at IS NULL;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, userID, secret)
+
+	return translateError(err)
+}
+
+// Finish enrollment once the user proved they can generate codes.
+func (m *TwoFactorModel) Confirm(ctx context.Context, userID int, counter int64) error {
+	query := `
+		UPDATE UserTOTP
+		SET confirmed_at = ?, last_counter = ?
+		WHERE user_id = ?
+		AND confirmed_at IS NULL;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, time.Now().UTC(), counter, userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// Record the time step of an accepted code. Returns ErrNoRecord if the step
+// is not newer than the last one used, i.e. the code is being replayed.
+func (m *TwoFactorModel) UseCounter(ctx context.Context, userID int, counter int64) error {
+	query := `
+		UPDATE UserTOTP
+		SET last_counter = ?
+		WHERE user_id = ?
+		AND last_counter < ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, counter, userID, counter)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+// Remove the user's TOTP secret and recovery codes. Must run in a
+// transaction, see WithTx.
+func (m *TwoFactorModel) Delete(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	for _, query := range []string{
+		`DELETE FROM RecoveryCode WHERE user_id = ?;`,
+		`DELETE FROM UserTOTP WHERE user_id = ?;`,
+	} {
+		_, err := m.db.ExecContext(ctx, query, userID)
+		if err != nil {
+			return translateError(err)
+		}
+	}
+
+	return nil
+}
+
+// Replace the user's recovery codes with a new set. Returns the plaintext
+// codes, which are not stored and must be shown to the user once. Must run in
+// a transaction, see WithTx.
+func (m *TwoFactorModel) NewRecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		codes[i] = code
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, `DELETE FROM RecoveryCode WHERE user_id = ?;`, userID)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	query := `
+		INSERT INTO RecoveryCode (hash, user_id)
+		VALUES (?, ?);`
+
+	for _, code := range codes {
+		_, err = m.db.ExecContext(ctx, query, hashRecoveryCode(code), userID)
+		if err != nil {
+			return nil, translateError(err)
+		}
+	}
+
+	return codes, nil
+}
+
+// Consume a recovery code. Returns ErrNoRecord if it does not exist or was
+// already used.
+func (m *TwoFactorModel) UseRecoveryCode(ctx context.Context, userID int, code string) error {
+	query := `
+		DELETE FROM RecoveryCode
+		WHERE hash = ? AND user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, hashRecoveryCode(code), userID)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return checkRowsAffected(result)
+}
+
+func (m *TwoFactorModel) CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	query := `
+		SELECT count(*)
+		FROM RecoveryCode
+		WHERE user_id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	var n int
+	err := m.db.QueryRowContext(ctx, query, userID).Scan(&n)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return n, nil
+}
+
+// Recovery codes look like "abcd-efgh-ijkl" (60 bits of entropy), so a fast
+// hash is sufficient.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	s := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:12]
+
+	return s[:4] + "-" + s[4:8] + "-" + s[8:], nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.TrimSpace(code))
+	hash := sha256.Sum256([]byte(code))
+
+	return hash[:]
+}
+
+func checkRowsAffected(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
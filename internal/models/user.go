@@ -2,49 +2,66 @@ package models
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"strings"
+	"time"
 
-	"github.com/alexedwards/argon2id"
 	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/go-ozzo/ozzo-validation/is"
 )
 
 type UserModel struct {
-	db *sql.DB
+	db     dbtx
+	hasher *passwordHasher
 }
 
 type User struct {
 	ID           int
 	Username     string
 	PasswordHash string
+	// Empty unless collected at signup
+	Email      string
+	VerifiedAt time.Time
+	// Incremented on every update for optimistic concurrency control
+	Version int
 }
 
 func (u User) Validate() error {
 	return validation.ValidateStruct(&u,
 		validation.Field(&u.Username, validation.Required),
-		validation.Field(&u.PasswordHash, validation.Required))
+		validation.Field(&u.PasswordHash, validation.Required),
+		validation.Field(&u.Email, is.Email))
 }
 
-func (u *User) SetPasswordHash(password string) error {
-	hash, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+// Check if the user has yet to follow the link sent to their email address.
+// Accounts created without an address are not limited.
+func (u User) Unverified() bool {
+	return u.Email != "" && u.VerifiedAt.IsZero()
+}
+
+// Hash the password with the current parameters. The user is not saved.
+func (m *UserModel) SetPassword(user *User, password string) error {
+	hash, err := m.hasher.hash(password)
 	if err != nil {
 		return err
 	}
 
-	u.PasswordHash = hash
+	user.PasswordHash = hash
 
 	return nil
 }
 
-func (m *UserModel) New(username, password string) (*User, error) {
+func (m *UserModel) New(ctx context.Context, username, password string) (*User, error) {
 	user := &User{Username: username}
 
-	err := user.SetPasswordHash(password)
+	err := m.SetPassword(user, password)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(user)
+	err = m.Insert(ctx, user)
 	if err != nil {
 		return nil, err
 	}
@@ -52,28 +69,32 @@ func (m *UserModel) New(username, password string) (*User, error) {
 	return user, nil
 }
 
-func (m *UserModel) Insert(user *User) error {
+func (m *UserModel) Insert(ctx context.Context, user *User) error {
 	err := user.Validate()
 	if err != nil {
 		return err
 	}
 
 	query := `
-		INSERT INTO User (username, password)
-		VALUES(?, ?)
-		RETURNING id;`
+		INSERT INTO User (username, password, email, verified_at)
+		VALUES(?, ?, ?, ?)
+		RETURNING id, version;`
 
-	args := []any{user.Username, user.PasswordHash}
+	args := []any{user.Username, user.PasswordHash, nullString(user.Email), nullTime(user.VerifiedAt)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
 	defer cancel()
 
-	err = m.db.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+	err = m.db.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.Version)
 	if err != nil {
+		err = translateError(err)
+
+		var ce *ConstraintError
 		switch {
-		// Check for SQLite unique violation
-		case err.Error() == "unique violation":
+		case errors.As(err, &ce) && ce.OnColumn("User", "username"):
 			return ErrDuplicateUsername
+		case errors.As(err, &ce) && ce.OnColumn("User", "email"):
+			return ErrDuplicateEmail
 		default:
 			return err
 		}
@@ -82,81 +103,178 @@ func (m *UserModel) Insert(user *User) error {
 	return nil
 }
 
-func (m *UserModel) GetWithID(id int) (*User, error) {
+func (m *UserModel) GetWithID(ctx context.Context, id int) (*User, error) {
 	query := `
-		SELECT id, username, password
+		SELECT id, username, password, email, verified_at, version
 		FROM User WHERE id = ?;`
 
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
 	defer cancel()
 
-	var u User
-	err := m.db.QueryRowContext(ctx, query, id).Scan(
-		&u.ID,
-		&u.Username,
-		&u.PasswordHash,
-	)
+	u, err := scanUser(m.db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrNoRecord
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
-	return &u, nil
+	return u, nil
+}
+
+// List users whose username contains search, ordered by ID.
+func (m *UserModel) GetAll(ctx context.Context, search string, filters Filters) ([]*User, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, username, password, email, verified_at, version
+		FROM User
+		WHERE (username LIKE ? ESCAPE '\' OR ? = '')
+		ORDER BY id
+		LIMIT ? OFFSET ?;`
+
+	pattern := "%" + escapeLike(search) + "%"
+	args := []any{pattern, search, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, translateError(err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var u User
+		var email sql.NullString
+		var verifiedAt sql.NullTime
+
+		err := rows.Scan(
+			&totalRecords,
+			&u.ID,
+			&u.Username,
+			&u.PasswordHash,
+			&email,
+			&verifiedAt,
+			&u.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, translateError(err)
+		}
+
+		u.Email = email.String
+		u.VerifiedAt = verifiedAt.Time
+		users = append(users, &u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, translateError(err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
 }
 
-func (m *UserModel) GetWithUsername(username string) (*User, error) {
+func (m *UserModel) GetWithUsername(ctx context.Context, username string) (*User, error) {
 	query := `
-		SELECT id, username, password
+		SELECT id, username, password, email, verified_at, version
 		FROM User WHERE username = ?;`
 
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
 	defer cancel()
 
-	var u User
-	err := m.db.QueryRowContext(ctx, query, username).Scan(
-		&u.ID,
-		&u.Username,
-		&u.PasswordHash,
-	)
+	u, err := scanUser(m.db.QueryRowContext(ctx, query, username))
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrNoRecord
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
-	return &u, nil
+	return u, nil
 }
 
-func (m *UserModel) GetForCredentials(username, password string) (*User, error) {
-	u, err := m.GetWithUsername(username)
+// Get the user that owns a valid, unexpired token of the given scope.
+func (m *UserModel) GetForToken(ctx context.Context, scope, plaintext string) (*User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT User.id, User.username, User.password, User.email, User.verified_at, User.version
+		FROM User
+		INNER JOIN Token
+		ON User.id = Token.user_id
+		WHERE Token.hash = ?
+		AND Token.scope = ?
+		AND Token.expiry > ?;`
+
+	args := []any{hash[:], scope, time.Now().UTC()}
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	u, err := scanUser(m.db.QueryRowContext(ctx, query, args...))
 	if err != nil {
 		switch {
-		case errors.Is(err, ErrNoRecord):
-			return nil, ErrInvalidCredentials
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNoRecord
 		default:
-			return nil, err
+			return nil, translateError(err)
 		}
 	}
 
-	match, err := argon2id.ComparePasswordAndHash(password, string(u.PasswordHash))
+	return u, nil
+}
+
+// Get the user if the password matches. Both unknown usernames and wrong
+// passwords cost one hash comparison and return ErrInvalidCredentials.
+//
+// Hashes weaker than the current parameters, including imported bcrypt
+// hashes, are replaced while the plaintext password is at hand.
+func (m *UserModel) GetForCredentials(ctx context.Context, username, password string) (*User, error) {
+	u, err := m.GetWithUsername(ctx, username)
+	if err != nil && !errors.Is(err, ErrNoRecord) {
+		return nil, err
+	}
+
+	hash := m.hasher.dummyHash
+	if u != nil {
+		hash = u.PasswordHash
+	}
+
+	match, err := m.hasher.compare(password, hash)
 	if err != nil {
 		return nil, err
 	}
-	if !match {
+
+	if u == nil || !match {
 		return nil, ErrInvalidCredentials
 	}
 
+	if m.hasher.outdated(u.PasswordHash) {
+		err = m.SetPassword(u, password)
+		if err != nil {
+			return nil, err
+		}
+
+		// Losing to a concurrent update only delays the upgrade to the
+		// next login
+		err = m.Update(ctx, u)
+		if err != nil && !errors.Is(err, ErrEditConflict) {
+			return nil, err
+		}
+	}
+
 	return u, nil
 }
 
-func (m *UserModel) Exists(id int) (bool, error) {
+func (m *UserModel) Exists(ctx context.Context, id int) (bool, error) {
 	query := `
 		SELECT EXISTS (
 			SELECT 1
@@ -164,19 +282,19 @@ func (m *UserModel) Exists(id int) (bool, error) {
 			WHERE id = ?
 		);`
 
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
 	defer cancel()
 
 	var exists bool
 	err := m.db.QueryRowContext(ctx, query, id).Scan(&exists)
 	if err != nil {
-		return false, err
+		return false, translateError(err)
 	}
 
 	return exists, nil
 }
 
-func (m *UserModel) ExistsWithUsername(username string) (bool, error) {
+func (m *UserModel) ExistsWithUsername(ctx context.Context, username string) (bool, error) {
 	query := `
 		SELECT EXISTS (
 			SELECT 1
@@ -184,19 +302,21 @@ func (m *UserModel) ExistsWithUsername(username string) (bool, error) {
 			WHERE username = ?
 		);`
 
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
 	defer cancel()
 
 	var exists bool
 	err := m.db.QueryRowContext(ctx, query, username).Scan(&exists)
 	if err != nil {
-		return false, err
+		return false, translateError(err)
 	}
 
 	return exists, nil
 }
 
-func (m UserModel) Update(user *User) error {
+// Update the user if it has not been modified since it was read. Returns
+// ErrEditConflict if the stored version no longer matches user.Version.
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	err := user.Validate()
 	if err != nil {
 		return err
@@ -204,30 +324,111 @@ func (m UserModel) Update(user *User) error {
 
 	query := `
 		UPDATE User 
-        SET username = ?, password = ?
-        WHERE id = ?;`
+        SET username = ?, password = ?, email = ?, verified_at = ?, version = version + 1
+        WHERE id = ? AND version = ?;`
 
 	args := []any{
 		user.Username,
 		user.PasswordHash,
+		nullString(user.Email),
+		nullTime(user.VerifiedAt),
 		user.ID,
+		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
 	defer cancel()
 
-	_, err = m.db.ExecContext(ctx, query, args...)
+	result, err := m.db.ExecContext(ctx, query, args...)
 	if err != nil {
+		err = translateError(err)
+
+		var ce *ConstraintError
 		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-			// Check for SQLite unique violation
-		case err.Error() == "unique violation":
+		case errors.As(err, &ce) && ce.OnColumn("User", "username"):
 			return ErrDuplicateUsername
+		case errors.As(err, &ce) && ce.OnColumn("User", "email"):
+			return ErrDuplicateEmail
 		default:
 			return err
 		}
 	}
 
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// Either the user was deleted or someone else updated it first
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	user.Version++
+
 	return nil
 }
+
+// Delete the user. Permissions and tokens are removed by ON DELETE CASCADE.
+func (m *UserModel) Delete(ctx context.Context, id int) error {
+	query := `
+		DELETE FROM User
+		WHERE id = ?;`
+
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+
+	result, err := m.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// Escape LIKE wildcards so user input is matched literally.
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+	return r.Replace(s)
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	var email sql.NullString
+	var verifiedAt sql.NullTime
+
+	err := row.Scan(
+		&u.ID,
+		&u.Username,
+		&u.PasswordHash,
+		&email,
+		&verifiedAt,
+		&u.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Email = email.String
+	u.VerifiedAt = verifiedAt.Time
+
+	return &u, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+)
+
+func TestGetForCredentials(t *testing.T) {
+	ctx := context.Background()
+	m, _ := newTestModels(t)
+
+	alice := newTestUser(t, m, "alice")
+
+	user, err := m.User.GetForCredentials(ctx, "alice", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.ID != alice.ID {
+		t.Errorf("got user %d, want %d", user.ID, alice.ID)
+	}
+
+	_, err = m.User.GetForCredentials(ctx, "alice", "wrongpassword")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: got %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	_, err = m.User.GetForCredentials(ctx, "bob", "wrongpassword")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown user: got %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	// An unknown user must cost a hash comparison like a wrong password.
+	// Break the dummy hash to see that it is compared against.
+	m.hasher.dummyHash = "not a hash"
+
+	_, err = m.User.GetForCredentials(ctx, "bob", "wrongpassword")
+	if !errors.Is(err, argon2id.ErrInvalidHash) {
+		t.Errorf("unknown user with broken dummy hash: got %v, want %v", err, argon2id.ErrInvalidHash)
+	}
+
+	_, err = m.User.GetForCredentials(ctx, "alice", "wrongpassword")
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password with broken dummy hash: got %v, want %v", err, ErrInvalidCredentials)
+	}
+}
@@ -0,0 +1,350 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Clock difference tolerated between us and the provider
+const skew = time.Minute
+
+// Unknown key IDs refetch the JWKS, to pick up rotated keys, at most this
+// often
+const minKeyRefresh = time.Minute
+
+func invalidToken(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, fmt.Sprintf(format, a...))
+}
+
+// IDToken holds the verified claims of an ID token.
+type IDToken struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+
+	claims map[string]json.RawMessage
+}
+
+// Decode any claim into dst. Returns false if the token does not have it.
+func (t *IDToken) Claim(name string, dst any) (bool, error) {
+	raw, ok := t.claims[name]
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(raw, dst)
+}
+
+// Values of a claim that is a string or an array of strings, such as groups.
+func (t *IDToken) Strings(name string) []string {
+	var list []string
+	_, err := t.Claim(name, &list)
+	if err == nil {
+		return list
+	}
+
+	var s string
+	_, err = t.Claim(name, &s)
+	if err == nil && s != "" {
+		return []string{s}
+	}
+
+	return nil
+}
+
+// audience is a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*a = audience{s}
+
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// flexBool accepts "true" as well as true, as sent by some providers
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	*b = flexBool(string(data) == "true" || string(data) == `"true"`)
+
+	return nil
+}
+
+func (c *Client) verify(ctx context.Context, p *provider, raw, nonce string) (*IDToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, invalidToken("header: %v", err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("signature: %v", err)
+	}
+
+	key, err := c.key(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]json.RawMessage
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, invalidToken("claims: %v", err)
+	}
+
+	var std struct {
+		Issuer            string   `json:"iss"`
+		Subject           string   `json:"sub"`
+		Audience          audience `json:"aud"`
+		AuthorizedParty   string   `json:"azp"`
+		Expiry            int64    `json:"exp"`
+		IssuedAt          int64    `json:"iat"`
+		Nonce             string   `json:"nonce"`
+		Email             string   `json:"email"`
+		EmailVerified     flexBool `json:"email_verified"`
+		Name              string   `json:"name"`
+		PreferredUsername string   `json:"preferred_username"`
+	}
+
+	err = decodeSegment(parts[1], &std)
+	if err != nil {
+		return nil, invalidToken("claims: %v", err)
+	}
+
+	now := time.Now()
+
+	switch {
+	case std.Issuer != p.Issuer:
+		return nil, invalidToken("issuer %q", std.Issuer)
+	case std.Subject == "":
+		return nil, invalidToken("no subject")
+	case !slices.Contains(std.Audience, c.config.ClientID):
+		return nil, invalidToken("audience %q", std.Audience)
+	case len(std.Audience) > 1 && std.AuthorizedParty != c.config.ClientID:
+		return nil, invalidToken("authorized party %q", std.AuthorizedParty)
+	case now.After(time.Unix(std.Expiry, 0).Add(skew)):
+		return nil, invalidToken("expired")
+	case time.Unix(std.IssuedAt, 0).After(now.Add(skew)):
+		return nil, invalidToken("issued in the future")
+	case std.Nonce == "" || subtle.ConstantTimeCompare([]byte(std.Nonce), []byte(nonce)) != 1:
+		return nil, invalidToken("nonce mismatch")
+	}
+
+	return &IDToken{
+		Issuer:            std.Issuer,
+		Subject:           std.Subject,
+		Email:             std.Email,
+		EmailVerified:     bool(std.EmailVerified),
+		Name:              std.Name,
+		PreferredUsername: std.PreferredUsername,
+		claims:            claims,
+	}, nil
+}
+
+func decodeSegment(seg string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, dst)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hash := sha256.Sum256(signed)
+
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) == nil {
+			return nil
+		}
+	case "ES256":
+		// JWS uses the fixed size r || s encoding rather than ASN.1
+		pub, ok := key.(*ecdsa.PublicKey)
+		if ok && len(sig) == 64 {
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			if ecdsa.Verify(pub, hash[:], r, s) {
+				return nil
+			}
+		}
+	default:
+		return invalidToken("unsupported algorithm %q", alg)
+	}
+
+	return invalidToken("invalid signature")
+}
+
+// keySet caches the provider's signing keys
+type keySet struct {
+	uri     string
+	keys    []jwk
+	fetched time.Time
+}
+
+// JSON Web Key (RFC 7517) with the members of RSA and EC keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) usableFor(kid, alg string) bool {
+	if k.Use != "" && k.Use != "sig" {
+		return false
+	}
+
+	if k.Alg != "" && k.Alg != alg {
+		return false
+	}
+
+	if kid != "" && k.Kid != kid {
+		return false
+	}
+
+	switch alg {
+	case "RS256":
+		return k.Kty == "RSA"
+	case "ES256":
+		return k.Kty == "EC" && k.Crv == "P-256"
+	}
+
+	return false
+}
+
+// Find the key that signed a token, refetching the key set if it is not
+// known, as happens after the provider rotates its keys.
+func (c *Client) key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	if alg != "RS256" && alg != "ES256" {
+		return nil, invalidToken("unsupported algorithm %q", alg)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	find := func() (crypto.PublicKey, bool, error) {
+		var found []jwk
+		for _, k := range c.keys.keys {
+			if k.usableFor(kid, alg) {
+				found = append(found, k)
+			}
+		}
+
+		// Without a key ID the key must be unambiguous
+		if len(found) != 1 {
+			return nil, false, nil
+		}
+
+		key, err := found[0].publicKey()
+
+		return key, true, err
+	}
+
+	key, ok, err := find()
+	if ok {
+		return key, err
+	}
+
+	if time.Since(c.keys.fetched) < minKeyRefresh {
+		return nil, invalidToken("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	err = c.getJSON(ctx, c.keys.uri, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	c.keys.keys = set.Keys
+	c.keys.fetched = time.Now()
+
+	key, ok, err = find()
+	if !ok {
+		return nil, invalidToken("unknown signing key %q", kid)
+	}
+
+	return key, err
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("%w: invalid RSA key %q", ErrProvider, k.Kid)
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: invalid P-256 key %q", ErrProvider, k.Kid)
+		}
+
+		// Reject points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		_, err := ecdh.P256().NewPublicKey(point)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid P-256 key %q: %w", ErrProvider, k.Kid, err)
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported key type %q", ErrProvider, k.Kty)
+}
@@ -0,0 +1,259 @@
+// Package oidc implements the relying party side of the OpenID Connect
+// authorization code flow with PKCE, for any provider that supports
+// discovery.
+//
+// ID tokens are verified against the provider's published JWKS. Supported
+// signing algorithms are RS256, the one every provider must offer, and ES256.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time the user is given to complete the login at the provider
+const Timeout = 10 * time.Minute
+
+var (
+	// The provider did not behave as the specification requires
+	ErrProvider = errors.New("oidc: invalid provider response")
+	// The ID token failed verification
+	ErrInvalidToken = errors.New("oidc: invalid id token")
+)
+
+// Config identifies the client to the provider.
+type Config struct {
+	// Issuer URL of the provider, e.g. "https://accounts.example.com"
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Must be registered with the provider
+	RedirectURL string
+	// "openid" is always requested
+	Scopes []string
+}
+
+// Client runs logins against a single provider. The provider configuration
+// is discovered on first use and cached.
+type Client struct {
+	config Config
+	http   *http.Client
+
+	mu       sync.Mutex
+	provider *provider
+	keys     *keySet
+}
+
+// Create a client. A nil httpClient uses http.DefaultClient.
+func New(config Config, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{config: config, http: httpClient}
+}
+
+// Subset of the provider metadata from OpenID Connect Discovery 1.0
+type provider struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+}
+
+func (c *Client) discover(ctx context.Context) (*provider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.provider != nil {
+		return c.provider, nil
+	}
+
+	u := strings.TrimSuffix(c.config.Issuer, "/") + "/.well-known/openid-configuration"
+
+	var p provider
+	err := c.getJSON(ctx, u, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	// The issuer must be exactly the one configured, or a provider could
+	// speak for another
+	if p.Issuer != c.config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q does not match %q", ErrProvider, p.Issuer, c.config.Issuer)
+	}
+
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: missing endpoints", ErrProvider)
+	}
+
+	c.provider = &p
+	c.keys = &keySet{uri: p.JWKSURI}
+
+	return c.provider, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, u string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: GET %s: %s", ErrProvider, u, resp.Status)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst)
+	if err != nil {
+		return fmt.Errorf("%w: GET %s: %w", ErrProvider, u, err)
+	}
+
+	return nil
+}
+
+// AuthRequest holds the secrets of a login in progress. They must be kept by
+// the client, e.g. in the session, until the provider redirects back.
+type AuthRequest struct {
+	// Sent to the provider and returned unchanged, protects against login
+	// CSRF
+	State string
+	// Bound into the ID token, protects against token replay
+	Nonce string
+	// PKCE code verifier, protects the authorization code
+	Verifier string
+	// Where to send the user
+	URL string
+}
+
+// Start a login. The user must be sent to the returned URL.
+func (c *Client) AuthCodeURL(ctx context.Context) (*AuthRequest, error) {
+	p, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var a AuthRequest
+	for _, s := range []*string{&a.State, &a.Nonce, &a.Verifier} {
+		*s, err = randomString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	challenge := sha256.Sum256([]byte(a.Verifier))
+
+	scopes := []string{"openid"}
+	for _, s := range c.config.Scopes {
+		if s != "openid" {
+			scopes = append(scopes, s)
+		}
+	}
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.config.ClientID},
+		"redirect_uri":          {c.config.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {a.State},
+		"nonce":                 {a.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	a.URL = p.AuthorizationEndpoint + sep + q.Encode()
+
+	return &a, nil
+}
+
+// Exchange the authorization code for an ID token and verify it.
+func (c *Client) Exchange(ctx context.Context, code string, a *AuthRequest) (*IDToken, error) {
+	p, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.config.RedirectURL},
+		"code_verifier": {a.Verifier},
+	}
+
+	// Public clients identify themselves in the body, confidential ones
+	// authenticate with client_secret_basic
+	if c.config.ClientSecret == "" {
+		form.Set("client_id", c.config.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.config.ClientID), url.QueryEscape(c.config.ClientSecret))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: token response: %w", ErrProvider, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: token request: %s: %s %s", ErrProvider, resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	if body.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in token response", ErrProvider)
+	}
+
+	return c.verify(ctx, p, body.IDToken, a.Nonce)
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,594 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "web"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "https://app.example.com/auth/oidc/callback"
+)
+
+type signingKey struct {
+	kid    string
+	alg    string
+	signer crypto.Signer
+}
+
+func newRSAKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingKey{kid: kid, alg: "RS256", signer: key}
+}
+
+func newECKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingKey{kid: kid, alg: "ES256", signer: key}
+}
+
+func (k signingKey) jwk() jwk {
+	b64 := base64.RawURLEncoding
+
+	switch pub := k.signer.Public().(type) {
+	case *rsa.PublicKey:
+		return jwk{
+			Kty: "RSA",
+			Kid: k.kid,
+			Use: "sig",
+			N:   b64.EncodeToString(pub.N.Bytes()),
+			E:   b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		return jwk{
+			Kty: "EC",
+			Kid: k.kid,
+			Use: "sig",
+			Crv: "P-256",
+			X:   b64.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			Y:   b64.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}
+	}
+
+	panic("unsupported key")
+}
+
+func (k signingKey) sign(t *testing.T, header, claims map[string]any) string {
+	t.Helper()
+
+	segment := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := segment(header) + "." + segment(claims)
+	hash := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := k.signer.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// mockProvider is an in-process OpenID provider. It issues codes without
+// asking anyone, checks PKCE and client authentication at the token
+// endpoint, and signs ID tokens with a key from its JWKS.
+type mockProvider struct {
+	*httptest.Server
+	t *testing.T
+
+	mu sync.Mutex
+	// Overrides the issuer the discovery document reports
+	discoveryIssuer string
+	// Published in the JWKS
+	published []signingKey
+	// Signs ID tokens, need not be published
+	signer signingKey
+	// Changes the ID token before it is signed
+	edit func(header, claims map[string]any)
+	// Authorization request of each issued code
+	grants      map[string]url.Values
+	jwksFetches int
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key := newRSAKey(t, "k1")
+	p := &mockProvider{
+		t:         t,
+		published: []signingKey{key},
+		signer:    key,
+		grants:    make(map[string]url.Values),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("GET /authorize", p.handleAuthorize)
+	mux.HandleFunc("POST /token", p.handleToken)
+	mux.HandleFunc("GET /jwks", p.handleJWKS)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *mockProvider) client() *Client {
+	return New(Config{
+		Issuer:       p.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"openid", "email"},
+	}, p.Client())
+}
+
+func (p *mockProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	issuer := p.discoveryIssuer
+	p.mu.Unlock()
+
+	if issuer == "" {
+		issuer = p.URL
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                 issuer,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"jwks_uri":               p.URL + "/jwks",
+	})
+}
+
+func (p *mockProvider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	code := "code-" + q.Get("state")
+
+	p.mu.Lock()
+	p.grants[code] = q
+	p.mu.Unlock()
+
+	redirect := q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (p *mockProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		tokenError("invalid_request")
+		return
+	}
+
+	id, secret, _ := r.BasicAuth()
+	if id != testClientID || secret != testClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+
+	p.mu.Lock()
+	g, ok := p.grants[r.PostForm.Get("code")]
+	delete(p.grants, r.PostForm.Get("code"))
+	signer, edit := p.signer, p.edit
+	p.mu.Unlock()
+
+	// PKCE: the verifier must hash to the challenge sent to /authorize
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok ||
+		r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("redirect_uri") != g.Get("redirect_uri") ||
+		g.Get("code_challenge_method") != "S256" ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != g.Get("code_challenge") {
+		tokenError("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	header := map[string]any{"alg": signer.alg, "kid": signer.kid}
+	claims := map[string]any{
+		"iss":                p.URL,
+		"sub":                "subject-1",
+		"aud":                g.Get("client_id"),
+		"exp":                now.Add(time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              g.Get("nonce"),
+		"email":              "alice@example.com",
+		"email_verified":     "true",
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "ops"},
+	}
+
+	if edit != nil {
+		edit(header, claims)
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"id_token":     signer.sign(p.t, header, claims),
+	})
+}
+
+func (p *mockProvider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.jwksFetches++
+
+	var keys []jwk
+	for _, k := range p.published {
+		keys = append(keys, k.jwk())
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+// Rotate to a new signing key, dropping the old one from the JWKS.
+func (p *mockProvider) rotate(key signingKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.published = []signingKey{key}
+	p.signer = key
+}
+
+func (p *mockProvider) setSigner(key signingKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.signer = key
+}
+
+func (p *mockProvider) fetches() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.jwksFetches
+}
+
+func (p *mockProvider) setEdit(edit func(header, claims map[string]any)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.edit = edit
+}
+
+// Send the user to the provider and return the code it redirects back
+// with, after checking the state came back unchanged.
+func (p *mockProvider) authorize(t *testing.T, c *Client) (string, *AuthRequest) {
+	t.Helper()
+
+	a, err := c.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := hc.Get(a.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := callback.Query().Get("state"); got != a.State {
+		t.Fatalf("got state %q, want %q", got, a.State)
+	}
+
+	return callback.Query().Get("code"), a
+}
+
+func (p *mockProvider) login(t *testing.T, c *Client) (*IDToken, error) {
+	t.Helper()
+
+	code, a := p.authorize(t, c)
+
+	return c.Exchange(context.Background(), code, a)
+}
+
+func TestLogin(t *testing.T) {
+	p := newMockProvider(t)
+	c := p.client()
+
+	a, err := c.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+	challenge := sha256.Sum256([]byte(a.Verifier))
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid email",
+		"state":                 a.State,
+		"nonce":                 a.Nonce,
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	}
+
+	for name, value := range want {
+		if got := q.Get(name); got != value {
+			t.Errorf("%s: got %q, want %q", name, got, value)
+		}
+	}
+
+	// Every login gets its own secrets
+	b, err := c.AuthCodeURL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.State == b.State || a.Nonce == b.Nonce || a.Verifier == b.Verifier {
+		t.Error("secrets reused across logins")
+	}
+
+	token, err := p.login(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Issuer != p.URL || token.Subject != "subject-1" {
+		t.Errorf("got %s %s, want %s subject-1", token.Issuer, token.Subject, p.URL)
+	}
+
+	if token.Email != "alice@example.com" || !token.EmailVerified || token.PreferredUsername != "alice" {
+		t.Errorf("got email %q verified %t username %q", token.Email, token.EmailVerified, token.PreferredUsername)
+	}
+
+	if groups := token.Strings("groups"); !slices.Equal(groups, []string{"staff", "ops"}) {
+		t.Errorf("got groups %v", groups)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	p := newMockProvider(t)
+	p.mu.Lock()
+	p.discoveryIssuer = "https://other.example.com"
+	p.mu.Unlock()
+
+	_, err := p.client().AuthCodeURL(context.Background())
+	if !errors.Is(err, ErrProvider) {
+		t.Errorf("got %v, want %v", err, ErrProvider)
+	}
+
+	_, err = New(Config{Issuer: p.URL + "/missing"}, p.Client()).AuthCodeURL(context.Background())
+	if !errors.Is(err, ErrProvider) {
+		t.Errorf("got %v, want %v", err, ErrProvider)
+	}
+}
+
+func TestExchangeChecksRequest(t *testing.T) {
+	p := newMockProvider(t)
+	c := p.client()
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		code, a := p.authorize(t, c)
+		a.Verifier += "x"
+
+		_, err := c.Exchange(context.Background(), code, a)
+		if !errors.Is(err, ErrProvider) {
+			t.Errorf("got %v, want %v", err, ErrProvider)
+		}
+	})
+
+	t.Run("code of another login", func(t *testing.T) {
+		code, _ := p.authorize(t, c)
+		_, a := p.authorize(t, c)
+
+		_, err := c.Exchange(context.Background(), code, a)
+		if !errors.Is(err, ErrProvider) {
+			t.Errorf("got %v, want %v", err, ErrProvider)
+		}
+	})
+
+	t.Run("wrong nonce", func(t *testing.T) {
+		code, a := p.authorize(t, c)
+		a.Nonce += "x"
+
+		_, err := c.Exchange(context.Background(), code, a)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("got %v, want %v", err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("code used twice", func(t *testing.T) {
+		code, a := p.authorize(t, c)
+
+		_, err := c.Exchange(context.Background(), code, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.Exchange(context.Background(), code, a)
+		if !errors.Is(err, ErrProvider) {
+			t.Errorf("got %v, want %v", err, ErrProvider)
+		}
+	})
+}
+
+func TestVerifyRejects(t *testing.T) {
+	p := newMockProvider(t)
+	c := p.client()
+
+	// Fetch the key set first, so that unknown keys are not refetched
+	_, err := p.login(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := p.signer
+	unpublished := newRSAKey(t, "k1")
+
+	tests := []struct {
+		name string
+		edit func(header, claims map[string]any)
+		// Sign with a key the provider does not publish
+		forge bool
+	}{
+		{name: "bad signature", forge: true},
+		{name: "issuer", edit: func(h, c map[string]any) { c["iss"] = "https://other.example.com" }},
+		{name: "audience", edit: func(h, c map[string]any) { c["aud"] = "other" }},
+		{name: "several audiences without authorized party", edit: func(h, c map[string]any) { c["aud"] = []string{testClientID, "other"} }},
+		{name: "expired", edit: func(h, c map[string]any) { c["exp"] = time.Now().Add(-2 * skew).Unix() }},
+		{name: "issued in the future", edit: func(h, c map[string]any) { c["iat"] = time.Now().Add(2 * skew).Unix() }},
+		{name: "no subject", edit: func(h, c map[string]any) { delete(c, "sub") }},
+		{name: "no nonce", edit: func(h, c map[string]any) { delete(c, "nonce") }},
+		{name: "unsigned", edit: func(h, c map[string]any) { h["alg"] = "none" }},
+		{name: "symmetric algorithm", edit: func(h, c map[string]any) { h["alg"] = "HS256" }},
+		{name: "unknown key", edit: func(h, c map[string]any) { h["kid"] = "k2" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.setEdit(tt.edit)
+			t.Cleanup(func() { p.setEdit(nil) })
+
+			if tt.forge {
+				p.setSigner(unpublished)
+				t.Cleanup(func() { p.setSigner(published) })
+			}
+
+			_, err := p.login(t, c)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+
+	t.Run("several audiences with authorized party", func(t *testing.T) {
+		p.setEdit(func(h, c map[string]any) {
+			c["aud"] = []string{testClientID, "other"}
+			c["azp"] = testClientID
+		})
+		t.Cleanup(func() { p.setEdit(nil) })
+
+		_, err := p.login(t, c)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestKeyRotation(t *testing.T) {
+	p := newMockProvider(t)
+	c := p.client()
+
+	_, err := p.login(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.rotate(newECKey(t, "k2"))
+
+	// Unknown keys do not refetch the key set more than once a minute
+	_, err = p.login(t, c)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got %v, want %v", err, ErrInvalidToken)
+	}
+
+	if n := p.fetches(); n != 1 {
+		t.Errorf("got %d key set fetches, want 1", n)
+	}
+
+	c.mu.Lock()
+	c.keys.fetched = time.Now().Add(-minKeyRefresh)
+	c.mu.Unlock()
+
+	token, err := p.login(t, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Subject != "subject-1" {
+		t.Errorf("got subject %q, want subject-1", token.Subject)
+	}
+
+	if n := p.fetches(); n != 2 {
+		t.Errorf("got %d key set fetches, want 2", n)
+	}
+
+	// The rotated out key is no longer trusted
+	c.mu.Lock()
+	c.keys.fetched = time.Now().Add(-minKeyRefresh)
+	c.mu.Unlock()
+
+	p.setSigner(newRSAKey(t, "k1"))
+
+	_, err = p.login(t, c)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got %v, want %v", err, ErrInvalidToken)
+	}
+
+	if !strings.Contains(err.Error(), "unknown signing key") {
+		t.Errorf("got %v, want unknown signing key", err)
+	}
+}
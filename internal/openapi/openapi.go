@@ -0,0 +1,156 @@
+// Package openapi builds OpenAPI 3.0 documents from Go types. Request and
+// response bodies are described by reflecting on structs: json tags name the
+// properties and validate tags, as understood by go-playground/validator,
+// become schema constraints.
+package openapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const Version = "3.0.3"
+
+// Document is an OpenAPI document. Create it with New, describe operations
+// with AddOperation and encode it with Build.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+
+	// Component name of each named struct, to detect clashes
+	types map[string]reflect.Type
+	errs  []error
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// SecurityRequirement maps security scheme names to the scopes required
+type SecurityRequirement map[string][]string
+
+// PathItem maps lower case HTTP methods to operations
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string                `json:"operationId,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []SecurityRequirement `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+func New(info Info) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   map[string]PathItem{},
+		Components: Components{
+			Schemas:         map[string]*Schema{},
+			SecuritySchemes: map[string]SecurityScheme{},
+		},
+		types: map[string]reflect.Type{},
+	}
+}
+
+var pathParamRegexp = regexp.MustCompile(`\{([^{}/]+)\}`)
+
+// PathParams returns the names of the {param} segments of a path
+func PathParams(path string) []string {
+	var names []string
+	for _, m := range pathParamRegexp.FindAllStringSubmatch(path, -1) {
+		names = append(names, m[1])
+	}
+
+	return names
+}
+
+// AddOperation describes the operation at method and path. Every {param} in
+// the path must have a matching path parameter.
+func (d *Document) AddOperation(method, path string, op *Operation) {
+	for _, name := range PathParams(path) {
+		declared := slices.ContainsFunc(op.Parameters, func(p Parameter) bool {
+			return p.In == "path" && p.Name == name
+		})
+		if !declared {
+			d.errs = append(d.errs, fmt.Errorf("%s %s: path parameter %q is not declared", method, path, name))
+		}
+	}
+
+	item, ok := d.Paths[path]
+	if !ok {
+		item = PathItem{}
+		d.Paths[path] = item
+	}
+
+	m := strings.ToLower(method)
+	if _, ok := item[m]; ok {
+		d.errs = append(d.errs, fmt.Errorf("%s %s: described twice", method, path))
+	}
+
+	item[m] = op
+}
+
+// JSONContent is the content of a request or response with a JSON body
+// shaped like v.
+func (d *Document) JSONContent(v any) map[string]MediaType {
+	return map[string]MediaType{
+		"application/json": {Schema: d.SchemaOf(v)},
+	}
+}
+
+// Build encodes the document, or returns what was wrong with its
+// description.
+func (d *Document) Build() ([]byte, error) {
+	if len(d.errs) > 0 {
+		return nil, errors.Join(d.errs...)
+	}
+
+	return json.MarshalIndent(d, "", "  ")
+}
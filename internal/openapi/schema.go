@@ -0,0 +1,278 @@
+package openapi
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     bool               `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     bool               `json:"exclusiveMaximum,omitempty"`
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// SchemaOf describes the JSON encoding of v. Named structs are added to the
+// components of the document and referenced.
+func (d *Document) SchemaOf(v any) *Schema {
+	return d.schema(reflect.TypeOf(v))
+}
+
+func (d *Document) schema(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Pointer:
+		s := d.schema(t.Elem())
+		// Siblings of $ref are ignored, so references can not be nullable
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		// encoding/json writes byte slices as base64
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+
+		return &Schema{Type: "array", Items: d.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.structSchema(t)
+		}
+
+		return d.componentRef(t)
+	case reflect.Interface:
+		return &Schema{}
+	default:
+		d.errs = append(d.errs, fmt.Errorf("unsupported type %s", t))
+
+		return &Schema{}
+	}
+}
+
+// Add a named struct to the components, once, and reference it.
+func (d *Document) componentRef(t reflect.Type) *Schema {
+	name := componentName(t)
+	ref := &Schema{Ref: "#/components/schemas/" + name}
+
+	if seen, ok := d.types[name]; ok {
+		if seen != t {
+			d.errs = append(d.errs, fmt.Errorf("types %s and %s are both named %s", seen, t, name))
+		}
+
+		return ref
+	}
+
+	// Registered before the fields are described, which may refer back to it
+	d.types[name] = t
+	d.Components.Schemas[name] = d.structSchema(t)
+
+	return ref
+}
+
+// Name of the component for a struct. A lower case prefix, as in apiUser, is
+// dropped.
+func componentName(t reflect.Type) string {
+	name := t.Name()
+	if i := strings.IndexFunc(name, unicode.IsUpper); i > 0 {
+		return name[i:]
+	}
+
+	return name
+}
+
+// Describe the fields of a struct as encoding/json writes them. A field is
+// required if it is validated as such, or if it is always written: it has no
+// validate tag and is not omitempty.
+func (d *Document) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fs := d.schema(f.Type)
+
+		rules, validated := f.Tag.Lookup("validate")
+		required := !validated && !strings.Contains(","+opts+",", ",omitempty,")
+
+		if validated {
+			var err error
+			required, err = applyRules(fs, f.Type, rules)
+			if err != nil {
+				d.errs = append(d.errs, fmt.Errorf("%s.%s: %w", t, f.Name, err))
+			}
+		}
+
+		s.Properties[name] = fs
+		if required {
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	return s
+}
+
+// Apply validate rules to the schema of a field of type t. Reports whether
+// the field is required. Rules with no schema equivalent are ignored.
+func applyRules(s *Schema, t reflect.Type, rules string) (bool, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var required bool
+
+	for i, rule := range strings.Split(rules, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "required":
+			required = true
+		case "dive":
+			if s.Items == nil {
+				return required, fmt.Errorf("dive on %s", t)
+			}
+
+			_, err := applyRules(s.Items, t.Elem(), strings.Join(strings.Split(rules, ",")[i+1:], ","))
+
+			return required, err
+		case "min", "max", "len", "gt", "gte", "lt", "lte":
+			err := applyBound(s, name, param)
+			if err != nil {
+				return required, fmt.Errorf("%s: %w", rule, err)
+			}
+		case "oneof":
+			for _, v := range strings.Fields(param) {
+				if s.Type == "integer" {
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						return required, fmt.Errorf("%s: %w", rule, err)
+					}
+
+					s.Enum = append(s.Enum, n)
+				} else {
+					s.Enum = append(s.Enum, v)
+				}
+			}
+		case "email":
+			s.Format = "email"
+		case "url", "http_url":
+			s.Format = "uri"
+		case "uuid", "uuid4":
+			s.Format = "uuid"
+		}
+	}
+
+	return required, nil
+}
+
+// Apply a size rule. Like the validator, it bounds the length of strings, the
+// number of items of arrays and the value of numbers.
+func applyBound(s *Schema, rule, param string) error {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return err
+	}
+
+	lower := rule == "min" || rule == "len" || rule == "gt" || rule == "gte"
+	upper := rule == "max" || rule == "len" || rule == "lt" || rule == "lte"
+	exclusive := rule == "gt" || rule == "lt"
+
+	switch s.Type {
+	case "string", "array", "object":
+		// Sizes are whole, gt=2 is the same as min=3
+		size := int(n)
+		if exclusive && lower {
+			size++
+		}
+
+		if exclusive && upper {
+			size--
+		}
+
+		var minField, maxField **int
+		switch s.Type {
+		case "string":
+			minField, maxField = &s.MinLength, &s.MaxLength
+		case "array":
+			minField, maxField = &s.MinItems, &s.MaxItems
+		default:
+			// Maps have no size keywords in a schema
+			return nil
+		}
+
+		if lower {
+			*minField = &size
+		}
+
+		if upper {
+			*maxField = &size
+		}
+	case "integer", "number":
+		if lower {
+			s.Minimum = &n
+			s.ExclusiveMinimum = exclusive
+		}
+
+		if upper {
+			s.Maximum = &n
+			s.ExclusiveMaximum = exclusive
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+// Package totp implements RFC 6238 time-based one-time passwords with the
+// defaults every authenticator app supports: HMAC-SHA1, 6 digits and a 30
+// second step.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+
+	// Accept codes one step either side of the current time to allow for
+	// clock drift.
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generate a random 160-bit secret, base32 encoded.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+// Key URI understood by authenticator apps, usually shown as a QR code.
+// See https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period.Seconds())))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Time step containing t
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code for the given time step.
+func Code(secret string, counter int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range Digits {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%mod), nil
+}
+
+// Validate code at time t. Returns the matching time step so callers can
+// reject a code that has already been used.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	now := Counter(t)
+
+	for counter := now - skew; counter <= now+skew; counter++ {
+		expected, err := Code(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
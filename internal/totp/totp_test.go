@@ -0,0 +1,154 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Base32 of the RFC 6238 SHA1 test seed "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 Appendix B, SHA1. The RFC lists 8 digit codes; these are their
+// last 6 digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, Counter(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != v.code {
+			t.Errorf("%d: got %s, want %s", v.unix, got, v.code)
+		}
+	}
+
+	_, err := Code("not base32!", 1)
+	if err == nil {
+		t.Error("invalid secret: got nil, want error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, v := range rfcVectors {
+		now := time.Unix(v.unix, 0)
+
+		counter, ok := Validate(rfcSecret, v.code, now)
+		if !ok || counter != Counter(now) {
+			t.Errorf("%d: got %d, %v, want %d, true", v.unix, counter, ok, Counter(now))
+		}
+	}
+
+	now := time.Unix(1111111111, 0)
+	code := "050471"
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		ok     bool
+	}{
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code, true},
+		{"spaces", rfcSecret, "050 471", true},
+		{"too short", rfcSecret, "50471", false},
+		{"too long", rfcSecret, "0504710", false},
+		{"wrong code", rfcSecret, "050472", false},
+		{"empty", rfcSecret, "", false},
+		{"other secret", "JBSWY3DPEHPK3PXP", code, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := Validate(tt.secret, tt.code, now)
+			if ok != tt.ok {
+				t.Errorf("got %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Counter(now)
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code, err := Code(rfcSecret, current+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		counter, ok := Validate(rfcSecret, code, now)
+
+		want := offset >= -skew && offset <= skew
+		if ok != want {
+			t.Errorf("step %+d: got %v, want %v", offset, ok, want)
+		}
+
+		// The matching step is returned, not the current one, so replays of
+		// an older code are caught
+		if ok && counter != current+offset {
+			t.Errorf("step %+d: got counter %d, want %d", offset, counter, current+offset)
+		}
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Web Lite", "alice@example.com", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Errorf("got %s://%s, want otpauth://totp", u.Scheme, u.Host)
+	}
+
+	if want := "/Web Lite:alice@example.com"; u.Path != want {
+		t.Errorf("label: got %q, want %q", u.Path, want)
+	}
+
+	q := u.Query()
+	for key, want := range map[string]string{
+		"secret":    rfcSecret,
+		"issuer":    "Web Lite",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	} {
+		if got := q.Get(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(key) != 20 {
+		t.Errorf("got %d bytes, want 20", len(key))
+	}
+
+	_, err = Code(secret, 1)
+	if err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+}
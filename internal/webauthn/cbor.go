@@ -0,0 +1,166 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Just enough CBOR (RFC 8949) to read attestation objects and COSE keys.
+// Maps decode to map[any]any with int64 or string keys, integers to int64,
+// byte strings to []byte and text strings to string.
+
+var errCBOR = errors.New("webauthn: malformed CBOR")
+
+const maxCBORDepth = 16
+
+// Decode a single CBOR item from the start of b. Returns the item and the
+// number of bytes it occupied.
+func decodeCBOR(b []byte) (any, int, error) {
+	d := &cborDecoder{b: b}
+
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return v, d.off, nil
+}
+
+type cborDecoder struct {
+	b   []byte
+	off int
+}
+
+func (d *cborDecoder) decode(depth int) (any, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", errCBOR)
+	}
+
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return -1 - int64(arg), nil
+	case 2:
+		return d.bytes(arg)
+	case 3:
+		b, err := d.bytes(arg)
+		return string(b), err
+	case 4:
+		if arg > uint64(len(d.b)) {
+			return nil, errCBOR
+		}
+
+		items := make([]any, 0, arg)
+		for range arg {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+
+		return items, nil
+	case 5:
+		if arg > uint64(len(d.b)) {
+			return nil, errCBOR
+		}
+
+		m := make(map[any]any, arg)
+		for range arg {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf("%w: unsupported map key", errCBOR)
+			}
+
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			m[k] = v
+		}
+
+		return m, nil
+	case 7:
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+}
+
+// Read an item head: the major type and its argument. Indefinite lengths
+// are not used by authenticators and are rejected.
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.off >= len(d.b) {
+		return 0, 0, errCBOR
+	}
+
+	initial := d.b[d.off]
+	d.off++
+
+	major := initial >> 5
+	info := initial & 0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("%w: unsupported additional info %d", errCBOR, info)
+	}
+
+	if d.off+size > len(d.b) {
+		return 0, 0, errCBOR
+	}
+
+	buf := make([]byte, 8)
+	copy(buf[8-size:], d.b[d.off:d.off+size])
+	d.off += size
+
+	return major, binary.BigEndian.Uint64(buf), nil
+}
+
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.b)-d.off) {
+		return nil, errCBOR
+	}
+
+	b := d.b[d.off : d.off+int(n)]
+	d.off += int(n)
+
+	return b, nil
+}
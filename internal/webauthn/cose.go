@@ -0,0 +1,132 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+)
+
+// COSE algorithm identifiers, https://www.iana.org/assignments/cose
+const (
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+)
+
+// COSE key types and parameters (RFC 9053)
+const (
+	ktyOKP = 1
+	ktyEC2 = 2
+	ktyRSA = 3
+
+	crvP256    = 1
+	crvEd25519 = 6
+
+	labelKty = 1
+	labelAlg = 3
+	// Curve for EC2 and OKP keys, modulus for RSA keys
+	labelCrvOrN = -1
+	// X coordinate for EC2 and OKP keys, exponent for RSA keys
+	labelXOrE = -2
+	labelY    = -3
+)
+
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// Parse a COSE_Key into a public key for one of the supported algorithms.
+func parsePublicKey(cose []byte) (*publicKey, error) {
+	v, n, err := decodeCBOR(cose)
+	if err != nil {
+		return nil, verificationError("public key: %v", err)
+	}
+
+	if n != len(cose) {
+		return nil, verificationError("trailing public key data")
+	}
+
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, verificationError("public key is not a map")
+	}
+
+	kty, _ := m[int64(labelKty)].(int64)
+	alg, _ := m[int64(labelAlg)].(int64)
+
+	switch {
+	case kty == ktyEC2 && alg == algES256:
+		crv, _ := m[int64(labelCrvOrN)].(int64)
+		x, _ := m[int64(labelXOrE)].([]byte)
+		y, _ := m[int64(labelY)].([]byte)
+		if crv != crvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, verificationError("invalid P-256 key")
+		}
+
+		// Reject points that are not on the curve
+		point := append(append([]byte{4}, x...), y...)
+		_, err := ecdh.P256().NewPublicKey(point)
+		if err != nil {
+			return nil, verificationError("invalid P-256 key: %v", err)
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		return &publicKey{alg: alg, key: key}, nil
+	case kty == ktyOKP && alg == algEdDSA:
+		crv, _ := m[int64(labelCrvOrN)].(int64)
+		x, _ := m[int64(labelXOrE)].([]byte)
+		if crv != crvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, verificationError("invalid Ed25519 key")
+		}
+
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == ktyRSA && alg == algRS256:
+		n, _ := m[int64(labelCrvOrN)].([]byte)
+		e, _ := m[int64(labelXOrE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, verificationError("invalid RSA key")
+		}
+
+		exp := new(big.Int).SetBytes(e)
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exp.Int64()),
+		}
+
+		return &publicKey{alg: alg, key: key}, nil
+	}
+
+	return nil, verificationError("unsupported key type %d with algorithm %d", kty, alg)
+}
+
+func (k *publicKey) verify(signed, sig []byte) error {
+	var ok bool
+
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(signed)
+		ok = ecdsa.VerifyASN1(key, hash[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, signed, sig)
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(signed)
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	}
+
+	if !ok {
+		return verificationError("invalid signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,422 @@
+// Package webauthn implements the relying party side of WebAuthn Level 2
+// registration and authentication ceremonies for passkeys.
+//
+// Attestation is not requested, so attestation statements are not verified:
+// a credential is trusted because the user registered it while logged in,
+// not because of who made the authenticator. Supported algorithms are ES256,
+// EdDSA (Ed25519) and RS256.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Time the browser gives the user to complete a ceremony
+const Timeout = 5 * time.Minute
+
+const challengeSize = 32
+
+// Authenticator data flags
+const (
+	flagUserPresent        = 0x01
+	flagUserVerified       = 0x04
+	flagAttestedCredential = 0x40
+	flagExtensionData      = 0x80
+)
+
+var (
+	// The response does not satisfy the ceremony
+	ErrVerification = errors.New("webauthn: verification failed")
+	// The signature counter did not increase, the authenticator may have
+	// been cloned
+	ErrSignCount = errors.New("webauthn: signature counter did not increase")
+)
+
+func verificationError(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrVerification, fmt.Sprintf(format, a...))
+}
+
+// RelyingParty is the website credentials are scoped to.
+type RelyingParty struct {
+	// Effective domain, e.g. "example.com"
+	ID   string
+	Name string
+	// Exact origin the browser reports, e.g. "https://example.com"
+	Origin string
+}
+
+// Credential is a registered public key credential.
+type Credential struct {
+	ID []byte
+	// COSE_Key encoded public key
+	PublicKey []byte
+	SignCount uint32
+	// User handle of the credential's owner, checked against the handle an
+	// assertion reports. Not known when a credential is first registered.
+	UserHandle []byte
+}
+
+// Bytes marshals to and from unpadded base64url, the encoding used for
+// binary fields in the JSON forms of WebAuthn options and responses.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	*b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+
+	return err
+}
+
+// Generate a random challenge for a single ceremony.
+func NewChallenge() ([]byte, error) {
+	b := make([]byte, challengeSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   Bytes  `json:"id"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions is the JSON form of PublicKeyCredentialCreationOptions.
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions is the JSON form of PublicKeyCredentialRequestOptions.
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// Options to register a discoverable credential for the user. Credentials
+// the user already has are excluded so an authenticator is not registered
+// twice.
+func (rp RelyingParty) CreationOptions(challenge, userHandle []byte, username string, exclude []Credential) CreationOptions {
+	opts := CreationOptions{
+		Challenge: challenge,
+		RP:        RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User: UserEntity{
+			ID:          userHandle,
+			Name:        username,
+			DisplayName: username,
+		},
+		PubKeyCredParams: []CredentialParameter{
+			{Type: "public-key", Alg: algES256},
+			{Type: "public-key", Alg: algEdDSA},
+			{Type: "public-key", Alg: algRS256},
+		},
+		Timeout:            Timeout.Milliseconds(),
+		ExcludeCredentials: []CredentialDescriptor{},
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "required",
+			UserVerification: "required",
+		},
+		Attestation: "none",
+	}
+
+	for _, c := range exclude {
+		opts.ExcludeCredentials = append(opts.ExcludeCredentials, CredentialDescriptor{
+			Type: "public-key",
+			ID:   c.ID,
+		})
+	}
+
+	return opts
+}
+
+// Options to authenticate with any discoverable credential for this relying
+// party. The user is identified by the credential they pick.
+func (rp RelyingParty) RequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          Timeout.Milliseconds(),
+		AllowCredentials: []CredentialDescriptor{},
+		UserVerification: "required",
+	}
+}
+
+// RegistrationResponse is the JSON form of a PublicKeyCredential returned
+// by navigator.credentials.create().
+type RegistrationResponse struct {
+	RawID    Bytes `json:"rawId"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AttestationObject Bytes `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON form of a PublicKeyCredential returned by
+// navigator.credentials.get().
+type AssertionResponse struct {
+	RawID    Bytes `json:"rawId"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Verify a registration ceremony started with challenge and return the new
+// credential. See https://www.w3.org/TR/webauthn-2/#sctn-registering-a-new-credential
+func (rp RelyingParty) VerifyRegistration(challenge []byte, resp *RegistrationResponse) (*Credential, error) {
+	err := rp.verifyClientData(resp.Response.ClientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	v, _, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, verificationError("attestation object: %v", err)
+	}
+
+	attestation, ok := v.(map[any]any)
+	if !ok {
+		return nil, verificationError("attestation object is not a map")
+	}
+
+	if _, ok := attestation["fmt"].(string); !ok {
+		return nil, verificationError("missing attestation format")
+	}
+
+	raw, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, verificationError("missing authenticator data")
+	}
+
+	authData, err := rp.verifyAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if authData.flags&flagAttestedCredential == 0 {
+		return nil, verificationError("no attested credential data")
+	}
+
+	if !bytes.Equal(authData.credentialID, resp.RawID) {
+		return nil, verificationError("credential ID mismatch")
+	}
+
+	// Reject keys that could not be used to verify an assertion later
+	_, err = parsePublicKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &Credential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}
+
+	return cred, nil
+}
+
+// Verify an authentication ceremony started with challenge against the
+// stored credential, returning the new signature counter to store. Returns
+// ErrSignCount if the counter went backwards. A user handle, when the
+// authenticator sends one, must be the credential's.
+// See https://www.w3.org/TR/webauthn-2/#sctn-verifying-assertion
+func (rp RelyingParty) VerifyAssertion(challenge []byte, cred *Credential, resp *AssertionResponse) (uint32, error) {
+	if !bytes.Equal(cred.ID, resp.RawID) {
+		return 0, verificationError("credential ID mismatch")
+	}
+
+	if len(resp.Response.UserHandle) > 0 && !bytes.Equal(resp.Response.UserHandle, cred.UserHandle) {
+		return 0, verificationError("user handle mismatch")
+	}
+
+	err := rp.verifyClientData(resp.Response.ClientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	authData, err := rp.verifyAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(bytes.Clone(resp.Response.AuthenticatorData), clientDataHash[:]...)
+
+	err = key.verify(signed, resp.Response.Signature)
+	if err != nil {
+		return 0, err
+	}
+
+	// Authenticators that do not implement a counter always report zero.
+	// Otherwise it must increase with every assertion.
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		return 0, ErrSignCount
+	}
+
+	return authData.signCount, nil
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func (rp RelyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	var cd clientData
+	err := json.Unmarshal(raw, &cd)
+	if err != nil {
+		return verificationError("client data: %v", err)
+	}
+
+	if cd.Type != typ {
+		return verificationError("unexpected client data type %q", cd.Type)
+	}
+
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return verificationError("challenge mismatch")
+	}
+
+	if cd.Origin != rp.Origin || cd.CrossOrigin {
+		return verificationError("unexpected origin %q", cd.Origin)
+	}
+
+	return nil
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+	// Only present when flagAttestedCredential is set
+	credentialID []byte
+	publicKey    []byte
+}
+
+// Parse authenticator data and check the RP ID hash and user flags. Passkeys
+// replace both the password and the second factor, so user verification
+// (PIN or biometric) is required, not just presence.
+func (rp RelyingParty) verifyAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, verificationError("authenticator data too short")
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(raw[:32], rpIDHash[:]) != 1 {
+		return nil, verificationError("RP ID hash mismatch")
+	}
+
+	ad := &authenticatorData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if ad.flags&flagUserPresent == 0 {
+		return nil, verificationError("user not present")
+	}
+
+	if ad.flags&flagUserVerified == 0 {
+		return nil, verificationError("user not verified")
+	}
+
+	rest := raw[37:]
+
+	if ad.flags&flagAttestedCredential != 0 {
+		// AAGUID (16 bytes), credential ID length (2 bytes)
+		if len(rest) < 18 {
+			return nil, verificationError("attested credential data too short")
+		}
+
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > 1023 || len(rest) < n {
+			return nil, verificationError("invalid credential ID length")
+		}
+
+		ad.credentialID = rest[:n]
+		rest = rest[n:]
+
+		_, size, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, verificationError("credential public key: %v", err)
+		}
+
+		ad.publicKey = rest[:size]
+		rest = rest[size:]
+	}
+
+	if ad.flags&flagExtensionData != 0 {
+		_, size, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, verificationError("extensions: %v", err)
+		}
+
+		rest = rest[size:]
+	}
+
+	if len(rest) != 0 {
+		return nil, verificationError("trailing authenticator data")
+	}
+
+	return ad, nil
+}
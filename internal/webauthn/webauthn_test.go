@@ -0,0 +1,377 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var testRP = RelyingParty{
+	ID:     "example.com",
+	Name:   "Example",
+	Origin: "https://example.com",
+}
+
+// Minimal CBOR encoder, enough to build attestation objects and COSE keys.
+// Map entries are written in the order given.
+type cborPair struct {
+	key, value any
+}
+
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n <= 0xff:
+		return append(b, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(n))
+	}
+}
+
+func appendCBOR(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return appendCBORHead(b, 1, uint64(-1-v))
+		}
+		return appendCBORHead(b, 0, uint64(v))
+	case []byte:
+		return append(appendCBORHead(b, 2, uint64(len(v))), v...)
+	case string:
+		return append(appendCBORHead(b, 3, uint64(len(v))), v...)
+	case []cborPair:
+		b = appendCBORHead(b, 5, uint64(len(v)))
+		for _, p := range v {
+			b = appendCBOR(b, p.key)
+			b = appendCBOR(b, p.value)
+		}
+		return b
+	}
+
+	panic("unsupported CBOR value")
+}
+
+// Software authenticator holding a single ES256 credential.
+type authenticator struct {
+	key        *ecdsa.PrivateKey
+	id         []byte
+	rpID       string
+	signCount  uint32
+	userHandle []byte
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &authenticator{
+		key:        key,
+		id:         []byte("credential-1"),
+		rpID:       testRP.ID,
+		userHandle: []byte("1"),
+	}
+}
+
+func (a *authenticator) coseKey() []byte {
+	pub := a.key.PublicKey
+	x := pub.X.FillBytes(make([]byte, 32))
+	y := pub.Y.FillBytes(make([]byte, 32))
+
+	return appendCBOR(nil, []cborPair{
+		{labelKty, ktyEC2},
+		{labelAlg, algES256},
+		{labelCrvOrN, crvP256},
+		{labelXOrE, x},
+		{labelY, y},
+	})
+}
+
+func (a *authenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	b := append(rpIDHash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, a.signCount)
+
+	if flags&flagAttestedCredential != 0 {
+		b = append(b, make([]byte, 16)...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, a.coseKey()...)
+	}
+
+	return b
+}
+
+func clientDataJSON(t *testing.T, typ string, challenge []byte, origin string) []byte {
+	t.Helper()
+
+	b, err := json.Marshal(clientData{
+		Type:      typ,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func (a *authenticator) create(t *testing.T, challenge []byte, origin string) *RegistrationResponse {
+	t.Helper()
+
+	attestation := appendCBOR(nil, []cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(flagUserPresent | flagUserVerified | flagAttestedCredential)},
+	})
+
+	resp := &RegistrationResponse{RawID: a.id}
+	resp.Response.ClientDataJSON = clientDataJSON(t, "webauthn.create", challenge, origin)
+	resp.Response.AttestationObject = attestation
+
+	return resp
+}
+
+func (a *authenticator) get(t *testing.T, challenge []byte, origin string) *AssertionResponse {
+	t.Helper()
+
+	a.signCount++
+
+	resp := &AssertionResponse{RawID: a.id}
+	resp.Response.ClientDataJSON = clientDataJSON(t, "webauthn.get", challenge, origin)
+	resp.Response.AuthenticatorData = a.authData(flagUserPresent | flagUserVerified)
+	resp.Response.UserHandle = a.userHandle
+
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	hash := sha256.Sum256(append(bytes.Clone(resp.Response.AuthenticatorData), clientDataHash[:]...))
+
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Response.Signature = sig
+
+	return resp
+}
+
+func newTestChallenge(t *testing.T) []byte {
+	t.Helper()
+
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return challenge
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	challenge := newTestChallenge(t)
+
+	a := newAuthenticator(t)
+
+	cred, err := testRP.VerifyRegistration(challenge, a.create(t, challenge, testRP.Origin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(cred.ID, a.id) {
+		t.Errorf("got ID %q, want %q", cred.ID, a.id)
+	}
+
+	if !bytes.Equal(cred.PublicKey, a.coseKey()) {
+		t.Error("public key does not match the authenticator's")
+	}
+
+	tests := []struct {
+		name string
+		resp func() *RegistrationResponse
+	}{
+		{
+			name: "other challenge",
+			resp: func() *RegistrationResponse {
+				return a.create(t, newTestChallenge(t), testRP.Origin)
+			},
+		},
+		{
+			name: "other origin",
+			resp: func() *RegistrationResponse {
+				return a.create(t, challenge, "https://evil.example.com")
+			},
+		},
+		{
+			name: "other RP ID",
+			resp: func() *RegistrationResponse {
+				b := newAuthenticator(t)
+				b.rpID = "evil.example.com"
+				return b.create(t, challenge, testRP.Origin)
+			},
+		},
+		{
+			name: "assertion client data",
+			resp: func() *RegistrationResponse {
+				resp := a.create(t, challenge, testRP.Origin)
+				resp.Response.ClientDataJSON = clientDataJSON(t, "webauthn.get", challenge, testRP.Origin)
+				return resp
+			},
+		},
+		{
+			name: "other credential ID",
+			resp: func() *RegistrationResponse {
+				resp := a.create(t, challenge, testRP.Origin)
+				resp.RawID = []byte("credential-2")
+				return resp
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testRP.VerifyRegistration(challenge, tt.resp())
+			if !errors.Is(err, ErrVerification) {
+				t.Fatalf("got %v, want %v", err, ErrVerification)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := newAuthenticator(t)
+
+	challenge := newTestChallenge(t)
+	cred, err := testRP.VerifyRegistration(challenge, a.create(t, challenge, testRP.Origin))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred.UserHandle = a.userHandle
+
+	// Start from a used authenticator, so the counter can go backwards
+	a.signCount = 10
+
+	challenge = newTestChallenge(t)
+	signCount, err := testRP.VerifyAssertion(challenge, cred, a.get(t, challenge, testRP.Origin))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signCount != a.signCount {
+		t.Errorf("got sign count %d, want %d", signCount, a.signCount)
+	}
+	cred.SignCount = signCount
+
+	t.Run("without user handle", func(t *testing.T) {
+		resp := a.get(t, challenge, testRP.Origin)
+		resp.Response.UserHandle = nil
+
+		_, err := testRP.VerifyAssertion(challenge, cred, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	tests := []struct {
+		name string
+		resp func() *AssertionResponse
+		want error
+	}{
+		{
+			name: "other challenge",
+			resp: func() *AssertionResponse {
+				return a.get(t, newTestChallenge(t), testRP.Origin)
+			},
+			want: ErrVerification,
+		},
+		{
+			name: "other origin",
+			resp: func() *AssertionResponse {
+				return a.get(t, challenge, "https://evil.example.com")
+			},
+			want: ErrVerification,
+		},
+		{
+			name: "other RP ID",
+			resp: func() *AssertionResponse {
+				a.rpID = "evil.example.com"
+				defer func() { a.rpID = testRP.ID }()
+				return a.get(t, challenge, testRP.Origin)
+			},
+			want: ErrVerification,
+		},
+		{
+			name: "other user handle",
+			resp: func() *AssertionResponse {
+				resp := a.get(t, challenge, testRP.Origin)
+				resp.Response.UserHandle = []byte("2")
+				return resp
+			},
+			want: ErrVerification,
+		},
+		{
+			name: "other key",
+			resp: func() *AssertionResponse {
+				b := newAuthenticator(t)
+				b.signCount = a.signCount
+				return b.get(t, challenge, testRP.Origin)
+			},
+			want: ErrVerification,
+		},
+		{
+			name: "tampered authenticator data",
+			resp: func() *AssertionResponse {
+				resp := a.get(t, challenge, testRP.Origin)
+				resp.Response.AuthenticatorData[36]++
+				return resp
+			},
+			want: ErrVerification,
+		},
+		{
+			name: "user not verified",
+			resp: func() *AssertionResponse {
+				resp := a.get(t, challenge, testRP.Origin)
+				resp.Response.AuthenticatorData[32] &^= flagUserVerified
+				return resp
+			},
+			want: ErrVerification,
+		},
+		{
+			name: "sign count replayed",
+			resp: func() *AssertionResponse {
+				a.signCount = cred.SignCount - 1
+				return a.get(t, challenge, testRP.Origin)
+			},
+			want: ErrSignCount,
+		},
+		{
+			name: "sign count went backwards",
+			resp: func() *AssertionResponse {
+				a.signCount = cred.SignCount / 2
+				return a.get(t, challenge, testRP.Origin)
+			},
+			want: ErrSignCount,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testRP.VerifyAssertion(challenge, cred, tt.resp())
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS UserPermission;
+DROP TABLE IF EXISTS Permission;
+DROP TABLE IF EXISTS Token;
+DROP TABLE IF EXISTS User;
+DROP INDEX IF EXISTS sessions_expiry_idx;
+DROP TABLE IF EXISTS sessions;
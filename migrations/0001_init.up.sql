@@ -0,0 +1,45 @@
+-- Baseline schema formerly created by initDB on every boot. IF NOT EXISTS
+-- lets databases created before migrations existed adopt this version.
+CREATE TABLE IF NOT EXISTS sessions (
+	token TEXT PRIMARY KEY,
+	data BLOB NOT NULL,
+	expiry REAL NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON sessions(expiry);
+
+CREATE TABLE IF NOT EXISTS User (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS Token (
+	hash BLOB PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	expiry TIMESTAMP NOT NULL,
+	scope TEXT NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS Permission (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS UserPermission (
+	user_id INTEGER NOT NULL,
+	permission_id INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE,
+	FOREIGN KEY (permission_id) REFERENCES Permissions (id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO Permission (name)
+VALUES
+	('admin'),
+	('services'),
+	('tags'),
+	('forwarding'),
+	('logs')
+ON CONFLICT (name) DO NOTHING;
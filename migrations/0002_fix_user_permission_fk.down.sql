@@ -0,0 +1,4 @@
+-- Keep the corrected foreign key. Restoring the reference to the missing
+-- Permissions table is rejected once foreign keys are enforced, and the
+-- schema of version 1 works the same with either reference.
+SELECT 1;
@@ -0,0 +1,16 @@
+-- UserPermission referenced the non-existent Permissions table. SQLite
+-- cannot alter a foreign key, so rebuild the table.
+CREATE TABLE UserPermission_new (
+	user_id INTEGER NOT NULL,
+	permission_id INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE,
+	FOREIGN KEY (permission_id) REFERENCES Permission (id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, permission_id)
+);
+
+INSERT INTO UserPermission_new (user_id, permission_id)
+SELECT user_id, permission_id FROM UserPermission;
+
+DROP TABLE UserPermission;
+
+ALTER TABLE UserPermission_new RENAME TO UserPermission;
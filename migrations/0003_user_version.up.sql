@@ -0,0 +1 @@
+ALTER TABLE User ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+ALTER TABLE Permission DROP COLUMN requires_two_factor;
+DROP TABLE RecoveryCode;
+DROP TABLE UserTOTP;
@@ -0,0 +1,19 @@
+CREATE TABLE UserTOTP (
+	user_id INTEGER PRIMARY KEY,
+	secret TEXT NOT NULL,
+	-- NULL until the user verifies their first code
+	confirmed_at TIMESTAMP,
+	-- Last accepted time step, so a code cannot be replayed
+	last_counter INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE
+);
+
+CREATE TABLE RecoveryCode (
+	hash BLOB PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE
+);
+
+CREATE INDEX RecoveryCode_user_id_idx ON RecoveryCode (user_id);
+
+ALTER TABLE Permission ADD COLUMN requires_two_factor INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,15 @@
+CREATE TABLE Passkey (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	credential_id BLOB NOT NULL UNIQUE,
+	-- COSE_Key encoded
+	public_key BLOB NOT NULL,
+	sign_count INTEGER NOT NULL DEFAULT 0,
+	name TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	version INTEGER NOT NULL DEFAULT 1,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE
+);
+
+CREATE INDEX Passkey_user_id_idx ON Passkey (user_id);
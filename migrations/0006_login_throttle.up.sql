@@ -0,0 +1,8 @@
+-- Failed login attempts per client IP ("ip:...") and per username ("user:...")
+CREATE TABLE LoginThrottle (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL,
+	last_failure TIMESTAMP NOT NULL,
+	-- Attempts are refused until this time
+	blocked_until TIMESTAMP
+);
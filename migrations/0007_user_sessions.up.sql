@@ -0,0 +1,15 @@
+-- Index of authenticated sessions, which scs stores as opaque blobs
+CREATE TABLE UserSession (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- SHA-256 of the scs session token
+	token_hash BLOB NOT NULL UNIQUE,
+	user_id INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	last_seen_at TIMESTAMP NOT NULL,
+	expiry TIMESTAMP NOT NULL,
+	ip TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE
+);
+
+CREATE INDEX UserSession_user_id_idx ON UserSession (user_id);
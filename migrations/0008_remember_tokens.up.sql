@@ -0,0 +1,15 @@
+-- Persistent login tokens. Each use replaces the token with a new one in the
+-- same family; used tokens are kept until they expire to detect theft.
+CREATE TABLE RememberToken (
+	selector TEXT PRIMARY KEY,
+	-- SHA-256 of the secret half of the token
+	validator_hash BLOB NOT NULL,
+	user_id INTEGER NOT NULL,
+	family TEXT NOT NULL,
+	expiry TIMESTAMP NOT NULL,
+	used_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE
+);
+
+CREATE INDEX RememberToken_family_idx ON RememberToken (family);
+CREATE INDEX RememberToken_user_id_idx ON RememberToken (user_id);
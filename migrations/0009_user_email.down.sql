@@ -0,0 +1,3 @@
+DROP INDEX User_email_idx;
+ALTER TABLE User DROP COLUMN verified_at;
+ALTER TABLE User DROP COLUMN email;
@@ -0,0 +1,6 @@
+-- Email address collected at signup when verification is enabled. Accounts
+-- with an unverified address are limited until the emailed link is followed.
+ALTER TABLE User ADD COLUMN email TEXT;
+ALTER TABLE User ADD COLUMN verified_at TIMESTAMP;
+
+CREATE UNIQUE INDEX User_email_idx ON User (email);
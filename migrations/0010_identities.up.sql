@@ -0,0 +1,16 @@
+-- Accounts at external identity providers linked to users, keyed by the
+-- provider's issuer URL and its subject identifier for the account.
+CREATE TABLE Identity (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	issuer TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	-- Email or username at the provider, for display only
+	name TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	UNIQUE (issuer, subject),
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE
+);
+
+CREATE INDEX Identity_user_id_idx ON Identity (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE AccessTokenPermission;
+DROP TABLE AccessToken;
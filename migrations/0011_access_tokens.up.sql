@@ -0,0 +1,23 @@
+-- Personal access tokens used by scripts to call the API as a user
+CREATE TABLE AccessToken (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- SHA-256 of the plaintext token
+	token_hash BLOB NOT NULL UNIQUE,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expiry TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES User (id) ON DELETE CASCADE
+);
+
+CREATE INDEX AccessToken_user_id_idx ON AccessToken (user_id);
+
+-- Permissions a token may use, out of those its user holds
+CREATE TABLE AccessTokenPermission (
+	access_token_id INTEGER NOT NULL,
+	permission_id INTEGER NOT NULL,
+	PRIMARY KEY (access_token_id, permission_id),
+	FOREIGN KEY (access_token_id) REFERENCES AccessToken (id) ON DELETE CASCADE,
+	FOREIGN KEY (permission_id) REFERENCES Permission (id) ON DELETE CASCADE
+);
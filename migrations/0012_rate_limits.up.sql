@@ -0,0 +1,8 @@
+-- Requests counted per key in fixed windows, such as signups per client IP
+-- ("signup-ip:...") or verification emails per user ("verify:...")
+CREATE TABLE RateLimit (
+	key TEXT PRIMARY KEY,
+	hits INTEGER NOT NULL,
+	-- End of the current window, when the count starts over
+	expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,3 @@
+-- Sessions stored under the hash of their token cannot be found by the token
+DELETE FROM sessions;
+DELETE FROM UserSession;
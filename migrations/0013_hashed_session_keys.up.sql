@@ -0,0 +1,4 @@
+-- Sessions are now stored under the hash of their token. Those stored under
+-- the token itself can no longer be found, so log everyone out once.
+DELETE FROM sessions;
+DELETE FROM UserSession;
@@ -0,0 +1,281 @@
+// Interactive docs for the API, rendered from its OpenAPI document. The page
+// is built with DOM methods only so that it runs under the CSP, which allows
+// neither inline scripts nor inline styles.
+(function () {
+    "use strict";
+
+    const specURL = "/api/openapi.json";
+
+    function el(tag, props, ...children) {
+        const e = document.createElement(tag);
+        Object.assign(e, props);
+        for (const child of children) {
+            if (child !== null && child !== undefined) {
+                e.append(child);
+            }
+        }
+        return e;
+    }
+
+    // Follow a local "#/components/schemas/Name" reference
+    function resolve(spec, schema) {
+        if (schema && schema.$ref) {
+            const name = schema.$ref.split("/").pop();
+            return { name: name, ...spec.components.schemas[name] };
+        }
+        return schema || {};
+    }
+
+    function constraints(schema) {
+        const parts = [];
+        if (schema.format) {
+            parts.push(schema.format);
+        }
+        if (schema.enum) {
+            parts.push("one of " + schema.enum.join(", "));
+        }
+        for (const [key, label] of [
+            ["minLength", "min length"],
+            ["maxLength", "max length"],
+            ["minItems", "min items"],
+            ["maxItems", "max items"],
+            ["minimum", schema.exclusiveMinimum ? ">" : ">="],
+            ["maximum", schema.exclusiveMaximum ? "<" : "<="],
+        ]) {
+            if (schema[key] !== undefined) {
+                parts.push(label + " " + schema[key]);
+            }
+        }
+        if (schema.nullable) {
+            parts.push("nullable");
+        }
+        return parts.join(", ");
+    }
+
+    function typeName(spec, schema) {
+        const s = resolve(spec, schema);
+        if (s.name) {
+            return s.name;
+        }
+        if (s.type === "array") {
+            return typeName(spec, s.items) + "[]";
+        }
+        if (s.type === "object" && s.additionalProperties) {
+            return "map of " + typeName(spec, s.additionalProperties);
+        }
+        return s.type || "any";
+    }
+
+    // Nested list of the properties of an object schema
+    function renderSchema(spec, schema, depth) {
+        let s = resolve(spec, schema);
+        if (s.type === "array") {
+            s = resolve(spec, s.items);
+        }
+        if (!s.properties || depth > 4) {
+            return null;
+        }
+
+        const required = s.required || [];
+        const list = el("ul");
+        for (const [name, prop] of Object.entries(s.properties)) {
+            const resolved = resolve(spec, prop);
+            const details = [typeName(spec, prop), constraints(resolved)];
+            if (required.includes(name)) {
+                details.push("required");
+            }
+            list.append(el("li", {},
+                el("code", { textContent: name }),
+                " " + details.filter(Boolean).join(", "),
+                renderSchema(spec, prop, depth + 1),
+            ));
+        }
+        return list;
+    }
+
+    // Sample value of a schema, to prefill request bodies
+    function example(spec, schema, depth) {
+        const s = resolve(spec, schema);
+        if (s.enum) {
+            return s.enum[0];
+        }
+        switch (s.type) {
+        case "object":
+            if (!s.properties || depth > 4) {
+                return {};
+            }
+            return Object.fromEntries(Object.entries(s.properties)
+                .map(([name, prop]) => [name, example(spec, prop, depth + 1)]));
+        case "array":
+            return [example(spec, s.items, depth + 1)];
+        case "integer":
+        case "number":
+            return s.minimum !== undefined ? s.minimum : 1;
+        case "boolean":
+            return false;
+        case "string":
+            if (s.format === "email") {
+                return "user@example.com";
+            }
+            if (s.format === "date-time") {
+                return new Date().toISOString();
+            }
+            return "x".repeat(s.minLength || 1);
+        default:
+            return null;
+        }
+    }
+
+    // Form to call the operation with the token of the page
+    function renderTryIt(spec, path, method, op) {
+        const form = el("form");
+        const inputs = [];
+
+        for (const param of op.parameters || []) {
+            const id = op.operationId + "-" + param.name;
+            const input = el("input", { id: id, name: param.name, required: !!param.required });
+            inputs.push({ param: param, input: input });
+            form.append(el("div", {},
+                el("label", { htmlFor: id, textContent: param.name + " (" + param.in + ")" }),
+                input,
+            ));
+        }
+
+        let body = null;
+        if (op.requestBody) {
+            const schema = op.requestBody.content["application/json"].schema;
+            body = el("textarea", {
+                id: op.operationId + "-body",
+                rows: 6,
+                cols: 60,
+                value: JSON.stringify(example(spec, schema, 0), null, 2),
+            });
+            form.append(el("div", {},
+                el("label", { htmlFor: body.id, textContent: "Body" }),
+                body,
+            ));
+        }
+
+        const output = el("pre");
+        form.append(el("button", { textContent: "Send" }), output);
+
+        form.addEventListener("submit", async (event) => {
+            event.preventDefault();
+
+            let url = path;
+            const query = new URLSearchParams();
+            for (const { param, input } of inputs) {
+                if (param.in === "path") {
+                    url = url.replace("{" + param.name + "}", encodeURIComponent(input.value));
+                } else if (input.value !== "") {
+                    query.set(param.name, input.value);
+                }
+            }
+            if (query.size > 0) {
+                url += "?" + query;
+            }
+
+            const headers = {};
+            const token = document.getElementById("api-token").value.trim();
+            if (token !== "") {
+                headers["Authorization"] = "Bearer " + token;
+            }
+            if (body) {
+                headers["Content-Type"] = "application/json";
+            }
+
+            output.textContent = "";
+            try {
+                const res = await fetch(url, {
+                    method: method.toUpperCase(),
+                    headers: headers,
+                    body: body ? body.value : undefined,
+                    credentials: "omit",
+                });
+                let text = await res.text();
+                try {
+                    text = JSON.stringify(JSON.parse(text), null, 2);
+                } catch {
+                    // Not JSON, shown as is
+                }
+                output.textContent = res.status + " " + res.statusText + "\n" + text;
+            } catch (err) {
+                output.textContent = err.message;
+            }
+        });
+
+        return form;
+    }
+
+    function renderOperation(spec, path, method, op) {
+        const summary = el("summary", {},
+            el("code", { textContent: method.toUpperCase() + " " + path }),
+            " " + (op.summary || ""),
+        );
+
+        const section = el("details", {}, summary);
+        if (op.description) {
+            section.append(el("p", { textContent: op.description }));
+        }
+        if (!op.security) {
+            section.append(el("p", { textContent: "No access token needed." }));
+        }
+
+        if (op.requestBody) {
+            const schema = op.requestBody.content["application/json"].schema;
+            section.append(
+                el("h4", { textContent: "Request body: " + typeName(spec, schema) }),
+                renderSchema(spec, schema, 0),
+            );
+        }
+
+        const responses = el("ul");
+        for (const [status, res] of Object.entries(op.responses)) {
+            const content = res.content && res.content["application/json"];
+            responses.append(el("li", {},
+                el("code", { textContent: status }),
+                " " + res.description + (content ? ": " + typeName(spec, content.schema) : ""),
+                status.startsWith("2") && content ? renderSchema(spec, content.schema, 0) : null,
+            ));
+        }
+        section.append(el("h4", { textContent: "Responses" }), responses);
+
+        section.append(el("h4", { textContent: "Try it" }), renderTryIt(spec, path, method, op));
+
+        return section;
+    }
+
+    function render(spec) {
+        document.getElementById("api-title").textContent = spec.info.title + " API";
+        document.getElementById("api-description").textContent = spec.info.description || "";
+
+        // Group operations by their first tag, in document order
+        const tags = new Map();
+        for (const [path, item] of Object.entries(spec.paths)) {
+            for (const [method, op] of Object.entries(item)) {
+                const tag = (op.tags && op.tags[0]) || "other";
+                if (!tags.has(tag)) {
+                    tags.set(tag, []);
+                }
+                tags.get(tag).push(renderOperation(spec, path, method, op));
+            }
+        }
+
+        const container = document.getElementById("api-operations");
+        for (const [tag, sections] of tags) {
+            container.append(el("h2", { textContent: tag }), ...sections);
+        }
+    }
+
+    fetch(specURL)
+        .then((res) => {
+            if (!res.ok) {
+                throw new Error("Unable to load " + specURL + ": " + res.status);
+            }
+            return res.json();
+        })
+        .then(render)
+        .catch((err) => {
+            document.getElementById("api-error").textContent = err.message;
+        });
+})();
@@ -0,0 +1,115 @@
+// Passkey registration and login. The server sends WebAuthn options as JSON
+// with binary fields in base64url, and expects credentials back in the same
+// form.
+(function () {
+    "use strict";
+
+    if (!window.PublicKeyCredential) {
+        return;
+    }
+
+    function toBase64url(buffer) {
+        const bytes = new Uint8Array(buffer);
+        let s = "";
+        for (const b of bytes) {
+            s += String.fromCharCode(b);
+        }
+        return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+
+    function fromBase64url(s) {
+        s = s.replace(/-/g, "+").replace(/_/g, "/");
+        const bin = atob(s + "===".slice((s.length + 3) % 4));
+        return Uint8Array.from(bin, (c) => c.charCodeAt(0));
+    }
+
+    async function post(url, csrfToken, body) {
+        const res = await fetch(url, {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+                "X-CSRF-Token": csrfToken,
+            },
+            body: body === undefined ? undefined : JSON.stringify(body),
+        });
+        const data = await res.json();
+        if (!res.ok) {
+            throw new Error(data.error || res.statusText);
+        }
+        return data;
+    }
+
+    // Wire up a container holding a CSRF token, a button and an error span
+    function setup(id, ceremony) {
+        const el = document.getElementById(id);
+        if (!el) {
+            return;
+        }
+
+        const csrfToken = el.querySelector("input[name=csrf_token]").value;
+        const button = el.querySelector("button");
+        const error = el.querySelector(".form-error");
+
+        button.addEventListener("click", async () => {
+            button.disabled = true;
+            error.textContent = "";
+            try {
+                const data = await ceremony(el, csrfToken);
+                window.location.assign(data.redirect);
+            } catch (err) {
+                error.textContent = err.message;
+                button.disabled = false;
+            }
+        });
+
+        el.hidden = false;
+    }
+
+    setup("passkey-login", async (el, csrfToken) => {
+        const options = await post("/auth/passkey/options", csrfToken);
+        options.challenge = fromBase64url(options.challenge);
+
+        const cred = await navigator.credentials.get({ publicKey: options });
+
+        return post("/auth/passkey", csrfToken, {
+            id: cred.id,
+            rawId: toBase64url(cred.rawId),
+            type: cred.type,
+            response: {
+                clientDataJSON: toBase64url(cred.response.clientDataJSON),
+                authenticatorData: toBase64url(cred.response.authenticatorData),
+                signature: toBase64url(cred.response.signature),
+                userHandle: cred.response.userHandle ? toBase64url(cred.response.userHandle) : "",
+            },
+        });
+    });
+
+    setup("passkey-register", async (el, csrfToken) => {
+        const name = el.querySelector("input[name=name]").value.trim();
+        if (name === "") {
+            throw new Error("Please name this passkey.");
+        }
+
+        const options = await post("/account/passkeys/options", csrfToken);
+        options.challenge = fromBase64url(options.challenge);
+        options.user.id = fromBase64url(options.user.id);
+        for (const c of options.excludeCredentials) {
+            c.id = fromBase64url(c.id);
+        }
+
+        const cred = await navigator.credentials.create({ publicKey: options });
+
+        return post("/account/passkeys", csrfToken, {
+            name: name,
+            credential: {
+                id: cred.id,
+                rawId: toBase64url(cred.rawId),
+                type: cred.type,
+                response: {
+                    clientDataJSON: toBase64url(cred.response.clientDataJSON),
+                    attestationObject: toBase64url(cred.response.attestationObject),
+                },
+            },
+        });
+    });
+})();